@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	networkConfigFile = `network.json`
+
+	maxAddressAllocationAttempts = 1000
+)
+
+// networkConfig holds network settings of the root dir.
+type networkConfig struct {
+	Subnet        string `json:"subnet,omitempty"`
+	HashAddresses bool   `json:"hash_addresses,omitempty"`
+
+	Networks       map[string]*namedNetwork `json:"networks,omitempty"`
+	DefaultNetwork string                   `json:"default_network,omitempty"`
+}
+
+func readNetworkConfig(rootDir string) (*networkConfig, error) {
+	config := &networkConfig{}
+
+	data, err := ioutil.ReadFile(filepath.Join(rootDir, networkConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode %s", networkConfigFile,
+		)
+	}
+
+	return config, nil
+}
+
+func writeNetworkConfig(rootDir string, config *networkConfig) error {
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(
+		filepath.Join(rootDir, networkConfigFile), data, 0644,
+	)
+}
+
+// configureNetwork updates network config of the root dir with specified
+// subnet and address allocation mode, if they are specified.
+func configureNetwork(rootDir string, subnet string, hashed bool) error {
+	if subnet == "" && !hashed {
+		return nil
+	}
+
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return err
+	}
+
+	if subnet != "" {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil || network.IP.To4() == nil {
+			return fmt.Errorf(
+				"invalid subnet '%s', should be IPv4 network/prefix", subnet,
+			)
+		}
+
+		config.Subnet = network.String()
+	}
+
+	if hashed {
+		config.HashAddresses = true
+	}
+
+	return writeNetworkConfig(rootDir, config)
+}
+
+// allocateContainerAddress returns new address for container according to
+// network config of the root dir.
+func allocateContainerAddress(
+	rootDir string,
+	containerName string,
+	bridgeAddress string,
+) (string, error) {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't read network config of '%s'", rootDir,
+		)
+	}
+
+	subnet, err := getContainerSubnet(rootDir, bridgeAddress)
+	if err != nil {
+		return "", err
+	}
+
+	return allocateAddress(
+		rootDir, containerName, subnet, bridgeAddress, config.HashAddresses,
+	)
+}
+
+// getContainerSubnet returns subnet, which is used to allocate container
+// addresses: subnet configured for the root dir, network of the bridge
+// address or default network.
+func getContainerSubnet(
+	rootDir string,
+	bridgeAddress string,
+) (*net.IPNet, error) {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't read network config of '%s'", rootDir,
+		)
+	}
+
+	var bridgeIP net.IP
+	for _, address := range splitAddresses(bridgeAddress) {
+		if !isIPv6Address(address) {
+			bridgeIP, _, _ = net.ParseCIDR(address)
+		}
+	}
+
+	subnet := config.Subnet
+	if subnet == "" {
+		if bridgeIP == nil {
+			subnet = defaultContainerNetwork
+		} else {
+			subnet = getIPv4Address(bridgeAddress)
+		}
+	}
+
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "invalid subnet '%s'", subnet,
+		)
+	}
+
+	if bridgeIP != nil && !network.Contains(bridgeIP) {
+		return nil, fmt.Errorf(
+			"bridge address %s is not in subnet %s, "+
+				"specify bridge address from the subnet with -b",
+			bridgeIP, network,
+		)
+	}
+
+	return network, nil
+}
+
+// allocateAddress returns new IPv4 address for container from subnet. Address
+// is either random or derived from container name, so the same name always
+// gets the same address. Addresses, which are used by other containers in
+// the root dir or by host routes, are skipped.
+func allocateAddress(
+	rootDir string,
+	containerName string,
+	subnet *net.IPNet,
+	bridgeAddress string,
+	hashed bool,
+) (string, error) {
+	ones, bits := subnet.Mask.Size()
+	if bits != 8*net.IPv4len || bits-ones < 2 {
+		return "", fmt.Errorf(
+			"subnet %s should be IPv4 network with at least 2 hosts",
+			subnet,
+		)
+	}
+
+	leases, err := getLeasedAddresses(rootDir, containerName)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't get addresses of containers",
+		)
+	}
+
+	for _, address := range splitAddresses(bridgeAddress) {
+		ip, _, err := net.ParseCIDR(address)
+		if err == nil {
+			leases[ip.String()] = true
+		}
+	}
+
+	routes, err := getHostRoutes(bridgeAddress)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't get host routes",
+		)
+	}
+
+	size := uint64(1) << uint(bits-ones)
+	base := uint64(binary.BigEndian.Uint32(subnet.IP.To4()))
+
+	offset := uint64(rand.Int63())
+	if hashed {
+		hash := sha256.Sum256([]byte(containerName))
+		offset = binary.BigEndian.Uint64(hash[:8])
+	}
+
+	for attempt := uint64(0); attempt < maxAddressAllocationAttempts; attempt++ {
+		host := (offset + attempt) % size
+
+		// network and broadcast addresses
+		if host == 0 || host == size-1 {
+			continue
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(base+host))
+
+		if leases[ip.String()] || isRoutedByHost(ip, routes) {
+			continue
+		}
+
+		return (&net.IPNet{IP: ip, Mask: subnet.Mask}).String(), nil
+	}
+
+	return "", fmt.Errorf(
+		"can't find free address in subnet %s", subnet,
+	)
+}
+
+// getLeasedAddresses returns addresses of all containers in the root dir
+// except specified one and addresses leased by DHCP server.
+func getLeasedAddresses(
+	rootDir string,
+	containerName string,
+) (map[string]bool, error) {
+	leases := map[string]bool{}
+
+	files, err := filepath.Glob(getContainerStateFile(rootDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if name == containerName {
+			continue
+		}
+
+		state, err := readContainerState(rootDir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses := splitAddresses(state.Address)
+		for _, network := range state.Networks {
+			addresses = append(addresses, splitAddresses(network.Address)...)
+		}
+
+		for _, address := range addresses {
+			ip, _, err := net.ParseCIDR(address)
+			if err == nil {
+				leases[ip.String()] = true
+			}
+		}
+	}
+
+	dhcpLeases, err := readDHCPLeases(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for mac, lease := range dhcpLeases {
+		if mac == containerName {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(lease.Address)
+		if err == nil {
+			leases[ip.String()] = true
+		}
+	}
+
+	return leases, nil
+}
+
+// getHostRoutes returns networks, which are routed by host through other
+// interfaces than container bridge, and host's own addresses.
+func getHostRoutes(bridgeAddress string) ([]*net.IPNet, error) {
+	command := exec.Command("ip", "-4", "route", "show", "table", "all")
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHostRoutes(string(output), bridgeAddress), nil
+}
+
+// parseHostRoutes parses output of ip route and returns routed networks
+// except networks of the bridge.
+func parseHostRoutes(output string, bridgeAddress string) []*net.IPNet {
+	bridgeNetworks := []*net.IPNet{}
+	for _, address := range splitAddresses(bridgeAddress) {
+		_, network, err := net.ParseCIDR(address)
+		if err == nil {
+			bridgeNetworks = append(bridgeNetworks, network)
+		}
+	}
+
+	routes := []*net.IPNet{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		destination := fields[0]
+		if destination == "local" && len(fields) > 1 {
+			destination = fields[1]
+		} else if destination == "default" ||
+			destination == "broadcast" ||
+			strings.Contains(destination, ":") {
+			continue
+		}
+
+		if !strings.Contains(destination, "/") {
+			destination += "/32"
+		}
+
+		_, network, err := net.ParseCIDR(destination)
+		if err != nil {
+			continue
+		}
+
+		isBridgeNetwork := false
+		for _, bridgeNetwork := range bridgeNetworks {
+			if bridgeNetwork.String() == network.String() {
+				isBridgeNetwork = true
+			}
+		}
+
+		if !isBridgeNetwork {
+			routes = append(routes, network)
+		}
+	}
+
+	return routes
+}
+
+func isRoutedByHost(ip net.IP, routes []*net.IPNet) bool {
+	for _, route := range routes {
+		if route.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestParseHostRoutes(t *testing.T) {
+	output := "default via 192.0.2.1 dev eth0\n" +
+		"10.0.0.0/8 dev br0 proto kernel scope link src 10.0.0.1\n" +
+		"192.0.2.0/24 dev eth0 proto kernel scope link src 192.0.2.2\n" +
+		"198.51.100.0/24 via 192.0.2.1 dev eth0\n" +
+		"local 10.0.0.1 dev br0 table local proto kernel scope host\n" +
+		"local 192.0.2.2 dev eth0 table local proto kernel scope host\n" +
+		"broadcast 192.0.2.255 dev eth0 table local proto kernel scope link\n" +
+		"unreachable 203.0.113.0/24\n" +
+		"fd00::/64 dev br0 proto kernel metric 256\n"
+
+	routes := []string{}
+	for _, route := range parseHostRoutes(output, "10.0.0.1/8,fd00::1/64") {
+		routes = append(routes, route.String())
+	}
+
+	expected := []string{
+		"192.0.2.0/24",
+		"198.51.100.0/24",
+		"10.0.0.1/32",
+		"192.0.2.2/32",
+	}
+
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected %v, got %v", expected, routes)
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip is not installed")
+	}
+
+	rootDir, err := ioutil.TempDir("", "hastur-address-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(rootDir)
+
+	// benchmarking network is not expected to be routed by test host
+	_, subnet, _ := net.ParseCIDR("198.18.0.0/29")
+
+	hashed, err := allocateAddress(rootDir, "web", subnet, "198.18.0.1/29", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		address, err := allocateAddress(rootDir, "web", subnet, "198.18.0.1/29", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if address != hashed {
+			t.Errorf("hashed address is changed: %s, then %s", hashed, address)
+		}
+	}
+
+	err = writeContainerState(rootDir, "web", &containerState{
+		Address: hashed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// address of container itself is not considered leased
+	address, err := allocateAddress(rootDir, "web", subnet, "198.18.0.1/29", true)
+	if err != nil || address != hashed {
+		t.Errorf("expected own address %s, got %s (%v)", hashed, address, err)
+	}
+
+	allocated := map[string]bool{hashed: true}
+	for _, name := range []string{"db", "cache", "queue", "proxy"} {
+		address, err := allocateAddress(
+			rootDir, name, subnet, "198.18.0.1/29", false,
+		)
+		if err != nil {
+			t.Fatalf("%s: can't allocate address: %s", name, err)
+		}
+
+		ip, network, err := net.ParseCIDR(address)
+		if err != nil || network.String() != subnet.String() {
+			t.Fatalf("%s: invalid address %s", name, address)
+		}
+
+		if allocated[address] || ip.Equal(net.ParseIP("198.18.0.1")) ||
+			ip.Equal(subnet.IP) || ip.Equal(net.ParseIP("198.18.0.7")) {
+			t.Fatalf("%s: address %s is already used", name, address)
+		}
+
+		allocated[address] = true
+
+		err = writeContainerState(rootDir, name, &containerState{
+			Address: address,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 6 hosts: bridge and 5 containers
+	_, err = allocateAddress(rootDir, "extra", subnet, "198.18.0.1/29", false)
+	if err == nil {
+		t.Errorf("expected error on exhausted subnet, got none")
+	}
+
+	for _, invalid := range []string{"198.18.0.0/31", "fd00::/64"} {
+		_, network, _ := net.ParseCIDR(invalid)
+
+		_, err = allocateAddress(rootDir, "web", network, "", false)
+		if err == nil {
+			t.Errorf("%s: expected error, got none", invalid)
+		}
+	}
+}
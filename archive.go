@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+)
+
+func listArchive(archive string) ([]string, error) {
+	command := exec.Command("tar", "-tf", archive)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
+}
+
+func extractArchive(archive string, target string, args ...string) error {
+	return runTar(append([]string{"-xf", archive, "-C", target}, args...)...)
+}
+
+func createArchive(archive string, dir string, entries ...string) error {
+	return runTar(append([]string{"-cf", archive, "-C", dir}, entries...)...)
+}
+
+func createCompressedArchive(archive string, dir string) error {
+	return runTar("--zstd", "-cf", archive, "-C", dir, ".")
+}
+
+func runTar(args ...string) error {
+	command := exec.Command(
+		"tar",
+		append([]string{
+			"--numeric-owner", "--xattrs", "--xattrs-include=*",
+		}, args...)...,
+	)
+
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
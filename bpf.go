@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// classic BPF opcodes, which are used by filter compiler
+const (
+	bpfLoadWord     = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfLoadHalf     = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS
+	bpfLoadByte     = syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS
+	bpfLoadHalfX    = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND
+	bpfLoadHeaderX  = syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH
+	bpfJumpEqual    = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfJumpSet      = syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K
+	bpfReturn       = syscall.BPF_RET | syscall.BPF_K
+	bpfAcceptLength = 0x40000
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeARP  = 0x0806
+
+	ipProtocolICMP   = 1
+	ipProtocolTCP    = 6
+	ipProtocolUDP    = 17
+	ipProtocolICMPv6 = 58
+)
+
+const (
+	bpfLabelNext   = "next"
+	bpfLabelReject = "reject"
+)
+
+// bpfBytecodeRegexp matches program in format of tcpdump -ddd output with
+// lines separated by commas, e.g. "1,6 0 0 65535".
+var bpfBytecodeRegexp = regexp.MustCompile(`^\d+(,\d+ \d+ \d+ \d+)+$`)
+
+// bpfInstruction is instruction with symbolic jump targets, which are
+// resolved when program is assembled.
+type bpfInstruction struct {
+	code  uint16
+	k     uint32
+	label string
+	jt    string
+	jf    string
+}
+
+func bpfStatement(code uint16, k uint32) bpfInstruction {
+	return bpfInstruction{code: code, k: k}
+}
+
+func bpfJump(code uint16, k uint32, jt string, jf string) bpfInstruction {
+	return bpfInstruction{code: code, k: k, jt: jt, jf: jf}
+}
+
+// compileFilter compiles capture filter into classic BPF program. Filter is
+// either program in tcpdump -ddd format or expression of primitives joined
+// by "and". Supported primitives are: ip, ip6, arp, tcp, udp, icmp,
+// host ADDRESS and port PORT.
+func compileFilter(filter string) ([]syscall.SockFilter, error) {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return nil, nil
+	}
+
+	if isBPFBytecode(filter) {
+		return parseBPFBytecode(compactBPFBytecode(filter))
+	}
+
+	program := []bpfInstruction{}
+
+	tokens := strings.Fields(filter)
+	for len(tokens) > 0 {
+		var (
+			fragment []bpfInstruction
+			err      error
+		)
+
+		switch tokens[0] {
+		case "ip":
+			fragment = compileEtherType(etherTypeIPv4)
+		case "ip6":
+			fragment = compileEtherType(etherTypeIPv6)
+		case "arp":
+			fragment = compileEtherType(etherTypeARP)
+		case "tcp":
+			fragment = compileIPProtocol(ipProtocolTCP, ipProtocolTCP)
+		case "udp":
+			fragment = compileIPProtocol(ipProtocolUDP, ipProtocolUDP)
+		case "icmp":
+			fragment = compileIPProtocol(ipProtocolICMP, ipProtocolICMPv6)
+
+		case "host", "port":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf(
+					"%s requires argument in filter '%s'", tokens[0], filter,
+				)
+			}
+
+			if tokens[0] == "host" {
+				fragment, err = compileHost(tokens[1])
+			} else {
+				fragment, err = compilePort(tokens[1])
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = tokens[1:]
+
+		default:
+			return nil, fmt.Errorf(
+				"unsupported filter primitive '%s', supported are: "+
+					"ip, ip6, arp, tcp, udp, icmp, host ADDRESS, port PORT",
+				tokens[0],
+			)
+		}
+
+		program = append(program, relabel(fragment, len(program))...)
+
+		tokens = tokens[1:]
+		if len(tokens) > 0 {
+			if tokens[0] != "and" || len(tokens) == 1 {
+				return nil, fmt.Errorf(
+					"primitives should be joined by 'and' in filter '%s'",
+					filter,
+				)
+			}
+
+			tokens = tokens[1:]
+		}
+	}
+
+	program = append(
+		program,
+		bpfInstruction{code: bpfReturn, k: bpfAcceptLength, label: "accept"},
+		bpfInstruction{code: bpfReturn, k: 0, label: bpfLabelReject},
+	)
+
+	return assembleBPF(program)
+}
+
+// relabel makes local labels of fragment unique and points "next" label to
+// the instruction after fragment.
+func relabel(fragment []bpfInstruction, offset int) []bpfInstruction {
+	next := fmt.Sprintf("f%d", offset+len(fragment))
+
+	rename := func(label string) string {
+		switch label {
+		case "", bpfLabelReject:
+			return label
+		case bpfLabelNext:
+			return next
+		default:
+			return fmt.Sprintf("f%d.%s", offset, label)
+		}
+	}
+
+	result := []bpfInstruction{}
+	for i, instruction := range fragment {
+		instruction.jt = rename(instruction.jt)
+		instruction.jf = rename(instruction.jf)
+
+		if instruction.label != "" {
+			instruction.label = rename(instruction.label)
+		}
+
+		if i == 0 {
+			instruction.label = joinLabels(
+				instruction.label, fmt.Sprintf("f%d", offset),
+			)
+		}
+
+		result = append(result, instruction)
+	}
+
+	return result
+}
+
+func joinLabels(labels ...string) string {
+	result := []string{}
+	for _, label := range labels {
+		if label != "" {
+			result = append(result, label)
+		}
+	}
+
+	return strings.Join(result, " ")
+}
+
+// assembleBPF resolves symbolic jump targets into relative offsets.
+func assembleBPF(program []bpfInstruction) ([]syscall.SockFilter, error) {
+	labels := map[string]int{}
+	for index, instruction := range program {
+		for _, label := range strings.Fields(instruction.label) {
+			labels[label] = index
+		}
+	}
+
+	// "next" of the last fragment points to the accept instruction
+	labels[fmt.Sprintf("f%d", len(program)-2)] = len(program) - 2
+
+	resolve := func(index int, label string) (uint8, error) {
+		if label == "" {
+			return 0, nil
+		}
+
+		target, ok := labels[label]
+		if !ok || target <= index || target-index-1 > 255 {
+			return 0, fmt.Errorf("invalid jump to '%s'", label)
+		}
+
+		return uint8(target - index - 1), nil
+	}
+
+	filter := []syscall.SockFilter{}
+	for index, instruction := range program {
+		jt, err := resolve(index, instruction.jt)
+		if err != nil {
+			return nil, err
+		}
+
+		jf, err := resolve(index, instruction.jf)
+		if err != nil {
+			return nil, err
+		}
+
+		filter = append(filter, syscall.SockFilter{
+			Code: instruction.code,
+			Jt:   jt,
+			Jf:   jf,
+			K:    instruction.k,
+		})
+	}
+
+	return filter, nil
+}
+
+func compileEtherType(etherType uint32) []bpfInstruction {
+	return []bpfInstruction{
+		bpfStatement(bpfLoadHalf, 12),
+		bpfJump(bpfJumpEqual, etherType, bpfLabelNext, bpfLabelReject),
+	}
+}
+
+func compileIPProtocol(protocol uint32, protocolv6 uint32) []bpfInstruction {
+	return []bpfInstruction{
+		bpfStatement(bpfLoadHalf, 12),
+		bpfJump(bpfJumpEqual, etherTypeIPv4, "", "ip6"),
+		bpfStatement(bpfLoadByte, 23),
+		bpfJump(bpfJumpEqual, protocol, bpfLabelNext, bpfLabelReject),
+		{
+			code: bpfJumpEqual, k: etherTypeIPv6, label: "ip6",
+			jf: bpfLabelReject,
+		},
+		bpfStatement(bpfLoadByte, 20),
+		bpfJump(bpfJumpEqual, protocolv6, bpfLabelNext, bpfLabelReject),
+	}
+}
+
+// compilePort matches TCP and UDP packets with specified source or
+// destination port. IPv4 fragments and IPv6 extension headers are not
+// matched.
+func compilePort(value string) ([]bpfInstruction, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port '%s' in filter", value)
+	}
+
+	k := uint32(port)
+
+	return []bpfInstruction{
+		bpfStatement(bpfLoadHalf, 12),
+		bpfJump(bpfJumpEqual, etherTypeIPv4, "", "ip6"),
+		bpfStatement(bpfLoadByte, 23),
+		bpfJump(bpfJumpEqual, ipProtocolTCP, "ip4.ports", ""),
+		bpfJump(bpfJumpEqual, ipProtocolUDP, "", bpfLabelReject),
+		{code: bpfLoadHalf, k: 20, label: "ip4.ports"},
+		bpfJump(bpfJumpSet, 0x1fff, bpfLabelReject, ""),
+		bpfStatement(bpfLoadHeaderX, 14),
+		bpfStatement(bpfLoadHalfX, 14),
+		bpfJump(bpfJumpEqual, k, bpfLabelNext, ""),
+		bpfStatement(bpfLoadHalfX, 16),
+		bpfJump(bpfJumpEqual, k, bpfLabelNext, bpfLabelReject),
+		{
+			code: bpfJumpEqual, k: etherTypeIPv6, label: "ip6",
+			jf: bpfLabelReject,
+		},
+		bpfStatement(bpfLoadByte, 20),
+		bpfJump(bpfJumpEqual, ipProtocolTCP, "ip6.ports", ""),
+		bpfJump(bpfJumpEqual, ipProtocolUDP, "", bpfLabelReject),
+		{code: bpfLoadHalf, k: 54, label: "ip6.ports"},
+		bpfJump(bpfJumpEqual, k, bpfLabelNext, ""),
+		bpfStatement(bpfLoadHalf, 56),
+		bpfJump(bpfJumpEqual, k, bpfLabelNext, bpfLabelReject),
+	}, nil
+}
+
+// compileHost matches IPv4 and ARP packets or IPv6 packets with specified
+// source or destination address.
+func compileHost(value string) ([]bpfInstruction, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid host address '%s' in filter", value)
+	}
+
+	if ip.To4() != nil {
+		k := binary.BigEndian.Uint32(ip.To4())
+
+		return []bpfInstruction{
+			bpfStatement(bpfLoadHalf, 12),
+			bpfJump(bpfJumpEqual, etherTypeIPv4, "", "arp"),
+			bpfStatement(bpfLoadWord, 26),
+			bpfJump(bpfJumpEqual, k, bpfLabelNext, ""),
+			bpfStatement(bpfLoadWord, 30),
+			bpfJump(bpfJumpEqual, k, bpfLabelNext, bpfLabelReject),
+			{
+				code: bpfJumpEqual, k: etherTypeARP, label: "arp",
+				jf: bpfLabelReject,
+			},
+			bpfStatement(bpfLoadWord, 28),
+			bpfJump(bpfJumpEqual, k, bpfLabelNext, ""),
+			bpfStatement(bpfLoadWord, 38),
+			bpfJump(bpfJumpEqual, k, bpfLabelNext, bpfLabelReject),
+		}, nil
+	}
+
+	fragment := []bpfInstruction{
+		bpfStatement(bpfLoadHalf, 12),
+		bpfJump(bpfJumpEqual, etherTypeIPv6, "", bpfLabelReject),
+	}
+
+	// source address is at offset 22 and destination address at 38, every
+	// address is compared by 4 words
+	for _, base := range []uint32{22, 38} {
+		mismatch := fmt.Sprintf("mismatch%d", base)
+		if base == 38 {
+			mismatch = bpfLabelReject
+		}
+
+		for word := uint32(0); word < 4; word++ {
+			k := binary.BigEndian.Uint32(ip[word*4 : word*4+4])
+
+			load := bpfStatement(bpfLoadWord, base+word*4)
+			if word == 0 && base == 38 {
+				load.label = "mismatch22"
+			}
+
+			jt := ""
+			if word == 3 {
+				jt = bpfLabelNext
+			}
+
+			fragment = append(
+				fragment, load, bpfJump(bpfJumpEqual, k, jt, mismatch),
+			)
+		}
+	}
+
+	return fragment, nil
+}
+
+func compactBPFBytecode(bytecode string) string {
+	return strings.Replace(
+		strings.Replace(strings.TrimSpace(bytecode), "\n", ",", -1),
+		", ", ",", -1,
+	)
+}
+
+// isBPFBytecode returns true if filter is program in tcpdump -ddd format
+// rather than expression.
+func isBPFBytecode(filter string) bool {
+	return bpfBytecodeRegexp.MatchString(compactBPFBytecode(filter))
+}
+
+// parseBPFBytecode parses program in tcpdump -ddd format.
+func parseBPFBytecode(bytecode string) ([]syscall.SockFilter, error) {
+	lines := strings.Split(bytecode, ",")
+
+	count, err := strconv.Atoi(lines[0])
+	if err != nil || count != len(lines)-1 {
+		return nil, fmt.Errorf(
+			"invalid BPF program, expected %s instructions", lines[0],
+		)
+	}
+
+	filter := []syscall.SockFilter{}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid BPF instruction '%s'", line)
+		}
+
+		values := []uint64{}
+		for i, field := range fields {
+			bits := []int{16, 8, 8, 32}[i]
+
+			value, err := strconv.ParseUint(field, 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("invalid BPF instruction '%s'", line)
+			}
+
+			values = append(values, value)
+		}
+
+		filter = append(filter, syscall.SockFilter{
+			Code: uint16(values[0]),
+			Jt:   uint8(values[1]),
+			Jf:   uint8(values[2]),
+			K:    uint32(values[3]),
+		})
+	}
+
+	return filter, nil
+}
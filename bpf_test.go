@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// runBPF executes program over packet and returns true if packet is
+// accepted. Only instructions produced by filter compiler are supported.
+func runBPF(t *testing.T, program []syscall.SockFilter, packet []byte) bool {
+	var a, x uint32
+
+	load := func(offset uint32, size uint32) (uint32, bool) {
+		if uint64(offset)+uint64(size) > uint64(len(packet)) {
+			return 0, false
+		}
+
+		switch size {
+		case 4:
+			return binary.BigEndian.Uint32(packet[offset:]), true
+		case 2:
+			return uint32(binary.BigEndian.Uint16(packet[offset:])), true
+		default:
+			return uint32(packet[offset]), true
+		}
+	}
+
+	for pc := 0; pc < len(program); pc++ {
+		var (
+			instruction = program[pc]
+			ok          = true
+		)
+
+		switch instruction.Code {
+		case bpfLoadWord:
+			a, ok = load(instruction.K, 4)
+		case bpfLoadHalf:
+			a, ok = load(instruction.K, 2)
+		case bpfLoadByte:
+			a, ok = load(instruction.K, 1)
+		case bpfLoadHalfX:
+			a, ok = load(x+instruction.K, 2)
+		case bpfLoadHeaderX:
+			x, ok = load(instruction.K, 1)
+			x = 4 * (x & 0xf)
+		case bpfJumpEqual, bpfJumpSet:
+			matched := a == instruction.K
+			if instruction.Code == bpfJumpSet {
+				matched = a&instruction.K != 0
+			}
+
+			if matched {
+				pc += int(instruction.Jt)
+			} else {
+				pc += int(instruction.Jf)
+			}
+		case bpfReturn:
+			return instruction.K != 0
+		default:
+			t.Fatalf("unsupported BPF instruction %#v", instruction)
+		}
+
+		// kernel rejects packet if load is out of packet bounds
+		if !ok {
+			return false
+		}
+	}
+
+	t.Fatalf("BPF program has no return instruction")
+
+	return false
+}
+
+func makeEthernetFrame(etherType uint16, payload []byte) []byte {
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+
+	return append(frame, payload...)
+}
+
+func makeIPv4Packet(
+	protocol byte, source, destination string, ports ...uint16,
+) []byte {
+	header := make([]byte, 20)
+	header[0] = 0x45
+	header[9] = protocol
+	copy(header[12:], net.ParseIP(source).To4())
+	copy(header[16:], net.ParseIP(destination).To4())
+
+	return makeEthernetFrame(etherTypeIPv4, append(header, makePorts(ports)...))
+}
+
+func makeIPv6Packet(
+	next byte, source, destination string, ports ...uint16,
+) []byte {
+	header := make([]byte, 40)
+	header[0] = 0x60
+	header[6] = next
+	copy(header[8:], net.ParseIP(source))
+	copy(header[24:], net.ParseIP(destination))
+
+	return makeEthernetFrame(etherTypeIPv6, append(header, makePorts(ports)...))
+}
+
+func makeARPPacket(sender, target string) []byte {
+	payload := make([]byte, 28)
+	copy(payload[14:], net.ParseIP(sender).To4())
+	copy(payload[24:], net.ParseIP(target).To4())
+
+	return makeEthernetFrame(etherTypeARP, payload)
+}
+
+func makePorts(ports []uint16) []byte {
+	data := make([]byte, 8)
+	for i, port := range ports {
+		binary.BigEndian.PutUint16(data[i*2:], port)
+	}
+
+	return data
+}
+
+func TestCompileFilter(t *testing.T) {
+	fragment := makeIPv4Packet(ipProtocolUDP, "10.0.0.2", "10.0.0.3", 53, 53)
+	fragment[21] = 0x01
+
+	packets := map[string][]byte{
+		"tcp4":      makeIPv4Packet(ipProtocolTCP, "10.0.0.2", "10.0.0.3", 80, 4000),
+		"udp4":      makeIPv4Packet(ipProtocolUDP, "10.0.0.3", "10.0.0.2", 4000, 53),
+		"icmp4":     makeIPv4Packet(ipProtocolICMP, "10.0.0.3", "10.0.0.4"),
+		"fragment4": fragment,
+		"tcp6":      makeIPv6Packet(ipProtocolTCP, "fd00::2", "fd00::3", 80, 4000),
+		"udp6":      makeIPv6Packet(ipProtocolUDP, "fd00::3", "fd00::2", 4000, 53),
+		"icmp6":     makeIPv6Packet(ipProtocolICMPv6, "fd00::3", "fd00::4"),
+		"arp":       makeARPPacket("10.0.0.4", "10.0.0.2"),
+		"short":     makeEthernetFrame(etherTypeIPv4, []byte{0x45}),
+	}
+
+	testcases := []struct {
+		filter   string
+		accepted []string
+	}{
+		{
+			"ip",
+			[]string{"tcp4", "udp4", "icmp4", "fragment4", "short"},
+		},
+		{
+			"ip6",
+			[]string{"tcp6", "udp6", "icmp6"},
+		},
+		{
+			"arp",
+			[]string{"arp"},
+		},
+		{
+			"tcp",
+			[]string{"tcp4", "tcp6"},
+		},
+		{
+			"udp",
+			[]string{"udp4", "fragment4", "udp6"},
+		},
+		{
+			"icmp",
+			[]string{"icmp4", "icmp6"},
+		},
+		{
+			"port 53",
+			[]string{"udp4", "udp6"},
+		},
+		{
+			"port 80 and tcp",
+			[]string{"tcp4", "tcp6"},
+		},
+		{
+			"host 10.0.0.2",
+			[]string{"tcp4", "udp4", "fragment4", "arp"},
+		},
+		{
+			"host 10.0.0.4 and icmp",
+			[]string{"icmp4"},
+		},
+		{
+			"host fd00::2",
+			[]string{"tcp6", "udp6"},
+		},
+		{
+			"ip6 and host fd00::3 and port 4000",
+			[]string{"tcp6", "udp6"},
+		},
+		{
+			"ip and ip6",
+			[]string{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		program, err := compileFilter(testcase.filter)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.filter, err)
+			continue
+		}
+
+		accepted := []string{}
+		for _, name := range []string{
+			"tcp4", "udp4", "icmp4", "fragment4",
+			"tcp6", "udp6", "icmp6", "arp", "short",
+		} {
+			if runBPF(t, program, packets[name]) {
+				accepted = append(accepted, name)
+			}
+		}
+
+		if !reflect.DeepEqual(accepted, testcase.accepted) {
+			t.Errorf(
+				"%s: expected %v to be accepted, got %v",
+				testcase.filter, testcase.accepted, accepted,
+			)
+		}
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	testcases := []string{
+		"vlan",
+		"port",
+		"port 0",
+		"port 65536",
+		"port http",
+		"host",
+		"host example.com",
+		"tcp or udp",
+		"tcp udp",
+		"tcp and",
+		"and tcp",
+	}
+
+	for _, filter := range testcases {
+		_, err := compileFilter(filter)
+		if err == nil {
+			t.Errorf("%s: expected error, got none", filter)
+		}
+	}
+}
+
+func TestParseBPFBytecode(t *testing.T) {
+	testcases := []struct {
+		bytecode string
+		valid    bool
+		expected []syscall.SockFilter
+	}{
+		{
+			bytecode: "1,6 0 0 65535",
+			valid:    true,
+			expected: []syscall.SockFilter{
+				{Code: 6, K: 65535},
+			},
+		},
+		{
+			bytecode: "3,40 0 0 12,21 0 1 2048,6 0 0 262144",
+			valid:    true,
+			expected: []syscall.SockFilter{
+				{Code: 40, K: 12},
+				{Code: 21, Jt: 0, Jf: 1, K: 2048},
+				{Code: 6, K: 262144},
+			},
+		},
+		{
+			bytecode: "2,6 0 0 65535",
+			valid:    false,
+		},
+		{
+			bytecode: "x,6 0 0 65535",
+			valid:    false,
+		},
+		{
+			bytecode: "1,6 0 256 65535",
+			valid:    false,
+		},
+		{
+			bytecode: "1,65536 0 0 0",
+			valid:    false,
+		},
+		{
+			bytecode: "1,6 0 0 4294967296",
+			valid:    false,
+		},
+		{
+			bytecode: "1,6 0 0",
+			valid:    false,
+		},
+		{
+			bytecode: "1,6 0 0 0 0",
+			valid:    false,
+		},
+	}
+
+	for _, testcase := range testcases {
+		program, err := parseBPFBytecode(testcase.bytecode)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", testcase.bytecode)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.bytecode, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(program, testcase.expected) {
+			t.Errorf(
+				"%s: expected %v, got %v",
+				testcase.bytecode, testcase.expected, program,
+			)
+		}
+	}
+}
+
+func TestCompileFilterBytecode(t *testing.T) {
+	testcases := []struct {
+		filter   string
+		bytecode bool
+	}{
+		{"1,6 0 0 65535", true},
+		{"2\n40 0 0 12\n6 0 0 65535\n", true},
+		{"2, 40 0 0 12, 6 0 0 65535", true},
+		{"port 53", false},
+		{"1", false},
+	}
+
+	for _, testcase := range testcases {
+		if isBPFBytecode(testcase.filter) != testcase.bytecode {
+			t.Errorf(
+				"%q: expected bytecode %v", testcase.filter, testcase.bytecode,
+			)
+		}
+	}
+
+	program, err := compileFilter("2\n40 0 0 12\n6 0 0 65535\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(program) != 2 || program[1].K != 65535 {
+		t.Errorf("unexpected program %v", program)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	// captureSnapLength is maximum length of captured packet, offloaded
+	// packets on veth can be larger than MTU.
+	captureSnapLength = 262144
+
+	pcapMagic          = 0xa1b2c3d4
+	pcapngSectionBlock = 0x0a0d0d0a
+	pcapngInterface    = 0x00000001
+	pcapngPacket       = 0x00000006
+	pcapngByteOrder    = 0x1a2b3c4d
+	pcapLinkEthernet   = 1
+)
+
+// captureWriter writes captured packets in specific file format.
+type captureWriter interface {
+	WritePacket(timestamp time.Time, data []byte, length int) error
+}
+
+type pcapWriter struct {
+	writer io.Writer
+}
+
+func newPcapWriter(writer io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLength)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkEthernet)
+
+	_, err := writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pcapWriter{writer: writer}, nil
+}
+
+func (pcap *pcapWriter) WritePacket(
+	timestamp time.Time,
+	data []byte,
+	length int,
+) error {
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(timestamp.Unix()))
+	binary.LittleEndian.PutUint32(
+		header[4:], uint32(timestamp.Nanosecond()/1000),
+	)
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(length))
+
+	_, err := pcap.writer.Write(append(header, data...))
+	return err
+}
+
+type pcapngWriter struct {
+	writer io.Writer
+}
+
+func newPcapngWriter(writer io.Writer, iface string) (*pcapngWriter, error) {
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(section[4:], 1)
+	binary.LittleEndian.PutUint64(section[8:], ^uint64(0))
+
+	// interface block has if_name option followed by end of options
+	name := padPcapngData([]byte(iface))
+	description := make([]byte, 8, 8+len(name)+4)
+	binary.LittleEndian.PutUint16(description[0:], pcapLinkEthernet)
+	binary.LittleEndian.PutUint32(description[4:], captureSnapLength)
+	description = append(description, 2, 0, byte(len(iface)), 0)
+	description = append(description, name...)
+	description = append(description, 0, 0, 0, 0)
+
+	pcapng := &pcapngWriter{writer: writer}
+
+	err := pcapng.writeBlock(pcapngSectionBlock, section)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pcapng.writeBlock(pcapngInterface, description)
+	if err != nil {
+		return nil, err
+	}
+
+	return pcapng, nil
+}
+
+func (pcapng *pcapngWriter) WritePacket(
+	timestamp time.Time,
+	data []byte,
+	length int,
+) error {
+	microseconds := uint64(timestamp.UnixNano() / 1000)
+
+	packet := make([]byte, 20)
+	binary.LittleEndian.PutUint32(packet[4:], uint32(microseconds>>32))
+	binary.LittleEndian.PutUint32(packet[8:], uint32(microseconds))
+	binary.LittleEndian.PutUint32(packet[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(packet[16:], uint32(length))
+
+	return pcapng.writeBlock(
+		pcapngPacket, append(packet, padPcapngData(data)...),
+	)
+}
+
+func (pcapng *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(body)+12))
+
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, blockType)
+
+	block := append(append(header, length...), body...)
+
+	_, err := pcapng.writer.Write(append(block, length...))
+	return err
+}
+
+// padPcapngData pads data with zeros to 32-bit boundary.
+func padPcapngData(data []byte) []byte {
+	if len(data)%4 == 0 {
+		return data
+	}
+
+	return append(
+		append([]byte{}, data...), make([]byte, 4-len(data)%4)...,
+	)
+}
+
+func htons(value uint16) uint16 {
+	return value<<8 | value>>8
+}
+
+// getCaptureInterface returns host interface, which should be used for
+// capture of container traffic, and filter expression, which selects
+// container packets on that interface. Bridge is filtered by container
+// address.
+func getCaptureInterface(
+	rootDir string,
+	containerName string,
+	useBridge bool,
+) (string, string, error) {
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return "", "", ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	if state == nil {
+		return "", "", fmt.Errorf(
+			"container '%s' has no state", containerName,
+		)
+	}
+
+	if useBridge {
+		bridge, _ := parseBridgeInfo(state.Bridge)
+		if bridge == "" {
+			return "", "", fmt.Errorf(
+				"container '%s' is not connected to bridge", containerName,
+			)
+		}
+
+		address := getIPv4Address(state.Address)
+		if address == "" {
+			address = getIPv6Address(state.Address)
+		}
+
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return "", "", ser.Errorf(
+				err, "invalid address of container '%s'", containerName,
+			)
+		}
+
+		return bridge, "host " + ip.String(), nil
+	}
+
+	for _, veth := range state.Veths {
+		alias, err := readInterfaceAlias(veth)
+		if err == nil && alias == getInterfaceAlias(containerName) {
+			return veth, "", nil
+		}
+	}
+
+	return "", "", fmt.Errorf(
+		"container '%s' has no veth interface on host, "+
+			"probably it's not running or doesn't use veth network mode",
+		containerName,
+	)
+}
+
+// openCaptureSocket opens raw packet socket, which receives all packets of
+// specified interface passed through filter.
+func openCaptureSocket(
+	iface string,
+	filter []syscall.SockFilter,
+) (int, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, err
+	}
+
+	// socket is opened without protocol, so it doesn't receive packets of
+	// all interfaces before it's bound
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return 0, ser.Errorf(err, "can't open packet socket")
+	}
+
+	if len(filter) > 0 {
+		err = syscall.AttachLsf(fd, filter)
+		if err != nil {
+			syscall.Close(fd)
+			return 0, ser.Errorf(err, "can't attach filter")
+		}
+	}
+
+	// timeout allows to check capture duration and signals
+	err = syscall.SetsockoptTimeval(
+		fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO,
+		&syscall.Timeval{Usec: 200000},
+	)
+	if err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  link.Index,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return 0, ser.Errorf(err, "can't bind packet socket to '%s'", iface)
+	}
+
+	return fd, nil
+}
+
+// capturePackets captures packets of the container and writes them into
+// output in pcap or pcapng format. Capture is stopped after specified
+// duration or by SIGINT or SIGTERM.
+func capturePackets(
+	rootDir string,
+	containerName string,
+	useBridge bool,
+	filter string,
+	duration time.Duration,
+	output io.Writer,
+	pcapng bool,
+	quiet bool,
+) error {
+	iface, containerFilter, err := getCaptureInterface(
+		rootDir, containerName, useBridge,
+	)
+	if err != nil {
+		return err
+	}
+
+	if containerFilter != "" {
+		if isBPFBytecode(filter) {
+			return fmt.Errorf(
+				"BPF program can't be combined with filter by container " +
+					"address, use filter expression",
+			)
+		}
+
+		if filter != "" {
+			filter = containerFilter + " and " + filter
+		} else {
+			filter = containerFilter
+		}
+	}
+
+	program, err := compileFilter(filter)
+	if err != nil {
+		return ser.Errorf(err, "can't compile filter '%s'", filter)
+	}
+
+	fd, err := openCaptureSocket(iface, program)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(fd)
+
+	buffer := bufio.NewWriter(output)
+
+	var writer captureWriter
+	if pcapng {
+		writer, err = newPcapngWriter(buffer, iface)
+	} else {
+		writer, err = newPcapWriter(buffer)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = buffer.Flush()
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "capturing on %s\n", iface)
+	}
+
+	var (
+		deadline = time.Now().Add(duration)
+		packet   = make([]byte, captureSnapLength)
+		captured = 0
+	)
+
+capture:
+	for duration == 0 || time.Now().Before(deadline) {
+		select {
+		case <-signals:
+			break capture
+		default:
+		}
+
+		// length of the packet is returned even if it's truncated
+		length, _, err := syscall.Recvfrom(fd, packet, syscall.MSG_TRUNC)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+
+			return ser.Errorf(err, "can't receive packet on '%s'", iface)
+		}
+
+		size := length
+		if size > len(packet) {
+			size = len(packet)
+		}
+
+		err = writer.WritePacket(time.Now(), packet[:size], length)
+		if err != nil {
+			return ser.Errorf(err, "can't write packet")
+		}
+
+		// output can be read by another program while capture is running
+		err = buffer.Flush()
+		if err != nil {
+			return ser.Errorf(err, "can't write packet")
+		}
+
+		captured++
+	}
+
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "%d packets captured\n", captured)
+	}
+
+	return nil
+}
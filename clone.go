@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+// cloneContainer creates copy of container with the same options, new
+// machine id and new address. Published ports are not copied, because host
+// port can be published only by one container.
+func cloneContainer(
+	rootDir string,
+	containerName string,
+	newContainerName string,
+	networkAddress string,
+	force bool,
+	storageEngine storage,
+) (string, error) {
+	err := ensureContainerStopped(rootDir, containerName, force)
+	if err != nil {
+		return "", err
+	}
+
+	if isExists(getContainerDir(rootDir, newContainerName)) {
+		return "", fmt.Errorf(
+			"container '%s' already exists", newContainerName,
+		)
+	}
+
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	image, err := getContainerImage(containerName, state, storageEngine)
+	if err != nil {
+		return "", err
+	}
+
+	if state == nil {
+		state = &containerState{}
+	}
+
+	// only addresses in named networks are remembered, addresses in other
+	// modes are specified or allocated on container start
+	if networkAddress != "" && len(state.Networks) == 0 {
+		return "", fmt.Errorf(
+			"address can be specified only for container in named networks, "+
+				"use -a on start of '%s' instead",
+			newContainerName,
+		)
+	}
+
+	err = storageEngine.CloneContainer(containerName, newContainerName)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't copy container '%s'", containerName,
+		)
+	}
+
+	err = storageEngine.InitContainer(image, newContainerName)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't mount root of container '%s'", newContainerName,
+		)
+	}
+
+	containerRoot, err := storageEngine.GetContainerRoot(newContainerName)
+	if err == nil {
+		err = resetMachineID(containerRoot)
+	}
+
+	storageEngine.DeInitContainer(newContainerName)
+
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't generate machine id for '%s'", newContainerName,
+		)
+	}
+
+	clone := *state
+	clone.Image = image
+	clone.Address = ""
+	clone.Networks = nil
+	clone.Ports = nil
+	clone.Veths = nil
+	clone.ProjectID = 0
+
+	if len(state.Networks) > 0 {
+		if networkAddress == "" {
+			networkAddress, err = allocateCloneAddress(
+				rootDir, newContainerName, state,
+			)
+			if err != nil {
+				return "", ser.Errorf(
+					err, "can't allocate address for '%s'", newContainerName,
+				)
+			}
+		}
+
+		// addresses on other networks will be allocated on container start
+		for _, network := range state.Networks {
+			clone.Networks = append(
+				clone.Networks, containerNetwork{Name: network.Name},
+			)
+		}
+
+		clone.Networks[0].Address = networkAddress
+		clone.Address = networkAddress
+	}
+
+	err = writeContainerState(rootDir, newContainerName, &clone)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't write state of container '%s'", newContainerName,
+		)
+	}
+
+	return clone.Address, nil
+}
+
+// allocateCloneAddress returns address for clone of container with
+// specified state from the first network of the container.
+func allocateCloneAddress(
+	rootDir string,
+	containerName string,
+	state *containerState,
+) (string, error) {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return "", err
+	}
+
+	name := state.Networks[0].Name
+
+	network, ok := config.Networks[name]
+	if !ok {
+		return "", fmt.Errorf("network '%s' does not exist", name)
+	}
+
+	return allocateNetworkAddress(
+		rootDir, containerName, network, config.HashAddresses,
+	)
+}
+
+func resetMachineID(root string) error {
+	err := os.Remove(filepath.Join(root, "etc", "machine-id"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	command := exec.Command("systemd-machine-id-setup", "--root", root)
+	_, _, err = executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/reconquest/ser-go"
+)
+
+const imageCommitFile = `.commit`
+
+// imageCommit describes lineage of the image, which was created from
+// container.
+type imageCommit struct {
+	Container string    `json:"container"`
+	Image     string    `json:"image"`
+	Date      time.Time `json:"date"`
+}
+
+// commitContainer creates new image from container's root and its image.
+func commitContainer(
+	rootDir string,
+	containerName string,
+	force bool,
+	storageEngine storage,
+) (string, error) {
+	err := ensureContainerStopped(rootDir, containerName, force)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	parent, err := getContainerImage(containerName, state, storageEngine)
+	if err != nil {
+		return "", err
+	}
+
+	parentKey, err := readImageKey(getImageDir(rootDir, parent))
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't read key of image %s", parent,
+		)
+	}
+
+	commit := imageCommit{
+		Container: containerName,
+		Image:     parent,
+		Date:      time.Now().UTC(),
+	}
+
+	data, err := json.MarshalIndent(commit, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	key := parentKey
+	key.Config = fmt.Sprintf("%x", sha256.Sum256(data))
+
+	image := key.String()
+	imageDir := getImageDir(rootDir, image)
+
+	err = storageEngine.CommitContainer(containerName, image, parent)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't commit container '%s' to image %s",
+			containerName, image,
+		)
+	}
+
+	// container-specific files should not be inherited by other containers
+	for _, path := range []string{".hastur.exec", "etc/machine-id"} {
+		err = os.Remove(filepath.Join(imageDir, path))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	err = setImageParent(rootDir, image, parent)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't set parent for image %s", image,
+		)
+	}
+
+	err = writeImageKey(imageDir, key)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't write key for image %s", image,
+		)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(imageDir, imageCommitFile), data, 0644)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't write lineage of image %s", image,
+		)
+	}
+
+	return image, markImageBuilt(rootDir, image, storageEngine)
+}
+
+func readImageCommit(imageDir string) (*imageCommit, error) {
+	data, err := ioutil.ReadFile(filepath.Join(imageDir, imageCommitFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var commit imageCommit
+	err = json.Unmarshal(data, &commit)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode image lineage in '%s'", imageDir,
+		)
+	}
+
+	return &commit, nil
+}
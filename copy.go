@@ -4,8 +4,10 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 
+	"github.com/reconquest/executil-go"
 	"github.com/reconquest/ser-go"
 )
 
@@ -83,3 +85,16 @@ func copyDir(src string, dest string) (err error) {
 
 	return nil
 }
+
+// copyTree copies contents of src into dest preserving ownership, special
+// files and extended attributes. On filesystems with reflink support (btrfs,
+// xfs) files are not copied, but share data blocks.
+func copyTree(src string, dest string) error {
+	command := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dest)
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	dhcpLeasesFile = `dhcp.json`
+
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpLeaseTime = 3600
+
+	dhcpHeaderSize         = 240
+	dhcpBootRequest        = 1
+	dhcpBootReply          = 2
+	dhcpBroadcastFlag      = 0x8000
+	dhcpHardwareTypeEther  = 1
+	dhcpHardwareAddressLen = 6
+)
+
+// DHCP message types.
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpACK      = 5
+	dhcpNAK      = 6
+	dhcpRelease  = 7
+	dhcpInform   = 8
+)
+
+// DHCP options.
+const (
+	dhcpOptionPad         = 0
+	dhcpOptionSubnetMask  = 1
+	dhcpOptionRouter      = 3
+	dhcpOptionRequestedIP = 50
+	dhcpOptionLeaseTime   = 51
+	dhcpOptionMessageType = 53
+	dhcpOptionServerID    = 54
+	dhcpOptionRenewalTime = 58
+	dhcpOptionRebindTime  = 59
+	dhcpOptionEnd         = 255
+)
+
+var (
+	dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+	linkEtherRegexp = regexp.MustCompile(
+		`^\d+: ([^:@]+)[@:].* link/ether ([0-9a-f:]+)`,
+	)
+)
+
+// dhcpPacket is DHCPv4 message, only fields required by server are parsed.
+type dhcpPacket struct {
+	Op       byte
+	XID      []byte
+	Flags    uint16
+	ClientIP net.IP
+	RelayIP  net.IP
+	MAC      net.HardwareAddr
+	Options  map[byte][]byte
+}
+
+func parseDHCPPacket(data []byte) (*dhcpPacket, error) {
+	if len(data) < dhcpHeaderSize ||
+		!bytes.Equal(data[236:240], dhcpMagicCookie) {
+		return nil, fmt.Errorf("invalid DHCP packet")
+	}
+
+	packet := &dhcpPacket{
+		Op:       data[0],
+		XID:      data[4:8],
+		Flags:    binary.BigEndian.Uint16(data[10:12]),
+		ClientIP: net.IP(data[12:16]),
+		RelayIP:  net.IP(data[24:28]),
+		MAC:      net.HardwareAddr(data[28 : 28+dhcpHardwareAddressLen]),
+		Options:  map[byte][]byte{},
+	}
+
+	options := data[dhcpHeaderSize:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == dhcpOptionEnd {
+			break
+		}
+
+		if code == dhcpOptionPad {
+			options = options[1:]
+			continue
+		}
+
+		if len(options) < 2 {
+			return nil, fmt.Errorf("invalid DHCP option %d", code)
+		}
+
+		end := 2 + int(options[1])
+		if len(options) < end {
+			return nil, fmt.Errorf("invalid DHCP option %d", code)
+		}
+
+		packet.Options[code] = options[2:end]
+		options = options[end:]
+	}
+
+	return packet, nil
+}
+
+func (packet *dhcpPacket) MessageType() byte {
+	value := packet.Options[dhcpOptionMessageType]
+	if len(value) != 1 {
+		return 0
+	}
+
+	return value[0]
+}
+
+// dhcpServer hands out addresses of containers from container states, so
+// containers, which configure network by DHCP, get the same addresses as
+// ones configured by hastur. Addresses for unknown clients are allocated
+// from the same subnet and remembered in dhcp.json.
+type dhcpServer struct {
+	rootDir string
+	bridge  string
+	address net.IP
+	network *net.IPNet
+	conn    net.PacketConn
+}
+
+func serveDHCP(rootDir string, bridge string, bridgeAddress string) error {
+	address, network, err := net.ParseCIDR(getIPv4Address(bridgeAddress))
+	if err != nil {
+		return fmt.Errorf(
+			"bridge '%s' should have IPv4 address to serve DHCP", bridge,
+		)
+	}
+
+	conn, err := listenDHCP(bridge)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't listen DHCP port on '%s'", bridge,
+		)
+	}
+
+	defer conn.Close()
+
+	server := &dhcpServer{
+		rootDir: rootDir,
+		bridge:  bridge,
+		address: address.To4(),
+		network: network,
+		conn:    conn,
+	}
+
+	fmt.Printf("Serving DHCP on %s (%s)\n", bridge, bridgeAddress)
+
+	buffer := make([]byte, 1500)
+	for {
+		size, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+
+		packet, err := parseDHCPPacket(buffer[:size])
+		if err != nil || packet.Op != dhcpBootRequest {
+			continue
+		}
+
+		err = server.handle(packet)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(
+				err, "WARNING: can't handle DHCP request from %s",
+				packet.MAC,
+			))
+		}
+	}
+}
+
+// listenDHCP opens UDP socket on DHCP server port, which receives and sends
+// broadcast packets only through specified interface.
+func listenDHCP(iface string) (net.PacketConn, error) {
+	fd, err := syscall.Socket(
+		syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(fd), "dhcp")
+	defer file.Close()
+
+	for _, option := range []int{syscall.SO_REUSEADDR, syscall.SO_BROADCAST} {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, option, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = syscall.SetsockoptString(
+		fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrInet4{Port: dhcpServerPort})
+	if err != nil {
+		return nil, err
+	}
+
+	return net.FilePacketConn(file)
+}
+
+func (server *dhcpServer) handle(request *dhcpPacket) error {
+	switch request.MessageType() {
+	case dhcpDiscover:
+		address, err := server.getAddress(request.MAC)
+		if err != nil {
+			return err
+		}
+
+		return server.reply(request, dhcpOffer, address)
+
+	case dhcpRequest, dhcpInform:
+		address, err := server.getAddress(request.MAC)
+		if err != nil {
+			return err
+		}
+
+		requested := net.IP(request.Options[dhcpOptionRequestedIP])
+		if len(requested) != net.IPv4len {
+			requested = request.ClientIP
+		}
+
+		if request.MessageType() == dhcpRequest &&
+			!requested.Equal(address) && !requested.IsUnspecified() {
+			return server.reply(request, dhcpNAK, net.IPv4zero)
+		}
+
+		fmt.Printf("Leased %s to %s\n", address, request.MAC)
+
+		return server.reply(request, dhcpACK, address)
+
+	case dhcpRelease:
+		err := releaseDHCPLease(server.rootDir, request.MAC)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't release lease of %s", request.MAC,
+			)
+		}
+
+		fmt.Printf("Released lease of %s\n", request.MAC)
+	}
+
+	return nil
+}
+
+// getAddress returns address for client with specified MAC: address of the
+// container, which has interface with the MAC, or address leased for the
+// MAC previously, or newly allocated address.
+func (server *dhcpServer) getAddress(mac net.HardwareAddr) (net.IP, error) {
+	address, err := findContainerAddressByMAC(server.rootDir, mac)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't find container with MAC %s", mac,
+		)
+	}
+
+	if address == "" {
+		address, err = allocateDHCPLease(
+			server.rootDir, mac, server.network, server.address,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !server.network.Contains(ip) {
+		return nil, fmt.Errorf(
+			"address %s of %s is not in network %s of bridge '%s'",
+			ip, mac, server.network, server.bridge,
+		)
+	}
+
+	return ip.To4(), nil
+}
+
+func (server *dhcpServer) reply(
+	request *dhcpPacket,
+	messageType byte,
+	address net.IP,
+) error {
+	packet := make([]byte, dhcpHeaderSize)
+
+	packet[0] = dhcpBootReply
+	packet[1] = dhcpHardwareTypeEther
+	packet[2] = dhcpHardwareAddressLen
+	copy(packet[4:8], request.XID)
+	binary.BigEndian.PutUint16(packet[10:12], request.Flags)
+	copy(packet[16:20], address.To4())
+	copy(packet[20:24], server.address)
+	copy(packet[24:28], request.RelayIP.To4())
+	copy(packet[28:], request.MAC)
+	copy(packet[236:240], dhcpMagicCookie)
+
+	options := [][]byte{
+		{dhcpOptionMessageType, 1, messageType},
+		append([]byte{dhcpOptionServerID, 4}, server.address...),
+	}
+
+	if messageType != dhcpNAK {
+		options = append(
+			options,
+			append([]byte{dhcpOptionSubnetMask, 4}, server.network.Mask...),
+			append([]byte{dhcpOptionRouter, 4}, server.address...),
+		)
+	}
+
+	if messageType == dhcpOffer || messageType == dhcpACK &&
+		request.MessageType() != dhcpInform {
+		for code, seconds := range map[byte]uint32{
+			dhcpOptionLeaseTime:   dhcpLeaseTime,
+			dhcpOptionRenewalTime: dhcpLeaseTime / 2,
+			dhcpOptionRebindTime:  dhcpLeaseTime * 7 / 8,
+		} {
+			option := []byte{code, 4, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(option[2:], seconds)
+
+			options = append(options, option)
+		}
+	}
+
+	for _, option := range options {
+		packet = append(packet, option...)
+	}
+
+	packet = append(packet, dhcpOptionEnd)
+
+	destination := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+	if !request.ClientIP.IsUnspecified() &&
+		request.Flags&dhcpBroadcastFlag == 0 && messageType != dhcpNAK {
+		destination.IP = request.ClientIP
+	}
+
+	_, err := server.conn.WriteTo(packet, destination)
+
+	return err
+}
+
+// findContainerAddressByMAC returns IPv4 address of the running container
+// interface with specified MAC from the container state.
+func findContainerAddressByMAC(
+	rootDir string,
+	mac net.HardwareAddr,
+) (string, error) {
+	active, err := listActiveContainers(containerSuffix)
+	if err != nil {
+		return "", err
+	}
+
+	for name := range active {
+		state, err := readContainerState(rootDir, name)
+		if err != nil || state == nil {
+			continue
+		}
+
+		macs, err := getContainerMACs(name)
+		if err != nil {
+			continue
+		}
+
+		for iface, ifaceMAC := range macs {
+			if ifaceMAC != mac.String() {
+				continue
+			}
+
+			address := state.Address
+			for index, network := range state.Networks {
+				if iface == getInterfaceName(index) {
+					address = network.Address
+				}
+			}
+
+			return getIPv4Address(address), nil
+		}
+	}
+
+	return "", nil
+}
+
+// getContainerMACs returns MAC addresses of container interfaces.
+func getContainerMACs(containerName string) (map[string]string, error) {
+	command := exec.Command("ip", "-n", containerName, "-o", "link", "show")
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	macs := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		matches := linkEtherRegexp.FindStringSubmatch(line)
+		if matches != nil {
+			macs[matches[1]] = matches[2]
+		}
+	}
+
+	return macs, nil
+}
+
+// dhcpLease is address leased to client, which isn't a container, lease is
+// removed when client releases it or when it expires.
+type dhcpLease struct {
+	Address string    `json:"address"`
+	Expires time.Time `json:"expires"`
+}
+
+// readDHCPLeases returns leases, which are not expired, by MAC.
+func readDHCPLeases(rootDir string) (map[string]dhcpLease, error) {
+	leases := map[string]dhcpLease{}
+
+	data, err := ioutil.ReadFile(filepath.Join(rootDir, dhcpLeasesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return leases, nil
+		}
+
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &leases)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode %s", dhcpLeasesFile,
+		)
+	}
+
+	now := time.Now()
+	for mac, lease := range leases {
+		if !lease.Expires.After(now) {
+			delete(leases, mac)
+		}
+	}
+
+	return leases, nil
+}
+
+func writeDHCPLeases(rootDir string, leases map[string]dhcpLease) error {
+	data, err := json.MarshalIndent(leases, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(rootDir, dhcpLeasesFile), data, 0644)
+}
+
+// allocateDHCPLease returns address leased for the MAC or allocates new one
+// from the network. Lease is extended for the lease time.
+func allocateDHCPLease(
+	rootDir string,
+	mac net.HardwareAddr,
+	network *net.IPNet,
+	serverAddress net.IP,
+) (string, error) {
+	leases, err := readDHCPLeases(rootDir)
+	if err != nil {
+		return "", err
+	}
+
+	lease, ok := leases[mac.String()]
+	if !ok {
+		config, err := readNetworkConfig(rootDir)
+		if err != nil {
+			return "", err
+		}
+
+		lease.Address, err = allocateAddress(
+			rootDir, mac.String(), network,
+			(&net.IPNet{IP: serverAddress, Mask: network.Mask}).String(),
+			config.HashAddresses,
+		)
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't allocate address for %s", mac,
+			)
+		}
+	}
+
+	lease.Expires = time.Now().Add(dhcpLeaseTime * time.Second)
+	leases[mac.String()] = lease
+
+	err = writeDHCPLeases(rootDir, leases)
+	if err != nil {
+		return "", err
+	}
+
+	return lease.Address, nil
+}
+
+// releaseDHCPLease removes lease of the MAC, so address can be allocated
+// again.
+func releaseDHCPLease(rootDir string, mac net.HardwareAddr) error {
+	leases, err := readDHCPLeases(rootDir)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := leases[mac.String()]; !ok {
+		return nil
+	}
+
+	delete(leases, mac.String())
+
+	return writeDHCPLeases(rootDir, leases)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func makeDHCPPacket(options ...byte) []byte {
+	data := make([]byte, dhcpHeaderSize)
+	data[0] = dhcpBootRequest
+	copy(data[28:], []byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+	copy(data[236:], dhcpMagicCookie)
+
+	return append(data, options...)
+}
+
+func TestParseDHCPPacket(t *testing.T) {
+	testcases := []struct {
+		name    string
+		data    []byte
+		valid   bool
+		options map[byte][]byte
+	}{
+		{
+			name:  "short packet",
+			data:  make([]byte, dhcpHeaderSize-1),
+			valid: false,
+		},
+		{
+			name:  "no magic cookie",
+			data:  make([]byte, dhcpHeaderSize),
+			valid: false,
+		},
+		{
+			name:    "no options",
+			data:    makeDHCPPacket(),
+			valid:   true,
+			options: map[byte][]byte{},
+		},
+		{
+			name: "message type and requested address",
+			data: makeDHCPPacket(
+				dhcpOptionMessageType, 1, dhcpDiscover,
+				dhcpOptionPad,
+				dhcpOptionRequestedIP, 4, 10, 0, 0, 2,
+				dhcpOptionEnd,
+			),
+			valid: true,
+			options: map[byte][]byte{
+				dhcpOptionMessageType: {dhcpDiscover},
+				dhcpOptionRequestedIP: {10, 0, 0, 2},
+			},
+		},
+		{
+			name: "options after end are ignored",
+			data: makeDHCPPacket(
+				dhcpOptionEnd, dhcpOptionMessageType, 200,
+			),
+			valid:   true,
+			options: map[byte][]byte{},
+		},
+		{
+			name:  "option without length",
+			data:  makeDHCPPacket(dhcpOptionMessageType),
+			valid: false,
+		},
+		{
+			name:  "truncated option",
+			data:  makeDHCPPacket(dhcpOptionRequestedIP, 4, 10, 0),
+			valid: false,
+		},
+		{
+			name:  "oversized option length 254",
+			data:  makeDHCPPacket(dhcpOptionRequestedIP, 254, 10, 0, 0, 2),
+			valid: false,
+		},
+		{
+			name:  "oversized option length 255",
+			data:  makeDHCPPacket(dhcpOptionRequestedIP, 255, 10, 0, 0, 2),
+			valid: false,
+		},
+		{
+			name: "option of length 255",
+			data: makeDHCPPacket(
+				append([]byte{12, 255}, make([]byte, 255)...)...,
+			),
+			valid: true,
+			options: map[byte][]byte{
+				12: make([]byte, 255),
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		packet, err := parseDHCPPacket(testcase.data)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", testcase.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.name, err)
+			continue
+		}
+
+		if packet.MAC.String() != "52:54:00:12:34:56" {
+			t.Errorf("%s: unexpected MAC %s", testcase.name, packet.MAC)
+		}
+
+		if len(packet.Options) != len(testcase.options) {
+			t.Errorf(
+				"%s: expected %d options, got %d",
+				testcase.name, len(testcase.options), len(packet.Options),
+			)
+		}
+
+		for code, value := range testcase.options {
+			if !bytes.Equal(packet.Options[code], value) {
+				t.Errorf(
+					"%s: option %d: expected %v, got %v",
+					testcase.name, code, value, packet.Options[code],
+				)
+			}
+		}
+	}
+}
+
+func TestReadDHCPLeasesSkipsExpired(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "hastur-dhcp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(rootDir)
+
+	now := time.Now()
+
+	err = writeDHCPLeases(rootDir, map[string]dhcpLease{
+		"52:54:00:00:00:01": {"10.0.0.2/8", now.Add(time.Hour)},
+		"52:54:00:00:00:02": {"10.0.0.3/8", now.Add(-time.Second)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leases, err := readDHCPLeases(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 1 || leases["52:54:00:00:00:01"].Address != "10.0.0.2/8" {
+		t.Errorf("expected only active lease, got %v", leases)
+	}
+
+	mac, _ := net.ParseMAC("52:54:00:00:00:01")
+
+	err = releaseDHCPLease(rootDir, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leases, err = readDHCPLeases(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 0 {
+		t.Errorf("expected no leases after release, got %v", leases)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	changeAdded    = "A"
+	changeModified = "M"
+	changeDeleted  = "D"
+)
+
+var zfsEscapeRegexp = regexp.MustCompile(`\\[0-3][0-7]{3}`)
+
+// change describes file, which was changed in container relative to its
+// image.
+type change struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// diffContainer returns changes made in container relative to its image.
+func diffContainer(
+	rootDir string,
+	containerName string,
+	storageEngine storage,
+) ([]change, *containerState, error) {
+	if !isExists(getContainerDir(rootDir, containerName)) {
+		return nil, nil, fmt.Errorf(
+			"container '%s' does not exist", containerName,
+		)
+	}
+
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return nil, nil, ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	image, err := getContainerImage(containerName, state, storageEngine)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state == nil {
+		state = &containerState{}
+	}
+
+	state.Image = image
+
+	changes, err := storageEngine.DiffContainer(image, containerName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filtered := []change{}
+	for _, change := range changes {
+		if strings.HasPrefix(change.Path, "/.hastur.exec") {
+			continue
+		}
+
+		filtered = append(filtered, change)
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Path < filtered[j].Path
+	})
+
+	return filtered, state, nil
+}
+
+// exportChanges writes added and modified files of container into tar
+// archive.
+func exportChanges(
+	rootDir string,
+	containerName string,
+	state *containerState,
+	changes []change,
+	archive string,
+	storageEngine storage,
+) error {
+	active, err := listActiveContainers(containerSuffix)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := active[containerName]; !ok {
+		err = storageEngine.InitContainer(state.Image, containerName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't mount root of container '%s'", containerName,
+			)
+		}
+
+		defer storageEngine.DeInitContainer(containerName)
+	}
+
+	list, err := ioutil.TempFile("", "hastur.diff.")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(list.Name())
+	defer list.Close()
+
+	for _, change := range changes {
+		if change.Kind == changeDeleted {
+			continue
+		}
+
+		_, err = fmt.Fprintf(list, ".%s\x00", change.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	absArchive, err := filepath.Abs(archive)
+	if err != nil {
+		return formatAbsPathError(archive, err)
+	}
+
+	containerRoot, err := storageEngine.GetContainerRoot(containerName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get root of container '%s'", containerName,
+		)
+	}
+
+	return runTar(
+		"-cf", absArchive,
+		"-C", containerRoot,
+		"--no-recursion", "--null", "-T", list.Name(),
+	)
+}
+
+func printChanges(changes []change, useJSON bool) error {
+	if useJSON {
+		output, err := json.MarshalIndent(changes, "", "    ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(output))
+
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 2, 4, 1, ' ', 0)
+	for _, change := range changes {
+		fmt.Fprintf(writer, "%s\t%s\n", change.Kind, change.Path)
+	}
+
+	return writer.Flush()
+}
+
+// diffOverlayUpperDir returns changes stored in overlay upper dir. Whiteouts
+// are reported as deleted files, opaque directories and files, which exist
+// in lower layers, are reported as modified. Files of lower layers, which
+// are hidden by opaque directories, are reported as deleted.
+func diffOverlayUpperDir(upper string, layers []string) ([]change, error) {
+	changes := []change{}
+	opaqueDirs := []string{}
+
+	err := filepath.Walk(
+		upper,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path == upper {
+				return nil
+			}
+
+			relPath, err := filepath.Rel(upper, path)
+			if err != nil {
+				return err
+			}
+
+			relPath = "/" + relPath
+
+			if isWhiteout(info) {
+				changes = append(changes, change{changeDeleted, relPath})
+				return nil
+			}
+
+			existsInLower := existsInLayers(layers, relPath)
+			for _, opaqueDir := range opaqueDirs {
+				if strings.HasPrefix(relPath, opaqueDir+"/") {
+					existsInLower = false
+				}
+			}
+
+			switch {
+			case !existsInLower:
+				changes = append(changes, change{changeAdded, relPath})
+
+			case !info.IsDir():
+				changes = append(changes, change{changeModified, relPath})
+
+			case isOpaqueDir(path):
+				changes = append(changes, change{changeModified, relPath})
+
+				changes = append(
+					changes, getHiddenChanges(layers, path, relPath)...,
+				)
+			}
+
+			if info.IsDir() && isOpaqueDir(path) {
+				opaqueDirs = append(opaqueDirs, relPath)
+			}
+
+			return nil
+		},
+	)
+
+	return changes, err
+}
+
+// getHiddenChanges returns entries of lower layers, which are hidden by
+// specified opaque directory of upper dir.
+func getHiddenChanges(layers []string, dir string, relDir string) []change {
+	hidden := map[string]bool{}
+	for _, layer := range layers {
+		entries, _ := ioutil.ReadDir(filepath.Join(layer, relDir))
+		for _, entry := range entries {
+			_, err := os.Lstat(filepath.Join(dir, entry.Name()))
+			if err == nil {
+				continue
+			}
+
+			name := filepath.Join(relDir, entry.Name())
+			if existsInLayers(layers, name) {
+				hidden[name] = true
+			}
+		}
+	}
+
+	changes := []change{}
+	for name := range hidden {
+		changes = append(changes, change{changeDeleted, name})
+	}
+
+	return changes
+}
+
+// existsInLayers checks that path is visible in overlay composed of
+// specified layers, topmost layer goes first.
+func existsInLayers(layers []string, path string) bool {
+	for _, layer := range layers {
+		info, err := os.Lstat(filepath.Join(layer, path))
+		if err == nil {
+			return !isWhiteout(info)
+		}
+
+		for dir := filepath.Dir(path); dir != "/"; dir = filepath.Dir(dir) {
+			info, err := os.Lstat(filepath.Join(layer, dir))
+			if err != nil {
+				continue
+			}
+
+			if isWhiteout(info) || !info.IsDir() {
+				return false
+			}
+
+			if isOpaqueDir(filepath.Join(layer, dir)) {
+				return false
+			}
+		}
+	}
+
+	return false
+}
+
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	return ok && stat.Rdev == 0
+}
+
+func isOpaqueDir(path string) bool {
+	for _, attr := range []string{
+		"trusted.overlay.opaque",
+		"user.overlay.opaque",
+	} {
+		value := make([]byte, 1)
+
+		size, err := syscall.Getxattr(path, attr, value)
+		if err == nil && size == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseZFSDiff parses output of zfs diff -H, paths are made relative to the
+// specified mountpoint.
+func parseZFSDiff(output string, mountpoint string) []change {
+	changes := []change{}
+
+	relative := func(path string) string {
+		path = unescapeZFSPath(path)
+
+		return "/" + strings.TrimLeft(strings.TrimPrefix(path, mountpoint), "/")
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "+":
+			changes = append(changes, change{changeAdded, relative(fields[1])})
+
+		case "-":
+			changes = append(changes, change{changeDeleted, relative(fields[1])})
+
+		case "M":
+			changes = append(changes, change{changeModified, relative(fields[1])})
+
+		case "R":
+			if len(fields) < 3 {
+				continue
+			}
+
+			changes = append(
+				changes,
+				change{changeDeleted, relative(fields[1])},
+				change{changeAdded, relative(fields[2])},
+			)
+		}
+	}
+
+	return changes
+}
+
+// unescapeZFSPath decodes characters, which are escaped by zfs diff as
+// backslash followed by four octal digits, e.g. space is written as \0040.
+func unescapeZFSPath(path string) string {
+	return zfsEscapeRegexp.ReplaceAllStringFunc(
+		path,
+		func(escaped string) string {
+			code, _ := strconv.ParseUint(escaped[1:], 8, 8)
+
+			return string([]byte{byte(code)})
+		},
+	)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseZFSDiff(t *testing.T) {
+	output := "M\t/var/lib/hastur/containers/web/\n" +
+		"+\t/var/lib/hastur/containers/web/srv/index\n" +
+		"-\t/var/lib/hastur/containers/web/usr/bin/tool\n" +
+		"M\t/var/lib/hastur/containers/web/etc/my\\0040file\n" +
+		"R\t/var/lib/hastur/containers/web/old\t" +
+		"/var/lib/hastur/containers/web/new\\0011name\n" +
+		"R\t/var/lib/hastur/containers/web/broken\n" +
+		"\n"
+
+	expected := []change{
+		{changeModified, "/"},
+		{changeAdded, "/srv/index"},
+		{changeDeleted, "/usr/bin/tool"},
+		{changeModified, "/etc/my file"},
+		{changeDeleted, "/old"},
+		{changeAdded, "/new\tname"},
+	}
+
+	changes := parseZFSDiff(output, "/var/lib/hastur/containers/web")
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+}
+
+func TestUnescapeZFSPath(t *testing.T) {
+	testcases := []struct {
+		path     string
+		expected string
+	}{
+		{"/etc/hosts", "/etc/hosts"},
+		{"/my\\0040file", "/my file"},
+		{"/back\\0134slash", "/back\\slash"},
+		{"/\\0303\\0251t\\0303\\0251", "/été"},
+		{"/not\\040escaped", "/not\\040escaped"},
+	}
+
+	for _, testcase := range testcases {
+		path := unescapeZFSPath(testcase.path)
+		if path != testcase.expected {
+			t.Errorf(
+				"%s: expected %q, got %q", testcase.path, testcase.expected, path,
+			)
+		}
+	}
+}
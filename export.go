@@ -0,0 +1,838 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	archiveManifestFile = `hastur.json`
+
+	archiveKindImage     = `image`
+	archiveKindContainer = `container`
+
+	archiveFormatTar   = `tar`
+	archiveFormatZFS   = `zfs`
+	archiveFormatLayer = `layer`
+)
+
+// archiveManifest describes contents of archive created by hastur export.
+type archiveManifest struct {
+	Kind     string          `json:"kind"`
+	Name     string          `json:"name"`
+	Format   string          `json:"format"`
+	Rootfs   string          `json:"rootfs"`
+	Checksum string          `json:"checksum"`
+	Key      *imageKey       `json:"key,omitempty"`
+	Image    string          `json:"image,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+	Packages []string        `json:"packages,omitempty"`
+	State    *containerState `json:"state,omitempty"`
+}
+
+func exportImage(
+	rootDir string,
+	imageName string,
+	archive string,
+	send bool,
+	storageEngine storage,
+) error {
+	image, err := resolveImage(rootDir, imageName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't resolve image '%s'", imageName,
+		)
+	}
+
+	key, err := readImageKey(getImageDir(rootDir, image))
+	if err != nil {
+		return ser.Errorf(
+			err, "can't read key of image %s", image,
+		)
+	}
+
+	tags, err := listTags(rootDir)
+	if err != nil {
+		return ser.Errorf(err, "can't list tags")
+	}
+
+	manifest := &archiveManifest{
+		Kind:     archiveKindImage,
+		Name:     image,
+		Key:      &key,
+		Tags:     tags[image],
+		Packages: key.Packages,
+	}
+
+	format := archiveFormatTar
+	if send {
+		format = archiveFormatZFS
+	}
+
+	return writeArchive(
+		rootDir, archive, manifest,
+		func(rootfs string) error {
+			if send {
+				return sendToFile(
+					rootfs, storageEngine,
+					func(streaming streamingStorage, file *os.File) error {
+						return streaming.SendImage(image, file)
+					},
+				)
+			}
+
+			imageRoot, err := storageEngine.MountImage(image)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't mount image %s", image,
+				)
+			}
+
+			defer storageEngine.UmountImage(image)
+
+			return createCompressedArchive(rootfs, imageRoot)
+		},
+		format,
+	)
+}
+
+func exportContainer(
+	rootDir string,
+	containerName string,
+	archive string,
+	send bool,
+	storageEngine storage,
+) error {
+	manifest, err := newContainerManifest(rootDir, containerName, storageEngine)
+	if err != nil {
+		return err
+	}
+
+	format := archiveFormatTar
+	if send {
+		format = archiveFormatZFS
+	}
+
+	return writeArchive(
+		rootDir, archive, manifest,
+		func(rootfs string) error {
+			if send {
+				return sendToFile(
+					rootfs, storageEngine,
+					func(streaming streamingStorage, file *os.File) error {
+						return streaming.SendContainer(containerName, file)
+					},
+				)
+			}
+
+			return withContainerRoot(
+				containerName, manifest.Image, storageEngine,
+				func(containerRoot string) error {
+					return createCompressedArchive(rootfs, containerRoot)
+				},
+			)
+		},
+		format,
+	)
+}
+
+// exportContainerLayer writes changes of container relative to its image
+// into archive, so container can be restored on top of the same image, e.g.
+// after migration to another storage.
+func exportContainerLayer(
+	rootDir string,
+	containerName string,
+	archive string,
+	storageEngine storage,
+) error {
+	manifest, err := newContainerManifest(rootDir, containerName, storageEngine)
+	if err != nil {
+		return err
+	}
+
+	changes, _, err := diffContainer(rootDir, containerName, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get changes of container '%s'", containerName,
+		)
+	}
+
+	return writeArchive(
+		rootDir, archive, manifest,
+		func(layer string) error {
+			return withContainerRoot(
+				containerName, manifest.Image, storageEngine,
+				func(containerRoot string) error {
+					return createLayerArchive(layer, containerRoot, changes)
+				},
+			)
+		},
+		archiveFormatLayer,
+	)
+}
+
+func newContainerManifest(
+	rootDir string,
+	containerName string,
+	storageEngine storage,
+) (*archiveManifest, error) {
+	if !isExists(getContainerDir(rootDir, containerName)) {
+		return nil, fmt.Errorf(
+			"container '%s' does not exist", containerName,
+		)
+	}
+
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	image, err := getContainerImage(containerName, state, storageEngine)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		state = &containerState{}
+	}
+
+	state.Image = image
+
+	manifest := &archiveManifest{
+		Kind:  archiveKindContainer,
+		Name:  containerName,
+		Image: image,
+		State: state,
+	}
+
+	key, err := readImageKey(getImageDir(rootDir, image))
+	if err == nil {
+		manifest.Packages = key.Packages
+	}
+
+	return manifest, nil
+}
+
+// withContainerRoot calls specified function with root of container, which
+// is mounted on top of specified image if container is not running.
+func withContainerRoot(
+	containerName string,
+	image string,
+	storageEngine storage,
+	fn func(containerRoot string) error,
+) error {
+	active, err := listActiveContainers(containerSuffix)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := active[containerName]; !ok {
+		err = storageEngine.InitContainer(image, containerName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't mount root of container '%s'", containerName,
+			)
+		}
+
+		defer storageEngine.DeInitContainer(containerName)
+	}
+
+	containerRoot, err := storageEngine.GetContainerRoot(containerName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get root of container '%s'", containerName,
+		)
+	}
+
+	return fn(containerRoot)
+}
+
+// createLayerArchive writes added and modified files of container root into
+// tar archive, which can be applied by applyLayer. Parent directories of
+// changed files are written too, so their attributes are kept, and deleted
+// files are written as whiteouts.
+func createLayerArchive(
+	archive string,
+	containerRoot string,
+	changes []change,
+) error {
+	var (
+		entries = map[string]bool{}
+		deleted = []string{}
+	)
+
+	for _, change := range changes {
+		if change.Path == "/" {
+			continue
+		}
+
+		if change.Kind == changeDeleted {
+			deleted = append(deleted, change.Path)
+			continue
+		}
+
+		for dir := path.Dir(change.Path); dir != "/"; dir = path.Dir(dir) {
+			entries[dir] = true
+		}
+
+		entries[change.Path] = true
+
+		if change.Kind != changeAdded {
+			continue
+		}
+
+		// contents of renamed directories are not reported as changes
+		err := filepath.Walk(
+			filepath.Join(containerRoot, change.Path),
+			func(name string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				relPath, err := filepath.Rel(containerRoot, name)
+				if err != nil {
+					return err
+				}
+
+				entries["/"+relPath] = true
+
+				return nil
+			},
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't list contents of '%s'", change.Path,
+			)
+		}
+	}
+
+	names := []string{}
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	err := writeLayerEntries(archive, "-cf", containerRoot, names)
+	if err != nil {
+		return err
+	}
+
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	whiteoutsDir, err := ioutil.TempDir(
+		filepath.Dir(archive), ".hastur.whiteouts.",
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create directory for whiteouts",
+		)
+	}
+
+	defer os.RemoveAll(whiteoutsDir)
+
+	whiteouts := []string{}
+	for _, name := range deleted {
+		whiteout := path.Join(
+			path.Dir(name), whiteoutPrefix+path.Base(name),
+		)
+
+		err = os.MkdirAll(
+			filepath.Join(whiteoutsDir, path.Dir(whiteout)), 0755,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(
+			filepath.Join(whiteoutsDir, whiteout), nil, 0644,
+		)
+		if err != nil {
+			return err
+		}
+
+		whiteouts = append(whiteouts, whiteout)
+	}
+
+	return writeLayerEntries(archive, "-rf", whiteoutsDir, whiteouts)
+}
+
+// writeLayerEntries creates or appends tar archive with specified entries
+// of dir without their contents.
+func writeLayerEntries(
+	archive string,
+	mode string,
+	dir string,
+	names []string,
+) error {
+	list, err := ioutil.TempFile("", "hastur.layer.")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(list.Name())
+	defer list.Close()
+
+	for _, name := range names {
+		_, err = fmt.Fprintf(list, ".%s\x00", name)
+		if err != nil {
+			return err
+		}
+	}
+
+	absArchive, err := filepath.Abs(archive)
+	if err != nil {
+		return formatAbsPathError(archive, err)
+	}
+
+	return runTar(
+		mode, absArchive,
+		"-C", dir,
+		"--no-recursion", "--null", "-T", list.Name(),
+	)
+}
+
+// writeArchive writes rootfs using specified function and packs it together
+// with manifest into the archive.
+func writeArchive(
+	rootDir string,
+	archive string,
+	manifest *archiveManifest,
+	writeRootfs func(rootfs string) error,
+	format string,
+) error {
+	tempDir, err := createTempBuildDir(rootDir, "export.")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	manifest.Format = format
+
+	switch format {
+	case archiveFormatZFS:
+		manifest.Rootfs = "rootfs.zfs"
+	case archiveFormatLayer:
+		manifest.Rootfs = "layer.tar"
+	default:
+		manifest.Rootfs = "rootfs.tar.zst"
+	}
+
+	rootfs := filepath.Join(tempDir, manifest.Rootfs)
+
+	err = writeRootfs(rootfs)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't write %s", manifest.Rootfs,
+		)
+	}
+
+	manifest.Checksum, err = getFileChecksum(rootfs)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(tempDir, archiveManifestFile), data, 0644,
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't write %s", archiveManifestFile,
+		)
+	}
+
+	absArchive, err := filepath.Abs(archive)
+	if err != nil {
+		return formatAbsPathError(archive, err)
+	}
+
+	return createArchive(
+		absArchive, tempDir, archiveManifestFile, manifest.Rootfs,
+	)
+}
+
+func sendToFile(
+	path string,
+	storageEngine storage,
+	send func(streamingStorage, *os.File) error,
+) error {
+	streaming, ok := storageEngine.(streamingStorage)
+	if !ok {
+		return errors.New("storage does not support native streams")
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return send(streaming, file)
+}
+
+func isHasturArchive(archive string) bool {
+	stat, err := os.Stat(archive)
+	if err != nil || stat.IsDir() {
+		return false
+	}
+
+	names, err := listArchive(archive)
+	if err != nil {
+		return false
+	}
+
+	for _, name := range names {
+		if filepath.Clean(name) == archiveManifestFile {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restoreArchive restores image or container from archive created by hastur
+// export. Returns manifest of the archive and name of restored image or
+// container.
+func restoreArchive(
+	rootDir string,
+	archive string,
+	containerName string,
+	force bool,
+	storageEngine storage,
+) (*archiveManifest, string, error) {
+	tempDir, err := createTempBuildDir(rootDir, "import.")
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	err = extractArchive(archive, tempDir)
+	if err != nil {
+		return nil, "", ser.Errorf(
+			err, "can't extract archive to '%s'", tempDir,
+		)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tempDir, archiveManifestFile))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var manifest archiveManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, "", ser.Errorf(
+			err, "can't decode %s", archiveManifestFile,
+		)
+	}
+
+	rootfs := filepath.Join(tempDir, filepath.Clean("/"+manifest.Rootfs))
+
+	checksum, err := getFileChecksum(rootfs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if checksum != manifest.Checksum {
+		return nil, "", fmt.Errorf(
+			"checksum mismatch for %s: expected %s, got %s",
+			manifest.Rootfs, manifest.Checksum, checksum,
+		)
+	}
+
+	switch manifest.Kind {
+	case archiveKindImage:
+		if manifest.Key == nil {
+			return nil, "", errors.New("image key is not specified")
+		}
+
+		image, err := restoreImage(
+			rootDir, *manifest.Key, &manifest, rootfs, force, storageEngine,
+		)
+
+		return &manifest, image, err
+
+	case archiveKindContainer:
+		if containerName == "" {
+			containerName = manifest.Name
+		}
+
+		err := restoreContainer(
+			rootDir, containerName, &manifest, rootfs, force, storageEngine,
+		)
+
+		return &manifest, containerName, err
+
+	default:
+		return nil, "", fmt.Errorf("unknown archive kind '%s'", manifest.Kind)
+	}
+}
+
+func restoreImage(
+	rootDir string,
+	key imageKey,
+	manifest *archiveManifest,
+	rootfs string,
+	force bool,
+	storageEngine storage,
+) (string, error) {
+	// exported image keeps its name, even if it was built by older hastur
+	// version, so containers on top of it can be restored
+	image := key.String()
+	if manifest.Kind == archiveKindImage &&
+		imageNameRegexp.MatchString(manifest.Name) {
+		image = manifest.Name
+	}
+
+	imageDir := getImageDir(rootDir, image)
+
+	if isExists(imageDir, ".hastur") && !force {
+		return image, nil
+	}
+
+	// image is restored from scratch, so files of existing image don't
+	// remain in it
+	if isExists(imageDir) {
+		err := setImageReadOnly(image, false, storageEngine)
+		if err != nil {
+			return "", err
+		}
+
+		err = storageEngine.DeInitImage(image)
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't deinitialize image %s", image,
+			)
+		}
+	}
+
+	if manifest.Format == archiveFormatZFS {
+		err := receiveFromFile(
+			rootfs, storageEngine,
+			func(streaming streamingStorage, file *os.File) error {
+				return streaming.ReceiveImage(image, file)
+			},
+		)
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't receive image %s", image,
+			)
+		}
+	} else {
+		err := storageEngine.InitImage(image, "")
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't initialize image %s", image,
+			)
+		}
+
+		imageRoot, err := storageEngine.MountImage(image)
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't mount image %s", image,
+			)
+		}
+
+		err = extractArchive(rootfs, imageRoot)
+
+		storageEngine.UmountImage(image)
+
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't extract %s", manifest.Rootfs,
+			)
+		}
+	}
+
+	err := setImageParent(rootDir, image, "")
+	if err != nil {
+		return "", err
+	}
+
+	err = writeImageKey(imageDir, key)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't write key for image %s", image,
+		)
+	}
+
+	return image, markImageBuilt(rootDir, image, storageEngine)
+}
+
+// restoreContainer restores container. Container, which was exported as
+// tarball, is restored as a new image and a container on top of it.
+// Container, which was exported as layer, is restored on top of its image,
+// which should be restored first.
+func restoreContainer(
+	rootDir string,
+	containerName string,
+	manifest *archiveManifest,
+	rootfs string,
+	force bool,
+	storageEngine storage,
+) error {
+	if isExists(getContainerDir(rootDir, containerName)) {
+		if !force {
+			return fmt.Errorf(
+				"container '%s' already exists", containerName,
+			)
+		}
+
+		err := storageEngine.DestroyContainer(containerName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't destroy container '%s'", containerName,
+			)
+		}
+	}
+
+	state := manifest.State
+	if state == nil {
+		state = &containerState{}
+	}
+
+	// quota project ids are unique only on the filesystem they're allocated
+	state.ProjectID = 0
+
+	switch manifest.Format {
+	case archiveFormatZFS:
+		err := receiveFromFile(
+			rootfs, storageEngine,
+			func(streaming streamingStorage, file *os.File) error {
+				return streaming.ReceiveContainer(containerName, file)
+			},
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't receive container '%s'", containerName,
+			)
+		}
+
+		if !isExists(getImageDir(rootDir, state.Image), ".hastur") {
+			state.Image = ""
+		}
+
+	case archiveFormatLayer:
+		image := manifest.Image
+		if !imageNameRegexp.MatchString(image) ||
+			!isExists(getImageDir(rootDir, image), ".hastur") {
+			return fmt.Errorf(
+				"image %s of container '%s' is not found",
+				image, containerName,
+			)
+		}
+
+		err := storageEngine.InitContainer(image, containerName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't create container '%s'", containerName,
+			)
+		}
+
+		containerRoot, err := storageEngine.GetContainerRoot(containerName)
+		if err == nil {
+			err = applyLayer(containerRoot, rootfs)
+		}
+
+		storageEngine.DeInitContainer(containerName)
+
+		if err != nil {
+			return ser.Errorf(
+				err, "can't apply layer of container '%s'", containerName,
+			)
+		}
+
+		state.Image = image
+
+	default:
+		// image is identified by checksum of the container root, so
+		// existing image is the same and can be used by other containers
+		image, err := restoreImage(
+			rootDir,
+			imageKey{
+				Distro:   importDistro,
+				Config:   manifest.Checksum,
+				Builder:  []string{},
+				Packages: manifest.Packages,
+			},
+			manifest, rootfs, false, storageEngine,
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't restore image for container '%s'",
+				containerName,
+			)
+		}
+
+		err = storageEngine.InitContainer(image, containerName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't create container '%s'", containerName,
+			)
+		}
+
+		storageEngine.DeInitContainer(containerName)
+
+		state.Image = image
+	}
+
+	return writeContainerState(rootDir, containerName, state)
+}
+
+func receiveFromFile(
+	path string,
+	storageEngine storage,
+	receive func(streamingStorage, *os.File) error,
+) error {
+	streaming, ok := storageEngine.(streamingStorage)
+	if !ok {
+		return errors.New("storage does not support native streams")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return receive(streaming, file)
+}
+
+func createTempBuildDir(rootDir string, prefix string) (string, error) {
+	buildDir := filepath.Join(rootDir, "build")
+
+	err := os.MkdirAll(buildDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tempDir, err := ioutil.TempDir(buildDir, prefix)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't create temporary directory",
+		)
+	}
+
+	return tempDir, nil
+}
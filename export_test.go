@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateLayerArchiveAppliesOnTopOfImage(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "hastur-layer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var (
+		image     = filepath.Join(dir, "image")
+		container = filepath.Join(dir, "container")
+	)
+
+	files := map[string]string{
+		"etc/hostname":     "image",
+		"etc/os-release":   "image",
+		"var/lib/old/data": "image",
+		"usr/bin/tool":     "image",
+	}
+
+	for _, root := range []string{image, container} {
+		for name, data := range files {
+			err = os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ioutil.WriteFile(
+				filepath.Join(root, name), []byte(data), 0644,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// directory is renamed, so its contents are not reported as changes
+	err = os.Rename(
+		filepath.Join(container, "var/lib/old"),
+		filepath.Join(container, "var/lib/new"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(container, "srv/app"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string]string{
+		"etc/hostname":  "container",
+		"srv/app/index": "container",
+	} {
+		err = ioutil.WriteFile(
+			filepath.Join(container, name), []byte(data), 0644,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Remove(filepath.Join(container, "usr/bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []change{
+		{changeModified, "/"},
+		{changeModified, "/etc/hostname"},
+		{changeAdded, "/srv"},
+		{changeAdded, "/srv/app"},
+		{changeAdded, "/srv/app/index"},
+		{changeDeleted, "/usr/bin/tool"},
+		{changeDeleted, "/var/lib/old"},
+		{changeAdded, "/var/lib/new"},
+	}
+
+	layer := filepath.Join(dir, "layer.tar")
+
+	err = createLayerArchive(layer, container, changes)
+	if err != nil {
+		t.Fatalf("can't create layer: %s", err)
+	}
+
+	err = applyLayer(image, layer)
+	if err != nil {
+		t.Fatalf("can't apply layer: %s", err)
+	}
+
+	expected := map[string]string{
+		"etc/hostname":     "container",
+		"etc/os-release":   "image",
+		"srv/app/index":    "container",
+		"var/lib/new/data": "image",
+	}
+
+	for name, data := range expected {
+		contents, err := ioutil.ReadFile(filepath.Join(image, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if string(contents) != data {
+			t.Errorf("%s: expected %q, got %q", name, data, contents)
+		}
+	}
+
+	for _, name := range []string{"usr/bin/tool", "var/lib/old"} {
+		if isExists(image, name) {
+			t.Errorf("%s: deleted file is not removed", name)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(image, "srv/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("srv/app: expected mode 0700, got %o", info.Mode().Perm())
+	}
+
+	names, err := listArchive(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		if filepath.Base(name) == "tool" || filepath.Base(name) == "os-release" {
+			t.Errorf("unchanged or deleted file %s is written into layer", name)
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -22,17 +22,51 @@ func getFSType(root string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+func getMountpoint(path string) (string, error) {
+	command := exec.Command("findmnt", "-o", "target", "-nfT", path)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
 func createBaseDirForPackages(
 	rootDir string,
 	packages []string,
 	storageEngine storage,
 ) (exists bool, dirName string, err error) {
-	imageName := fmt.Sprintf(
-		"%x",
-		sha256.Sum224([]byte(strings.Join(packages, ","))),
+	return createBaseDirForKey(
+		rootDir,
+		newImageKey(packages, ""),
+		true,
+		storageEngine,
 	)
+}
+
+func createBaseDirForKey(
+	rootDir string,
+	key imageKey,
+	layered bool,
+	storageEngine storage,
+) (exists bool, dirName string, err error) {
+	imageName := key.String()
 
 	imageDir := getImageDir(rootDir, imageName)
+	if !isExists(imageDir) {
+		migrated, err := migrateLegacyImage(rootDir, key, storageEngine)
+		if err != nil {
+			return false, "", ser.Errorf(
+				err, "can't migrate legacy image for %s", imageName,
+			)
+		}
+
+		if migrated {
+			return true, imageName, nil
+		}
+	}
+
 	if isExists(imageDir) && !isExists(imageDir, ".hastur") {
 		err = storageEngine.DeInitImage(imageName)
 		if err != nil {
@@ -43,13 +77,37 @@ func createBaseDirForPackages(
 	}
 
 	if !isExists(imageDir) {
-		err = storageEngine.InitImage(imageName)
+		parent := ""
+		if layered {
+			parent, err = findParentImage(rootDir, key)
+			if err != nil {
+				return false, "", ser.Errorf(
+					err, "can't find parent image for %s", imageName,
+				)
+			}
+		}
+
+		err = storageEngine.InitImage(imageName, parent)
 		if err != nil {
 			return false, "", ser.Errorf(
 				err, "can't initialize image %s", imageName,
 			)
 		}
 
+		err = setImageParent(rootDir, imageName, parent)
+		if err != nil {
+			return false, "", ser.Errorf(
+				err, "can't set parent for image %s", imageName,
+			)
+		}
+
+		err = writeImageKey(imageDir, key)
+		if err != nil {
+			return false, "", ser.Errorf(
+				err, "can't write key for image %s", imageName,
+			)
+		}
+
 		return false, imageName, nil
 	} else {
 		return true, imageName, nil
@@ -103,8 +161,8 @@ func getImageDir(rootDir string, imageName string) string {
 	return filepath.Join(rootDir, "images", imageName)
 }
 
-func getBaseDirs(rootDir string) ([]string, error) {
-	return filepath.Glob(filepath.Join(rootDir, "base.#*"))
+func getImageBuildDir(rootDir string, imageName string) string {
+	return filepath.Join(rootDir, "build", imageName)
 }
 
 func removeContainerDir(containerDir string) error {
@@ -117,7 +175,86 @@ func removeContainerDir(containerDir string) error {
 	return nil
 }
 
+// isEmptyRootDir returns true if root dir has no containers and images.
+func isEmptyRootDir(rootDir string) bool {
+	for _, dir := range []string{"containers", "images"} {
+		entries, err := ioutil.ReadDir(filepath.Join(rootDir, dir))
+		if err == nil && len(entries) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 func isExists(path ...string) bool {
 	_, err := os.Stat(filepath.Join(path...))
 	return !os.IsNotExist(err)
 }
+
+// resolveInRoot resolves path inside root the same way as it would be
+// resolved if root was chrooted: absolute symlinks are resolved relative to
+// root and .. can't leave root. Returned path doesn't contain symlinks, so
+// it can be used on host safely.
+func resolveInRoot(root string, unsafePath string) (string, error) {
+	var (
+		current   = ""
+		remaining = filepath.ToSlash(unsafePath)
+		links     = 0
+	)
+
+	for remaining != "" {
+		var component string
+
+		if index := strings.Index(remaining, "/"); index >= 0 {
+			component, remaining = remaining[:index], remaining[index+1:]
+		} else {
+			component, remaining = remaining, ""
+		}
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir("/" + current)[1:]
+			continue
+		}
+
+		next := filepath.Join(current, component)
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf(
+				"too many levels of symbolic links in '%s'", unsafePath,
+			)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			current = ""
+		}
+
+		remaining = target + "/" + remaining
+	}
+
+	return filepath.Join(root, current), nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	imageDistro     = `archlinux`
+	imageKeyFile    = `.key`
+	imageParentFile = `.parent`
+)
+
+var imageBuilderOptions = []string{"-c", "-d"}
+
+// imageKey describes everything that affects contents of built image, so
+// two images with equal keys are interchangeable.
+type imageKey struct {
+	Distro   string   `json:"distro"`
+	Packages []string `json:"packages"`
+	Builder  []string `json:"builder"`
+	Config   string   `json:"config,omitempty"`
+}
+
+func newImageKey(packages []string, config string) imageKey {
+	return imageKey{
+		Distro:   imageDistro,
+		Packages: normalizePackages(packages),
+		Builder:  imageBuilderOptions,
+		Config:   config,
+	}
+}
+
+// String returns image name, which is used as directory name for the image.
+func (key imageKey) String() string {
+	data, _ := json.Marshal(key)
+
+	return fmt.Sprintf("%x", sha256.Sum224(data))
+}
+
+func normalizePackages(packages []string) []string {
+	unique := map[string]struct{}{}
+	for _, packageName := range packages {
+		packageName = strings.TrimSpace(packageName)
+		if packageName == "" {
+			continue
+		}
+
+		unique[packageName] = struct{}{}
+	}
+
+	normalized := []string{}
+	for packageName := range unique {
+		normalized = append(normalized, packageName)
+	}
+
+	sort.Strings(normalized)
+
+	return normalized
+}
+
+func writeImageKey(imageDir string, key imageKey) error {
+	data, err := json.MarshalIndent(key, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(imageDir, imageKeyFile), data, 0644)
+}
+
+// readImageKey reads key of the image. Images created by hastur before keys
+// were introduced have only list of packages, so key is recovered from it.
+func readImageKey(imageDir string) (imageKey, error) {
+	var key imageKey
+
+	data, err := ioutil.ReadFile(filepath.Join(imageDir, imageKeyFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return key, err
+		}
+
+		packages, err := listExplicitlyInstalled(imageDir)
+		if err != nil {
+			return key, err
+		}
+
+		return newImageKey(packages, ""), nil
+	}
+
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return key, ser.Errorf(
+			err, "can't decode image key '%s'", imageDir,
+		)
+	}
+
+	return key, nil
+}
+
+func listImages(rootDir string) ([]string, error) {
+	return listContainers(filepath.Join(rootDir, "images"))
+}
+
+// migrateLegacyImage looks for completely built image, which name was
+// generated by older hastur versions from unsorted list of packages, and
+// renames it according to given key.
+func migrateLegacyImage(
+	rootDir string,
+	key imageKey,
+	storageEngine storage,
+) (bool, error) {
+	images, err := listImages(rootDir)
+	if err != nil {
+		return false, err
+	}
+
+	imageName := key.String()
+
+	for _, image := range images {
+		imageDir := getImageDir(rootDir, image)
+		if image == imageName || !isExists(imageDir, ".hastur") {
+			continue
+		}
+
+		if isExists(imageDir, imageKeyFile) {
+			continue
+		}
+
+		legacyKey, err := readImageKey(imageDir)
+		if err != nil {
+			continue
+		}
+
+		if legacyKey.String() != imageName {
+			continue
+		}
+
+		err = storageEngine.RenameImage(image, imageName)
+		if err != nil {
+			return false, ser.Errorf(
+				err, "can't rename image %s to %s", image, imageName,
+			)
+		}
+
+		err = writeImageKey(getImageDir(rootDir, imageName), key)
+		if err != nil {
+			return false, ser.Errorf(
+				err, "can't write key for image %s", imageName,
+			)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// buildImageForPackages returns name of the image with specified packages,
+// building it if it's not built yet or if rebuild is forced.
+func buildImageForPackages(
+	rootDir string,
+	packages []string,
+	force bool,
+	storageEngine storage,
+) (string, error) {
+	cacheExists, image, err := createBaseDirForPackages(
+		rootDir,
+		packages,
+		storageEngine,
+	)
+	if err != nil {
+		return "", ser.Errorf(
+			err,
+			"can't create base dir '%s'", image,
+		)
+	}
+
+	if cacheExists && !force {
+		return image, nil
+	}
+
+	if cacheExists {
+		err = setImageReadOnly(image, false, storageEngine)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Println("Installing packages")
+	err = installImagePackages(
+		rootDir, image,
+		normalizePackages(packages),
+		storageEngine,
+	)
+	if err != nil {
+		return "", ser.Errorf(
+			err,
+			"can't install packages into '%s'", rootDir,
+		)
+	}
+
+	err = markImageBuilt(rootDir, image, storageEngine)
+	if err != nil {
+		return "", err
+	}
+
+	return image, nil
+}
+
+// markImageBuilt marks image as completely built and makes it read-only, if
+// storage supports it.
+func markImageBuilt(
+	rootDir string,
+	image string,
+	storageEngine storage,
+) error {
+	err := setImageReadOnly(image, false, storageEngine)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(getImageDir(rootDir, image), ".hastur"),
+		nil, 0644,
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create .hastur file in image directory",
+		)
+	}
+
+	return setImageReadOnly(image, true, storageEngine)
+}
+
+// setImageReadOnly protects image from modification or allows to modify
+// it again, e.g. when image is rebuilt.
+func setImageReadOnly(
+	image string,
+	readonly bool,
+	storageEngine storage,
+) error {
+	readOnlyStorage, ok := storageEngine.(readOnlyImageStorage)
+	if !ok {
+		return nil
+	}
+
+	err := readOnlyStorage.SetImageReadOnly(image, readonly)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't change read-only mode of image %s", image,
+		)
+	}
+
+	return nil
+}
+
+// findParentImage returns completely built image with the largest set of
+// packages, which is a subset of packages from given key, so new image can be
+// built as a layer on top of it. Only images built from plain package lists
+// can be used as parents.
+func findParentImage(rootDir string, key imageKey) (string, error) {
+	images, err := listImages(rootDir)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		parent   = ""
+		packages = 0
+	)
+
+	for _, image := range images {
+		imageDir := getImageDir(rootDir, image)
+		if image == key.String() || !isExists(imageDir, ".hastur") {
+			continue
+		}
+
+		parentKey, err := readImageKey(imageDir)
+		if err != nil {
+			continue
+		}
+
+		if parentKey.Distro != key.Distro || parentKey.Config != "" {
+			continue
+		}
+
+		if strings.Join(parentKey.Builder, " ") !=
+			strings.Join(key.Builder, " ") {
+			continue
+		}
+
+		if len(parentKey.Packages) <= packages {
+			continue
+		}
+
+		if len(subtractPackages(parentKey.Packages, key.Packages)) > 0 {
+			continue
+		}
+
+		parent = image
+		packages = len(parentKey.Packages)
+	}
+
+	return parent, nil
+}
+
+func getImageParent(rootDir string, image string) (string, error) {
+	data, err := ioutil.ReadFile(
+		filepath.Join(getImageDir(rootDir, image), imageParentFile),
+	)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// setImageParent records parent of the image. Marker of completely built
+// image is removed as well, because it can be inherited from parent image.
+func setImageParent(rootDir string, image string, parent string) error {
+	imageDir := getImageDir(rootDir, image)
+
+	err := os.Remove(filepath.Join(imageDir, ".hastur"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if parent == "" {
+		err = os.Remove(filepath.Join(imageDir, imageParentFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	return ioutil.WriteFile(
+		filepath.Join(imageDir, imageParentFile),
+		[]byte(parent+"\n"),
+		0644,
+	)
+}
+
+// getImageLayers returns directories of the image and all its parents,
+// topmost layer goes first.
+func getImageLayers(rootDir string, image string) ([]string, error) {
+	layers := []string{}
+	visited := map[string]bool{}
+
+	for image != "" {
+		if visited[image] {
+			return nil, fmt.Errorf(
+				"image %s is a parent of itself", image,
+			)
+		}
+
+		visited[image] = true
+
+		layers = append(layers, getImageDir(rootDir, image))
+
+		parent, err := getImageParent(rootDir, image)
+		if err != nil {
+			return nil, ser.Errorf(
+				err, "can't get parent of image %s", image,
+			)
+		}
+
+		image = parent
+	}
+
+	return layers, nil
+}
+
+// installImagePackages installs packages into the image. If image is a layer
+// on top of another image, only missing packages will be installed.
+func installImagePackages(
+	rootDir string,
+	image string,
+	packages []string,
+	storageEngine storage,
+) error {
+	parent, err := getImageParent(rootDir, image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get parent of image %s", image,
+		)
+	}
+
+	missing := packages
+	if parent != "" {
+		parentKey, err := readImageKey(getImageDir(rootDir, parent))
+		if err != nil {
+			return ser.Errorf(
+				err, "can't read key of image %s", parent,
+			)
+		}
+
+		missing = subtractPackages(packages, parentKey.Packages)
+	}
+
+	imageRoot, err := storageEngine.MountImage(image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't mount image %s", image,
+		)
+	}
+
+	defer storageEngine.UmountImage(image)
+
+	if len(missing) > 0 {
+		err = installPackages(imageRoot, missing)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeExplicitlyInstalled(imageRoot, packages)
+}
+
+func subtractPackages(packages []string, subtrahend []string) []string {
+	excluded := map[string]struct{}{}
+	for _, packageName := range subtrahend {
+		excluded[packageName] = struct{}{}
+	}
+
+	result := []string{}
+	for _, packageName := range packages {
+		if _, ok := excluded[packageName]; !ok {
+			result = append(result, packageName)
+		}
+	}
+
+	return result
+}
+
+// recreateImage removes built image and creates empty image with the same
+// key, so it can be built again from scratch.
+func recreateImage(
+	rootDir string,
+	image string,
+	key imageKey,
+	storageEngine storage,
+) error {
+	err := setImageReadOnly(image, false, storageEngine)
+	if err != nil {
+		return err
+	}
+
+	err = storageEngine.DeInitImage(image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't deinitialize image %s", image,
+		)
+	}
+
+	_, _, err = createBaseDirForKey(rootDir, key, false, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create base dir '%s'", image,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestNormalizePackages(t *testing.T) {
+	testcases := []struct {
+		packages []string
+		expected []string
+	}{
+		{
+			[]string{"bash", "coreutils"},
+			[]string{"bash", "coreutils"},
+		},
+		{
+			[]string{"vim", "bash", "git"},
+			[]string{"bash", "git", "vim"},
+		},
+		{
+			[]string{" git ", "git", "bash", "", "  "},
+			[]string{"bash", "git"},
+		},
+		{
+			[]string{},
+			[]string{},
+		},
+		{
+			nil,
+			[]string{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		normalized := normalizePackages(testcase.packages)
+		if !reflect.DeepEqual(normalized, testcase.expected) {
+			t.Errorf(
+				"%q: expected %q, got %q",
+				testcase.packages, testcase.expected, normalized,
+			)
+		}
+	}
+}
+
+func TestNewImageKey(t *testing.T) {
+	nameRegexp := regexp.MustCompile(`^[0-9a-f]{56}$`)
+
+	testcases := []struct {
+		packages []string
+		config   string
+		same     []string
+		other    []string
+	}{
+		{
+			packages: []string{"bash", "git"},
+			same:     []string{"git", "bash", "git"},
+			other:    []string{"bash"},
+		},
+		{
+			packages: []string{"bash", "git"},
+			config:   "recipe",
+			same:     []string{" git", "bash "},
+			other:    []string{"bash", "git", "vim"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		key := newImageKey(testcase.packages, testcase.config)
+		name := key.String()
+
+		if !nameRegexp.MatchString(name) {
+			t.Errorf("%q: invalid image name %s", testcase.packages, name)
+		}
+
+		if key.Distro != imageDistro ||
+			!reflect.DeepEqual(key.Builder, imageBuilderOptions) ||
+			key.Config != testcase.config {
+			t.Errorf("%q: unexpected key %#v", testcase.packages, key)
+		}
+
+		same := newImageKey(testcase.same, testcase.config).String()
+		if same != name {
+			t.Errorf(
+				"%q and %q: expected same image, got %s and %s",
+				testcase.packages, testcase.same, name, same,
+			)
+		}
+
+		other := newImageKey(testcase.other, testcase.config).String()
+		if other == name {
+			t.Errorf(
+				"%q and %q: expected different images",
+				testcase.packages, testcase.other,
+			)
+		}
+
+		if newImageKey(testcase.packages, "other").String() == name {
+			t.Errorf("%q: config doesn't change image", testcase.packages)
+		}
+	}
+}
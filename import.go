@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	importDistro = `import`
+
+	whiteoutPrefix = `.wh.`
+	whiteoutOpaque = `.wh..wh..opq`
+
+	ociMediaTypeIndex           = `application/vnd.oci.image.index.v1+json`
+	dockerMediaTypeManifestList = `application/vnd.docker.distribution.manifest.list.v2+json`
+)
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// importedImage describes root filesystem, which should be imported as image.
+type importedImage struct {
+	checksum string
+	layers   []string
+	tags     []string
+}
+
+// importImage imports rootfs tarball, OCI image layout directory or archive
+// created by docker save as a new image.
+func importImage(
+	rootDir string,
+	source string,
+	force bool,
+	storageEngine storage,
+) (string, []string, error) {
+	tempDir, err := createTempBuildDir(rootDir, "import.")
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	imported, err := readImportSource(source, tempDir)
+	if err != nil {
+		return "", nil, ser.Errorf(
+			err, "can't read '%s'", source,
+		)
+	}
+
+	key := imageKey{
+		Distro:  importDistro,
+		Config:  imported.checksum,
+		Builder: []string{},
+	}
+
+	cacheExists, image, err := createBaseDirForKey(
+		rootDir, key, false, storageEngine,
+	)
+	if err != nil {
+		return "", nil, ser.Errorf(
+			err, "can't create base dir '%s'", image,
+		)
+	}
+
+	if cacheExists && !force {
+		return image, imported.tags, nil
+	}
+
+	// layers are applied to empty image only, so files of previous import
+	// don't remain in the image
+	if cacheExists {
+		err = recreateImage(rootDir, image, key, storageEngine)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	imageRoot, err := storageEngine.MountImage(image)
+	if err != nil {
+		return "", nil, ser.Errorf(
+			err, "can't mount image %s", image,
+		)
+	}
+
+	defer storageEngine.UmountImage(image)
+
+	for _, layer := range imported.layers {
+		err = applyLayer(imageRoot, layer)
+		if err != nil {
+			return "", nil, ser.Errorf(
+				err, "can't apply layer '%s'", layer,
+			)
+		}
+	}
+
+	err = writeExplicitlyInstalled(imageRoot, []string{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = markImageBuilt(rootDir, image, storageEngine)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return image, imported.tags, nil
+}
+
+func readImportSource(source string, tempDir string) (*importedImage, error) {
+	stat, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		return readOCILayout(source)
+	}
+
+	names, err := listArchive(source)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't list archive contents",
+		)
+	}
+
+	layout := ""
+	for _, name := range names {
+		switch path.Clean(name) {
+		case "manifest.json":
+			layout = "docker"
+		case "oci-layout":
+			if layout == "" {
+				layout = "oci"
+			}
+		}
+	}
+
+	if layout == "" {
+		checksum, err := getFileChecksum(source)
+		if err != nil {
+			return nil, err
+		}
+
+		return &importedImage{
+			checksum: checksum,
+			layers:   []string{source},
+		}, nil
+	}
+
+	err = extractArchive(source, tempDir)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't extract archive to '%s'", tempDir,
+		)
+	}
+
+	if layout == "oci" {
+		return readOCILayout(tempDir)
+	}
+
+	return readDockerArchive(tempDir)
+}
+
+func readDockerArchive(dir string) (*importedImage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []dockerManifest
+	err = json.Unmarshal(data, &manifests)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode manifest.json",
+		)
+	}
+
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("no images found in manifest.json")
+	}
+
+	manifest := manifests[0]
+
+	imported := &importedImage{
+		checksum: fmt.Sprintf("%x", sha256.Sum256(data)),
+	}
+
+	for _, layer := range manifest.Layers {
+		imported.layers = append(
+			imported.layers,
+			filepath.Join(dir, filepath.Clean("/"+layer)),
+		)
+	}
+
+	for _, tag := range manifest.RepoTags {
+		if validateTag(tag) == nil {
+			imported.tags = append(imported.tags, tag)
+		}
+	}
+
+	return imported, nil
+}
+
+func readOCILayout(dir string) (*importedImage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	var manifest ociManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode index.json",
+		)
+	}
+
+	// index can reference another indexes, so go down until manifest with
+	// layers is found
+	for len(manifest.Layers) == 0 {
+		descriptor, err := selectOCIManifest(manifest.Manifests)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(getOCIBlobPath(dir, descriptor.Digest))
+		if err != nil {
+			return nil, ser.Errorf(
+				err, "can't read manifest %s", descriptor.Digest,
+			)
+		}
+
+		manifest = ociManifest{}
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			return nil, ser.Errorf(
+				err, "can't decode manifest %s", descriptor.Digest,
+			)
+		}
+
+		if manifest.MediaType != ociMediaTypeIndex &&
+			manifest.MediaType != dockerMediaTypeManifestList &&
+			len(manifest.Layers) == 0 {
+			return nil, fmt.Errorf(
+				"manifest %s has no layers", descriptor.Digest,
+			)
+		}
+	}
+
+	imported := &importedImage{
+		checksum: checksum,
+	}
+
+	for _, layer := range manifest.Layers {
+		imported.layers = append(
+			imported.layers,
+			getOCIBlobPath(dir, layer.Digest),
+		)
+	}
+
+	return imported, nil
+}
+
+// selectOCIManifest selects manifest for the current platform, if platform
+// is specified.
+func selectOCIManifest(manifests []ociDescriptor) (ociDescriptor, error) {
+	for _, manifest := range manifests {
+		if manifest.Platform == nil {
+			return manifest, nil
+		}
+
+		if manifest.Platform.OS == "linux" &&
+			manifest.Platform.Architecture == runtime.GOARCH {
+			return manifest, nil
+		}
+	}
+
+	return ociDescriptor{}, fmt.Errorf(
+		"no manifests found for linux/%s", runtime.GOARCH,
+	)
+}
+
+func getOCIBlobPath(dir string, digest string) string {
+	return filepath.Join(
+		dir, "blobs", filepath.Clean("/"+strings.Replace(digest, ":", "/", 1)),
+	)
+}
+
+func getFileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't calculate checksum of '%s'", path,
+		)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// applyLayer removes files, which are marked by whiteouts in the layer, and
+// extracts layer on top of root. Layer is extracted into empty directory
+// first and then moved into root, resolving paths inside root, so symlinks
+// of the image, e.g. var/run -> /run, don't point to host files.
+func applyLayer(root string, layer string) error {
+	names, err := listArchive(layer)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't list layer contents",
+		)
+	}
+
+	for _, name := range names {
+		for _, component := range strings.Split(name, "/") {
+			if component == ".." {
+				return fmt.Errorf(
+					"layer entry '%s' points outside of root", name,
+				)
+			}
+		}
+	}
+
+	for _, name := range names {
+		dir, base := path.Split(path.Clean("/" + name))
+
+		if base != whiteoutOpaque && !strings.HasPrefix(base, whiteoutPrefix) {
+			continue
+		}
+
+		dir, err = resolveInRoot(root, dir)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't resolve path of whiteout '%s'", name,
+			)
+		}
+
+		if base == whiteoutOpaque {
+			err = removeDirContents(dir)
+		} else {
+			err = os.RemoveAll(filepath.Join(
+				dir, strings.TrimPrefix(base, whiteoutPrefix),
+			))
+		}
+
+		if err != nil {
+			return ser.Errorf(
+				err, "can't apply whiteout '%s'", name,
+			)
+		}
+	}
+
+	// temporary directory is created inside root, so layer files can be
+	// moved into root by rename
+	layerDir, err := ioutil.TempDir(root, ".hastur.layer.")
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create directory for layer",
+		)
+	}
+
+	defer os.RemoveAll(layerDir)
+
+	err = extractArchive(layer, layerDir, "--exclude="+whiteoutPrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	return mergeLayerDir(layerDir, root, "/")
+}
+
+// mergeLayerDir moves contents of dir in extracted layer into root.
+// Directories, which already exist in root, are merged, other files are
+// replaced.
+func mergeLayerDir(layerDir string, root string, dir string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(layerDir, dir))
+	if err != nil {
+		return err
+	}
+
+	target, err := resolveInRoot(root, dir)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't resolve path '%s'", dir,
+		)
+	}
+
+	for _, entry := range entries {
+		var (
+			name        = path.Join(dir, entry.Name())
+			source      = filepath.Join(layerDir, name)
+			destination = filepath.Join(target, entry.Name())
+		)
+
+		if entry.IsDir() {
+			resolved, err := resolveInRoot(root, name)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't resolve path '%s'", name,
+				)
+			}
+
+			info, err := os.Stat(resolved)
+			if err == nil && info.IsDir() {
+				err = mergeLayerDir(layerDir, root, name)
+				if err != nil {
+					return err
+				}
+
+				err = copyFileAttributes(entry, resolved)
+				if err != nil {
+					return ser.Errorf(
+						err, "can't set attributes of '%s'", name,
+					)
+				}
+
+				continue
+			}
+		}
+
+		err = os.RemoveAll(destination)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't remove '%s'", name,
+			)
+		}
+
+		err = os.Rename(source, destination)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't move '%s' into root", name,
+			)
+		}
+	}
+
+	return nil
+}
+
+// copyFileAttributes sets mode, owner and modification time of target to
+// ones of specified file.
+func copyFileAttributes(info os.FileInfo, target string) error {
+	err := os.Chmod(target, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		err = os.Lchown(target, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+func removeDirContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, entry := range entries {
+		err := os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
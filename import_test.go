@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "hastur-root-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"run", "usr/lib", "etc"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"var":      "usr",
+		"usr/run":  "/run",
+		"lib":      "usr/lib",
+		"escape":   "../../../../etc",
+		"loop":     "loop",
+		"etc/self": ".",
+	}
+
+	for link, target := range links {
+		err = os.Symlink(target, filepath.Join(root, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testcases := []struct {
+		path     string
+		expected string
+		valid    bool
+	}{
+		{"/", "", true},
+		{"/etc/passwd", "etc/passwd", true},
+		{"var/run/foo", "run/foo", true},
+		{"/lib/../etc", "usr/etc", true},
+		{"../../etc", "etc", true},
+		{"escape/passwd", "etc/passwd", true},
+		{"etc/self/self/hosts", "etc/hosts", true},
+		{"missing/dir/file", "missing/dir/file", true},
+		{"loop/file", "", false},
+	}
+
+	for _, testcase := range testcases {
+		resolved, err := resolveInRoot(root, testcase.path)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", testcase.path)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.path, err)
+			continue
+		}
+
+		expected := filepath.Join(root, testcase.expected)
+		if resolved != expected {
+			t.Errorf(
+				"%s: expected %s, got %s", testcase.path, expected, resolved,
+			)
+		}
+	}
+}
+
+func TestApplyLayerDoesNotFollowSymlinksOutsideRoot(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+
+	host, err := ioutil.TempDir("", "hastur-host-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(host)
+
+	root := filepath.Join(host, "root")
+	hostRun := filepath.Join(host, "run")
+
+	for _, dir := range []string{
+		filepath.Join(root, "run"),
+		filepath.Join(root, "var"),
+		hostRun,
+		filepath.Join(host, "layer", "var", "run"),
+	} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// symlink resolves to host directory if it's followed outside of root
+	err = os.Symlink(hostRun, filepath.Join(root, "var", "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{
+		filepath.Join(hostRun, "foo"),
+		filepath.Join(root, hostRun, "foo"),
+		filepath.Join(host, "layer", "var", "run", ".wh.foo"),
+		filepath.Join(host, "layer", "var", "run", "bar"),
+	} {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(file, []byte{}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layer := filepath.Join(host, "layer.tar")
+	err = exec.Command(
+		"tar", "-cf", layer, "-C", filepath.Join(host, "layer"), "var",
+	).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = applyLayer(root, layer)
+	if err != nil {
+		t.Fatalf("can't apply layer: %s", err)
+	}
+
+	if !isExists(hostRun, "foo") {
+		t.Errorf("whiteout removed file outside of root")
+	}
+
+	if isExists(hostRun, "bar") {
+		t.Errorf("layer file is written outside of root")
+	}
+
+	if isExists(root, hostRun, "foo") {
+		t.Errorf("whiteout is not applied inside root")
+	}
+
+	if !isExists(root, hostRun, "bar") {
+		t.Errorf("layer file is not written inside root")
+	}
+}
@@ -6,9 +6,15 @@ import (
 	"github.com/reconquest/executil-go"
 )
 
-func addPostroutingMasquarading(dev string) error {
-	args := []string{"-t", "nat", "-A", "POSTROUTING", "-o", dev,
-		"-j", "MASQUERADE"}
+// addPostroutingMasquarading masquerades traffic, which leaves host through
+// the bridge. Traffic to the network of the bridge isn't masqueraded, so
+// containers on the bridge see each other addresses even if bridge traffic
+// passes through iptables.
+func addPostroutingMasquarading(dev string, network string) error {
+	args := append(
+		[]string{"-t", "nat", "-A", "POSTROUTING", "-o", dev},
+		getMasquaradingArgs(network)...,
+	)
 
 	command := exec.Command("iptables", args...)
 	_, _, err := executil.Run(command)
@@ -19,9 +25,30 @@ func addPostroutingMasquarading(dev string) error {
 	return nil
 }
 
-func removePostroutingMasquarading(dev string) error {
-	args := []string{"-t", "nat", "-D", "POSTROUTING", "-o", dev,
-		"-j", "MASQUERADE"}
+// addPostroutingNetworkMasquarading masquerades traffic from containers
+// network, which leaves host not through the bridge. Network can be either
+// IPv4 or IPv6 (NAT66).
+func addPostroutingNetworkMasquarading(dev string, network string) error {
+	return runIPTables(
+		network,
+		"-t", "nat", "-A", "POSTROUTING", "-s", network,
+		"!", "-o", dev, "-j", "MASQUERADE",
+	)
+}
+
+func removePostroutingNetworkMasquarading(dev string, network string) error {
+	return runIPTables(
+		network,
+		"-t", "nat", "-D", "POSTROUTING", "-s", network,
+		"!", "-o", dev, "-j", "MASQUERADE",
+	)
+}
+
+func removePostroutingMasquarading(dev string, network string) error {
+	args := append(
+		[]string{"-t", "nat", "-D", "POSTROUTING", "-o", dev},
+		getMasquaradingArgs(network)...,
+	)
 
 	command := exec.Command("iptables", args...)
 	_, _, err := executil.Run(command)
@@ -31,3 +58,69 @@ func removePostroutingMasquarading(dev string) error {
 
 	return nil
 }
+
+func getMasquaradingArgs(network string) []string {
+	if network == "" {
+		return []string{"-j", "MASQUERADE"}
+	}
+
+	return []string{"-s", network, "!", "-d", network, "-j", "MASQUERADE"}
+}
+
+// addIsolationRules drops all forwarded traffic, which enters or leaves
+// specified bridge, so containers on the bridge can reach only each other
+// and the host.
+func addIsolationRules(dev string) error {
+	for _, family := range []string{"0.0.0.0/0", "::/0"} {
+		for _, rule := range getIsolationRules(dev) {
+			err := runIPTables(family, append([]string{"-C"}, rule...)...)
+			if err == nil {
+				continue
+			}
+
+			err = runIPTables(family, append([]string{"-I"}, rule...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func removeIsolationRules(dev string) error {
+	for _, family := range []string{"0.0.0.0/0", "::/0"} {
+		for _, rule := range getIsolationRules(dev) {
+			err := runIPTables(family, append([]string{"-D"}, rule...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func getIsolationRules(dev string) [][]string {
+	return [][]string{
+		{"FORWARD", "-i", dev, "!", "-o", dev, "-j", "DROP"},
+		{"FORWARD", "-o", dev, "!", "-i", dev, "-j", "DROP"},
+	}
+}
+
+// runIPTables runs iptables or ip6tables depending on family of specified
+// address or network.
+func runIPTables(address string, args ...string) error {
+	binary := "iptables"
+	if isIPv6Address(address) {
+		binary = "ip6tables"
+	}
+
+	command := exec.Command(binary, args...)
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -5,15 +5,14 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"os"
-	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/reconquest/executil-go"
+	"github.com/reconquest/karma-go"
 	"github.com/reconquest/ser-go"
 )
 
@@ -35,9 +34,31 @@ services and running local network of trusted containers.
 
 Usage:
     hastur -h | --help
-    hastur [options] [-b=] [-s=] [-a=] [-p <packages>...] [-n=] -S [--] [<command>...]
+    hastur [options] [-b=] [-s=] [-a=] [-L=] [--nat66] [--subnet=<subnet>] [--hash-address] [-w <network>...] [-N=] [--gateway=<gateway>] [-P <port>...] [--deny-internet] [--deny-host] [--allow=<peer>...] [--reset-policy] [-p <packages>...] [-R=] [-i=] [-n=] -S [--] [<command>...]
+    hastur [options] [-s=] -B [-T=] <recipe>
+    hastur [options] [-s=] --tag <image> <tag>
+    hastur [options] [-s=] --untag <tag>...
+    hastur [options] [-s=] --images [-j]
+    hastur [options] [-s=] --import [-T=] [-n=] <archive>
+    hastur [options] [-s=] --export [--send] <name> <archive>
+    hastur [options] [-s=] --commit <name> <tag>
+    hastur [options] [-s=] [-a=] --clone <name> <target>
+    hastur [options] [-s=] --snapshot <name> <snapshot>
+    hastur [options] [-s=] --rollback <name> <snapshot>
+    hastur [options] [-s=] --remove-snapshot <name> <snapshot>
+    hastur [options] [-s=] --reset <name>
+    hastur [options] [-s=] --diff [-j] [-o=] <name>
+    hastur [options] [-s=] --export-image [--send] <image> <archive>
     hastur [options] [-s=] -Q [-j] [<name>...]
     hastur [options] [-s=] -D [-f] <name>
+    hastur [options] [-s=] [-f] --migrate <spec>
+    hastur [options] [-s=] --add-network [--nat] [--isolated] <network> <bridge>
+    hastur [options] [-s=] --remove-network <network>
+    hastur [options] [-s=] --networks [-j]
+    hastur [options] [-s=] --isolate
+    hastur [options] [-s=] --restore-uplink <iface>
+    hastur [options] [-s=] [-b=] --dhcp
+    hastur [options] [-s=] --capture [--bridge] [--filter=<filter>] [--duration=<duration>] [--pcapng] <name> [<file>]
     hastur [options] [-s=] --free
 
 Options:
@@ -54,42 +75,252 @@ Options:
                       root dir to provide groundwork for overlayfs.
                       [default: autodetect]
        <storage>     Possible values are:
-                      * autodetect - use one of available storage engines
-                      depending on current FS.
-                      * overlayfs:N - use current FS and overlayfs on top;
-                      if overlayfs is unsupported on current FS, mount tmpfs of
-                      size N first.
-                      * zfs:POOL - use ZFS and use <root> located on POOL.
+                      * autodetect - use storage engine, which was used in
+                      <root> previously, or overlayfs otherwise.
+                      * overlayfs[:OPTIONS] - use current FS and overlayfs on
+                      top. Options are:
+                        tmpfs-size=N - if overlayfs is unsupported on
+                        current FS, mount tmpfs of size N first;
+                        upper=auto|tmpfs - with tmpfs, mount tmpfs even if
+                        current FS is supported.
+                      * zfs:OPTIONS - use ZFS. Options are:
+                        pool=POOL - use <root> located on POOL;
+                        mountpoint=PATH - mountpoint of <root> dataset,
+                          should be absolute path of <root>;
+                        compression=ALGORITHM - compression for datasets;
+                        recordsize=N - record size for datasets;
+                        atime=on|off - access time updates for datasets;
+                        dedup=on|off|... - deduplication for datasets.
+                      Dataset properties can be prefixed with image. or
+                      container. to set them only on image or container
+                      datasets. Built images are read-only.
+                      * NAME[:OPTIONS] - use external storage driver
+                      hastur-storage-NAME found in PATH, options are passed
+                      to the driver as is.
+                      Options are separated by comma. Value without option
+                      name is treated as tmpfs-size for overlayfs and as
+                      pool for zfs, e.g. overlayfs:2G or zfs:tank.
+                      Storage specified for empty <root> is remembered and
+                      storage, which doesn't match remembered one, is
+                      refused unless -f is specified.
 
 Create options:
     -S               Create and start container.
        <command>     Execute specified command in created
                       container.
       -b <bridge>    Bridge interface name and, optionally, an address,
-                      separated by colon.
+                      separated by colon. IPv4 and IPv6 addresses can be
+                      specified separated by comma, e.g.
+                      br0:10.0.0.1/8,fd00::1/64.
                       If bridge does not exists, it will be automatically
                       created.
                       [default: br0:10.0.0.1/8]
       -t <iface>     Use host network and gain access to external network.
                       Interface will pair given interface with bridge.
+                      Addresses and routes of interface are remembered
+                      and restored when last container on the bridge exits.
       -p <packages>  Packages to install, separated by comma.
                       [default: ` + defaultPackages + `]
+      -R <recipe>    Use image built from specified recipe file instead of
+                      image with packages specified by -p.
+      -i <image>     Use specified image, which can be referenced either by
+                      tag or by name, instead of image with packages specified
+                      by -p.
       -n <name>      Use specified container name. If not specified, randomly
                       generated name will be used and container will be
                       considered ephemeral, e.g. will be destroyed on <command>
                       exit.
       -a <address>   Use specified IP address/netmask. If not specified,
-                      automatically generated adress from 10.0.0.0/8 will
-                      be used.
+                      automatically generated adress from network of bridge
+                      address will be used.
+                      IPv6 address can be specified after comma. If bridge
+                      has IPv6 address and container has no one, it will be
+                      generated from the bridge network.
+      --subnet <subnet>
+                     Allocate container addresses from specified IPv4
+                      network instead of network of bridge address. Subnet
+                      is remembered for <root>.
+      --hash-address
+                     Derive container address from hash of its name, so
+                      the same name always gets the same address. Mode is
+                      remembered for <root>. Addresses of other containers
+                      in <root> and networks routed by host are skipped.
+      --nat66        Masquerade IPv6 traffic from containers, which leaves
+                      host not through the bridge.
+      -N <mode>      Use specified network mode instead of bridge. Mode
+                      is remembered for container. Possible values are:
+                      * bridge - attach container to bridge specified by -b;
+                      * veth - connect container to host by veth pair
+                      without bridge, address of bridge specified by -b is
+                      assigned to host side and used as gateway, traffic is
+                      masqueraded;
+                      * macvlan:IFACE, ipvlan:IFACE - create macvlan or
+                      ipvlan interface on host interface IFACE, so container
+                      appears directly in its network; container address
+                      should be specified using -a;
+                      * host - use host network;
+                      * none - use only loopback interface.
+      --gateway <gateway>
+                     Use specified gateway for default route in macvlan and
+                      ipvlan modes.
+      -P <port>      Publish container port on host, format is
+                      hostport:containerport[/proto], where proto is tcp
+                      (default), udp or sctp. Can be specified several times.
+                      If not specified, ports of existing container will be
+                      published.
+      --deny-internet
+                     Drop traffic from container, which leaves container
+                      networks, and don't masquerade it.
+      --deny-host    Drop new connections from container to the host's
+                      bridge address.
+      --allow <peer>
+                     Allow traffic from container only to specified peer,
+                      which can be address, network or container name,
+                      optionally followed by :port[/proto], e.g. db:5432
+                      or [fd00::1]:80/tcp. Can be specified several times.
+                      All other traffic from container, including traffic
+                      to the host, is dropped.
+      --reset-policy
+                     Remove network policy of existing container. If no
+                      policy options are specified, policy of existing
+                      container is used.
+      -w <network>   Attach container to specified named network instead
+                      of bridge specified by -b. Can be specified several
+                      times; container gets interfaces host0, host1, ... and
+                      address on every network, default route goes through
+                      the first one. Address specified by -a is used on the
+                      first network. If not specified, networks of existing
+                      container or default network of <root> will be used.
+      -L <size>      Limit size of container writable layer, e.g. 10G.
+                      Size suffixes K, M, G and T are supported, 0 removes
+                      the limit. If not specified, limit of existing
+                      container will be used.
       -k             Keep container after exit if it name was autogenerated.
       -x <dir>       Copy entries of specified directory into created
                       container root directory.
       -e             Keep container after exit if executed <command> failed.
 
+Build options:
+    -B               Build image from specified recipe file. Recipe is a JSON
+                      file with following fields:
+                      * name - name of the recipe;
+                      * packages - list of packages to install;
+                      * files - list of objects with source, target and
+                      optional octal mode fields, which describe files to
+                      copy into image; source is relative to recipe file;
+                      * commands - list of shell commands to run inside
+                      image;
+                      * environment - environment variables for commands.
+                      Image will be rebuilt only if recipe or files are
+                      changed or if -f is specified.
+      -T <tag>       Tag built image with specified tag instead of recipe
+                      name.
+
+Image options:
+    --tag            Tag specified <image> with <tag>. Image can be referenced
+                      either by name or by another tag. Existing tag will be
+                      moved to specified image.
+    --untag          Remove specified tags. Images will not be removed.
+    --images         Show images in the <root> dir with their tags and
+                      packages.
+    --import         Import image from specified <archive>, which can be
+                      either rootfs tarball, OCI image layout directory or
+                      archive created by docker save. Layers will be
+                      flattened into single image. Image will be tagged with
+                      tag specified by -T or with tags from docker archive.
+                      Archives created by --export and --export-image are
+                      restored as well; restored container can be renamed
+                      using -n.
+    --commit         Create new image from stopped container with specified
+                      <name> and tag it with <tag>. Image will be based on
+                      the container's image, so other containers can be
+                      started from it using -i.
+    --clone          Create new container <target> as a copy of container
+                      with specified <name>. New container will get the same
+                      options, except published ports, and new machine id.
+                      Containers in named networks get address specified
+                      by -a or automatically generated one, containers in
+                      other modes get address on start.
+    --export         Export container with specified <name> into <archive>.
+                      Root of container will be archived using tar and zstd.
+    --export-image   Export specified <image> into <archive>.
+      --send         Use native stream of storage engine (zfs send) instead
+                      of tar.
+
+Snapshot options:
+    --snapshot       Save current state of container with specified <name> as
+                      <snapshot>. ZFS snapshots are used for ZFS storage and
+                      copies of container's upper dir for overlayfs.
+    --rollback       Revert stopped container to specified <snapshot>. ZFS
+                      snapshots, which were created after it, are destroyed.
+    --remove-snapshot
+                     Remove specified <snapshot> of container.
+    --reset          Revert stopped container to the state of its image by
+                      wiping all container changes. ZFS snapshots of the
+                      container are destroyed as well.
+
 Query options:
     -Q               Show information about containers in the <root> dir.
        <name>        Query container's options.
     -j               Output information using JSON format.
+    --diff           Show files added (A), modified (M) and deleted (D) in
+                      container with specified <name> relative to its image.
+      -o <archive>   Write added and modified files into tar <archive>.
+Migrate options:
+    --migrate        Move all images and containers in <root> to storage
+                      specified by <spec>, which has the same format as
+                      <storage>. Containers should be stopped. Images and
+                      changes of containers are exported into archives next
+                      to <root> and restored after old storage is destroyed,
+                      containers are restored on top of their images. Other
+                      files of <root>, e.g. container states and networks,
+                      are kept. Containers with snapshots are migrated only
+                      if -f is specified, snapshots are dropped.
+
+Network options:
+    --add-network    Create named <network> on specified <bridge>, which has
+                      the same format as -b and should have IPv4 address,
+                      which defines subnet of the network. Subnets of
+                      networks in <root> should not overlap.
+      --nat          Masquerade traffic from network, which leaves host not
+                      through the bridge.
+      --isolated     Drop traffic forwarded between network and other
+                      interfaces, so containers can reach only each other
+                      and host.
+    --remove-network
+                     Remove named <network>. Network used by containers is
+                      removed only if -f is specified.
+    --networks       Show named networks in the <root> dir.
+    --isolate        Create isolated network with unique bridge and subnet
+                      for <root> and use it by default for containers, so
+                      containers of different roots can't see each other.
+
+    --restore-uplink
+                     Restore addresses and routes of host interface <iface>,
+                      which was added to bridge using -t, and remove it from
+                      the bridge.
+    --dhcp           Run DHCPv4 server on bridge specified by -b. Containers
+                      get addresses, which are configured for them by
+                      hastur, other clients get addresses allocated from
+                      network of the bridge address, which are remembered in
+                      <root> until they are released or expire after an
+                      hour without renewal.
+    --capture        Capture packets on host side of veth pair of running
+                      container <name> and write them in pcap format into
+                      <file> or to stdout if <file> is not specified or is -.
+                      Capture is stopped by SIGINT.
+      --bridge       Capture packets on bridge of the container instead,
+                      selecting packets with container address.
+      --filter <filter>
+                     Capture only packets matching <filter>, which is either
+                      expression of primitives joined by 'and': ip, ip6,
+                      arp, tcp, udp, icmp, host ADDRESS, port PORT, or BPF
+                      program in format of tcpdump -ddd output with lines
+                      separated by comma.
+      --duration <duration>
+                     Stop capture after specified <duration>, e.g. 30s.
+      --pcapng       Write packets in pcapng format.
+
 Destroy options:
     -D               Destroy specified container.
     --free           Completely remove all data in <root> directory with
@@ -117,19 +348,80 @@ func main() {
 		panic(err)
 	}
 
+	// network commands don't use storage, so they work even if storage
+	// can't be initialized, e.g. when ZFS pool is not imported
+	switch {
+	case args["--add-network"].(bool):
+		err = addNamedNetwork(args)
+	case args["--remove-network"].(bool):
+		err = removeNamedNetwork(args)
+	case args["--networks"].(bool):
+		err = listNamedNetworks(args)
+	case args["--isolate"].(bool):
+		err = isolateRootNetwork(args)
+	case args["--restore-uplink"].(bool):
+		err = restoreHostUplink(args)
+	case args["--dhcp"].(bool):
+		err = runDHCPServer(args)
+	case args["--capture"].(bool):
+		err = captureContainerPackets(args)
+	default:
+		err = runStorageCommand(args)
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// runStorageCommand initializes storage and runs command, which operates on
+// images or containers.
+func runStorageCommand(args map[string]interface{}) error {
 	var (
 		rootDir     = args["-r"].(string)
 		storageSpec = args["-s"].(string)
 	)
 
-	storageEngine, err := createStorageFromSpec(rootDir, storageSpec)
+	storageEngine, err := createStorageFromSpec(
+		rootDir, storageSpec, args["-f"].(bool),
+	)
 	if err != nil {
-		fatal(ser.Errorf(err, "can't initialize storage"))
+		return ser.Errorf(err, "can't initialize storage")
 	}
 
 	switch {
 	case args["-S"].(bool):
 		err = createAndStart(args, storageEngine)
+	case args["-B"].(bool):
+		err = buildImage(args, storageEngine)
+	case args["--migrate"].(bool):
+		err = migrateRoot(args, storageEngine)
+	case args["--tag"].(bool):
+		err = tagImage(args)
+	case args["--untag"].(bool):
+		err = untagImages(args)
+	case args["--images"].(bool):
+		err = queryImages(args, storageEngine)
+	case args["--import"].(bool):
+		err = importImageArchive(args, storageEngine)
+	case args["--commit"].(bool):
+		err = commitContainerImage(args, storageEngine)
+	case args["--clone"].(bool):
+		err = cloneContainerCopy(args, storageEngine)
+	case args["--snapshot"].(bool):
+		err = snapshotContainer(args, storageEngine)
+	case args["--rollback"].(bool):
+		err = rollbackContainer(args, storageEngine)
+	case args["--remove-snapshot"].(bool):
+		err = removeContainerSnapshot(args, storageEngine)
+	case args["--reset"].(bool):
+		err = resetContainerLayer(args, storageEngine)
+	case args["--diff"].(bool):
+		err = showContainerDiff(args, storageEngine)
+	case args["--export"].(bool):
+		err = exportContainerArchive(args, storageEngine)
+	case args["--export-image"].(bool):
+		err = exportImageArchive(args, storageEngine)
 	case args["-Q"].(bool):
 		err = queryContainers(args, storageEngine)
 	case args["-D"].(bool):
@@ -138,9 +430,7 @@ func main() {
 		err = destroyRoot(args, storageEngine)
 	}
 
-	if err != nil {
-		fatal(err)
-	}
+	return err
 }
 
 func execBootstrap() error {
@@ -183,53 +473,33 @@ func destroyContainer(
 	storageEngine storage,
 ) error {
 	var (
+		rootDir       = args["-r"].(string)
 		containerName = args["<name>"].([]string)[0]
 	)
 
 	err := storageEngine.DestroyContainer(containerName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't destroy container '%s'", containerName,
+		)
+	}
 
 	_ = umountNetorkNamespace(containerName)
 
-	err = cleanupNetworkInterface(containerName)
+	_ = removeContainerFirewall(containerName)
+
+	err = cleanupNetworkInterface(rootDir, containerName)
 	if err != nil {
 		log.Println(err)
 	}
 
-	return err
-}
-
-func showBaseDirsInfo(
-	args map[string]interface{},
-	storageEngine storage,
-) error {
-	var (
-		rootDir = args["-r"].(string)
-	)
-
-	baseDirs, err := getBaseDirs(rootDir)
+	err = removeContainerState(rootDir, containerName)
 	if err != nil {
 		return ser.Errorf(
-			err,
-			"can't get base dirs from '%s'", rootDir,
+			err, "can't remove state of container '%s'", containerName,
 		)
 	}
 
-	for _, baseDir := range baseDirs {
-		packages, err := listExplicitlyInstalled(baseDir)
-		if err != nil {
-			return ser.Errorf(
-				err,
-				"can't list explicitly installed packages in '%s'",
-				baseDir,
-			)
-		}
-
-		fmt.Println(baseDir)
-		for _, packageName := range packages {
-			fmt.Printf("\t%s\n", packageName)
-		}
-	}
-
 	return nil
 }
 
@@ -249,95 +519,152 @@ func createAndStart(
 		keepFailed        = args["-e"].(bool)
 		copyingDir, _     = args["-x"].(string)
 		hostInterface, _  = args["-t"].(string)
+		recipePath, _     = args["-R"].(string)
+		imageName, _      = args["-i"].(string)
 		quiet             = args["-q"].(bool)
+		quota, _          = args["-L"].(string)
+		nat66             = args["--nat66"].(bool)
+		subnet, _         = args["--subnet"].(string)
+		hashAddress       = args["--hash-address"].(bool)
+		networkNames, _   = args["-w"].([]string)
+		networkMode, _    = args["-N"].(string)
+		gateway, _        = args["--gateway"].(string)
+		portSpecs, _      = args["-P"].([]string)
+		denyInternet      = args["--deny-internet"].(bool)
+		denyHost          = args["--deny-host"].(bool)
+		allowedPeers, _   = args["--allow"].([]string)
+		resetPolicy       = args["--reset-policy"].(bool)
 	)
 
-	err := ensureIPv4Forwarding()
+	if quota != "" {
+		_, err := parseSize(quota)
+		if err != nil {
+			return err
+		}
+	}
+
+	ports, err := parsePublishedPorts(portSpecs)
+	if err != nil {
+		return err
+	}
+
+	bridgeDevice, bridgeAddress := parseBridgeInfo(bridgeInfo)
+
+	err = validateAddresses(bridgeAddress)
 	if err != nil {
 		return ser.Errorf(
-			err,
-			"can't enable ipv4 forwarding",
+			err, "invalid address of bridge '%s'", bridgeDevice,
 		)
 	}
 
-	bridgeDevice, bridgeAddress := parseBridgeInfo(bridgeInfo)
-	err = ensureBridge(bridgeDevice)
+	err = validateAddresses(networkAddress)
 	if err != nil {
 		return ser.Errorf(
-			err,
-			"can't create bridge interface '%s'", bridgeDevice,
+			err, "invalid container address '%s'", networkAddress,
 		)
 	}
 
-	err = ensureBridgeInterfaceUp(bridgeDevice)
+	err = configureNetwork(rootDir, subnet, hashAddress)
 	if err != nil {
 		return ser.Errorf(
-			err,
-			"can't set bridge '%s' up",
-			bridgeDevice,
+			err, "can't configure network of '%s'", rootDir,
 		)
 	}
 
-	if bridgeAddress != "" {
-		err = setupBridge(bridgeDevice, bridgeAddress)
-		if err != nil {
-			return ser.Errorf(
-				err,
-				"can't assign address '%s' on bridge '%s'",
-				bridgeAddress,
-				bridgeDevice,
-			)
+	ephemeral := false
+	if containerName == "" {
+		generatedName := generateContainerName()
+		if !keep {
+			ephemeral = true
+
+			if !keepFailed && !quiet {
+				fmt.Println(
+					"Container is ephemeral and will be deleted after exit.",
+				)
+			}
 		}
+
+		containerName = generatedName
+
+		fmt.Printf("Container name: %s\n", containerName)
 	}
 
-	if hostInterface != "" {
-		err := addInterfaceToBridge(hostInterface, bridgeDevice)
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	if networkMode == "" && state != nil {
+		networkMode = state.Network
+	}
+
+	if networkMode == "" {
+		networkMode = networkModeBridge
+	}
+
+	mode, link, err := parseNetworkMode(networkMode)
+	if err != nil {
+		return err
+	}
+
+	if mode != networkModeBridge && len(networkNames) > 0 {
+		return fmt.Errorf(
+			"named networks can't be used in %s network mode", mode,
+		)
+	}
+
+	gateway, err = parseGatewayAddress(gateway)
+	if err != nil {
+		return err
+	}
+
+	if len(networkNames) == 0 && mode == networkModeBridge {
+		networkNames, err = getDefaultNetworks(rootDir, state)
 		if err != nil {
 			return ser.Errorf(
-				err,
-				"can't bind host's ethernet '%s' to '%s'",
-				hostInterface,
-				bridgeDevice,
+				err, "can't get networks of container '%s'", containerName,
 			)
 		}
+	}
 
-		err = copyInterfaceAddressToBridge(hostInterface, bridgeDevice)
-		if err != nil {
-			return ser.Errorf(
-				err,
-				"can't copy address from host's '%s' to '%s'",
-				hostInterface,
+	// bridge address is used as gateway by containers in veth mode
+	hasGateway := mode == networkModeBridge || mode == networkModeVeth
+	if len(networkNames) == 0 && hasGateway {
+		if nat66 && getIPv6Address(bridgeAddress) == "" {
+			return fmt.Errorf(
+				"bridge '%s' should have IPv6 address to use NAT66",
 				bridgeDevice,
 			)
 		}
 
-		err = copyInterfaceRoutesToBridge(hostInterface, bridgeDevice)
+		err = ensureIPv4Forwarding()
 		if err != nil {
 			return ser.Errorf(
 				err,
-				"can't copy routes from host's '%s' to '%s'",
-				hostInterface,
-				bridgeDevice,
+				"can't enable ipv4 forwarding",
 			)
 		}
-	}
-
-	ephemeral := false
-	if containerName == "" {
-		generatedName := generateContainerName()
-		if !keep {
-			ephemeral = true
 
-			if !keepFailed && !quiet {
-				fmt.Println(
-					"Container is ephemeral and will be deleted after exit.",
+		if getIPv6Address(bridgeAddress) != "" {
+			err = ensureIPv6Forwarding()
+			if err != nil {
+				return ser.Errorf(
+					err,
+					"can't enable ipv6 forwarding",
 				)
 			}
 		}
 
-		containerName = generatedName
-
-		fmt.Printf("Container name: %s\n", containerName)
+		if mode == networkModeBridge {
+			err = prepareBridge(
+				rootDir, bridgeDevice, bridgeAddress, hostInterface,
+			)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	allPackages := []string{}
@@ -346,35 +673,44 @@ func createAndStart(
 		allPackages = append(allPackages, packages...)
 	}
 
-	cacheExists, baseDir, err := createBaseDirForPackages(
-		rootDir,
-		allPackages,
-		storageEngine,
-	)
-	if err != nil {
-		return ser.Errorf(
-			err,
-			"can't create base dir '%s'", baseDir,
-		)
-	}
+	var baseDir string
+	switch {
+	case imageName != "":
+		baseDir, err = resolveImage(rootDir, imageName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't resolve image '%s'", imageName,
+			)
+		}
 
-	if !cacheExists || force {
-		fmt.Println("Installing packages")
-		err = installPackages(getImageDir(rootDir, baseDir), allPackages)
+	case recipePath != "":
+		recipe, err := readRecipe(recipePath)
 		if err != nil {
 			return ser.Errorf(
-				err,
-				"can't install packages into '%s'", rootDir,
+				err, "can't read recipe '%s'", recipePath,
+			)
+		}
+
+		baseDir, err = buildImageForRecipe(
+			rootDir, recipe, force, storageEngine,
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't build image for recipe '%s'", recipePath,
 			)
 		}
 
-		err = ioutil.WriteFile(
-			filepath.Join(getImageDir(rootDir, baseDir), ".hastur"),
-			nil, 0644,
+	default:
+		baseDir, err = buildImageForPackages(
+			rootDir,
+			allPackages,
+			force,
+			storageEngine,
 		)
 		if err != nil {
 			return ser.Errorf(
-				err, "can't create .hastur file in image directory",
+				err,
+				"can't build image for packages %q", allPackages,
 			)
 		}
 	}
@@ -387,17 +723,202 @@ func createAndStart(
 		)
 	}
 
-	if networkAddress == "" {
-		_, baseIPNet, _ := net.ParseCIDR("10.0.0.0/8")
-		networkAddress = generateRandomNetwork(baseIPNet)
+	if quota == "" && state != nil {
+		quota = state.Quota
+	}
+
+	projectID := uint32(0)
+	if state != nil {
+		projectID = state.ProjectID
+	}
+
+	if quota != "" {
+		size, _ := parseSize(quota)
+
+		err = storageEngine.SetContainerQuota(containerName, size)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't set quota for container '%s'", containerName,
+			)
+		}
+
+		// quota project id can be allocated and stored by storage
+		quotaState, err := readContainerState(rootDir, containerName)
+		if err == nil && quotaState != nil {
+			projectID = quotaState.ProjectID
+		}
+
+		if size == 0 {
+			quota = ""
+		}
+	}
+
+	var (
+		interfaces []containerInterface
+		networks   []containerNetwork
+	)
+
+	if len(networkNames) > 0 {
+		interfaces, networks, err = getContainerNetworks(
+			rootDir, containerName, networkNames, networkAddress, state,
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't setup networks of '%s'", containerName,
+			)
+		}
+
+		if !quiet && (state == nil || len(state.Networks) == 0) {
+			for _, network := range networks {
+				fmt.Printf(
+					"Container will use IP: %s (%s)\n",
+					network.Address, network.Name,
+				)
+			}
+		}
+
+		networkAddress = networks[0].Address
+		bridgeInfo = interfaces[0].Bridge + ":" + interfaces[0].Gateway
+	} else {
+		switch mode {
+		case networkModeHost, networkModeNone:
+			networkAddress = ""
+
+		case networkModeMacvlan, networkModeIPvlan:
+			if networkAddress == "" {
+				return fmt.Errorf(
+					"container address should be specified using -a "+
+						"in %s network mode",
+					mode,
+				)
+			}
+
+			bridgeAddress = gateway
+		}
+
+		if networkAddress == "" && hasGateway {
+			networkAddress, err = allocateContainerAddress(
+				rootDir, containerName, bridgeAddress,
+			)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't allocate address for '%s'", containerName,
+				)
+			}
+
+			if !quiet {
+				fmt.Printf("Container will use IP: %s\n", networkAddress)
+			}
+		}
+
+		if hasGateway {
+			networkAddress, err = ensureIPv6Address(
+				networkAddress, bridgeAddress,
+			)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't allocate IPv6 address for '%s'",
+					containerName,
+				)
+			}
+		}
+
+		iface := containerInterface{
+			Mode:         mode,
+			Link:         link,
+			Name:         getNetworkModeInterface(mode, link),
+			Address:      networkAddress,
+			Gateway:      bridgeAddress,
+			DefaultRoute: true,
+			NAT66:        nat66,
+		}
+
+		switch mode {
+		case networkModeBridge:
+			iface.Bridge = bridgeDevice
+			iface.Masquerade = true
+
+		case networkModeVeth:
+			iface.HostName = getVethHostName(
+				"ve-", containerName+containerSuffix,
+			)
+			iface.NAT = true
+		}
+
+		interfaces = []containerInterface{iface}
+	}
+
+	if len(ports) == 0 && state != nil {
+		ports = state.Ports
+	}
+
+	if len(ports) > 0 && networkAddress == "" {
+		return fmt.Errorf(
+			"ports can't be published in %s network mode", mode,
+		)
+	}
+
+	policy := &networkPolicy{
+		DenyInternet: denyInternet,
+		DenyHost:     denyHost,
+		Allow:        allowedPeers,
+	}
+
+	if policy.IsEmpty() && !resetPolicy && state != nil {
+		policy = state.Policy
+	}
+
+	if !policy.IsEmpty() {
+		if networkAddress == "" {
+			return fmt.Errorf(
+				"network policy can't be used in %s network mode", mode,
+			)
+		}
 
-		if !quiet {
-			fmt.Printf("Container will use IP: %s\n", networkAddress)
+		err = resolveNetworkPolicy(rootDir, policy)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't resolve network policy",
+			)
 		}
+	} else {
+		policy = nil
+	}
+
+	// bridge mode is default and is not remembered, so container can be
+	// attached to named networks later
+	stateNetworkMode := ""
+	if mode != networkModeBridge {
+		stateNetworkMode = networkMode
+	}
+
+	err = writeContainerState(rootDir, containerName, &containerState{
+		Image:     baseDir,
+		Address:   networkAddress,
+		Bridge:    bridgeInfo,
+		Quota:     quota,
+		ProjectID: projectID,
+		Networks:  networks,
+		Network:   stateNetworkMode,
+		Ports:     ports,
+		Policy:    policy,
+	})
+	if err != nil {
+		return ser.Errorf(
+			err, "can't write state of container '%s'", containerName,
+		)
 	}
 
+	// images can be read-only, so entries are copied only into container
 	if copyingDir != "" {
-		err = copyDir(copyingDir, getImageDir(rootDir, baseDir))
+		containerRoot, err := storageEngine.GetContainerRoot(containerName)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't get root of container '%s'", containerName,
+			)
+		}
+
+		err = copyDir(copyingDir, containerRoot)
 		if err != nil {
 			return ser.Errorf(
 				err,
@@ -408,12 +929,31 @@ func createAndStart(
 
 	err = nspawn(
 		storageEngine,
+		rootDir,
 		containerName,
-		bridgeDevice, networkAddress, bridgeAddress,
+		interfaces, ports, policy,
 		ephemeral, keepFailed, quiet,
 		commandLine,
 	)
 
+	if mode == networkModeBridge && len(networkNames) == 0 {
+		restoreErr := restoreUnusedUplinks(rootDir, bridgeDevice)
+		if restoreErr != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(
+				restoreErr,
+				"WARNING: can't restore host interfaces of bridge '%s'",
+				bridgeDevice,
+			))
+		}
+	}
+
+	if ephemeral && (err == nil || !keepFailed) {
+		removeErr := removeContainerState(rootDir, containerName)
+		if removeErr != nil {
+			log.Println(removeErr)
+		}
+	}
+
 	if err != nil {
 		if executil.IsExitError(err) {
 			os.Exit(executil.GetExitStatus(err))
@@ -425,25 +965,655 @@ func createAndStart(
 	return nil
 }
 
-func destroyRoot(
-	args map[string]interface{},
-	storageEngine storage,
+// prepareBridge creates bridge with specified address and adds host
+// interface to it, if specified.
+func prepareBridge(
+	rootDir string,
+	bridgeDevice string,
+	bridgeAddress string,
+	hostInterface string,
 ) error {
-	err := storageEngine.Destroy()
+	err := ensureBridge(bridgeDevice)
 	if err != nil {
 		return ser.Errorf(
-			err, "can't destroy storage",
+			err,
+			"can't create bridge interface '%s'", bridgeDevice,
 		)
 	}
 
-	return nil
-}
-
-func generateContainerName() string {
-	tuples := []string{"ir", "oh", "at", "op", "un", "ed"}
-	triples := []string{"gep", "vin", "kut", "lop", "man", "zod"}
-	all := append(append([]string{}, tuples...), triples...)
-
+	err = ensureBridgeInterfaceUp(bridgeDevice)
+	if err != nil {
+		return ser.Errorf(
+			err,
+			"can't set bridge '%s' up",
+			bridgeDevice,
+		)
+	}
+
+	if bridgeAddress != "" {
+		err = setupBridge(bridgeDevice, bridgeAddress)
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't assign address '%s' on bridge '%s'",
+				bridgeAddress,
+				bridgeDevice,
+			)
+		}
+	}
+
+	if hostInterface != "" {
+		err = saveUplinkState(rootDir, hostInterface, bridgeDevice)
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't save configuration of host's ethernet '%s'",
+				hostInterface,
+			)
+		}
+
+		err = addInterfaceToBridge(hostInterface, bridgeDevice)
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't bind host's ethernet '%s' to '%s'",
+				hostInterface,
+				bridgeDevice,
+			)
+		}
+
+		err = copyInterfaceAddressToBridge(hostInterface, bridgeDevice)
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't copy address from host's '%s' to '%s'",
+				hostInterface,
+				bridgeDevice,
+			)
+		}
+
+		err = copyInterfaceRoutesToBridge(hostInterface, bridgeDevice)
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't copy routes from host's '%s' to '%s'",
+				hostInterface,
+				bridgeDevice,
+			)
+		}
+	}
+
+	return nil
+}
+
+func buildImage(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir    = args["-r"].(string)
+		recipePath = args["<recipe>"].(string)
+		force      = args["-f"].(bool)
+		tag, _     = args["-T"].(string)
+	)
+
+	recipe, err := readRecipe(recipePath)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't read recipe '%s'", recipePath,
+		)
+	}
+
+	image, err := buildImageForRecipe(rootDir, recipe, force, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't build image for recipe '%s'", recipePath,
+		)
+	}
+
+	if tag == "" {
+		tag = recipe.Name
+	}
+
+	err = setTag(rootDir, tag, image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't tag image %s with '%s'", image, tag,
+		)
+	}
+
+	fmt.Println(image)
+
+	return nil
+}
+
+func importImageArchive(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir          = args["-r"].(string)
+		archive          = args["<archive>"].(string)
+		force            = args["-f"].(bool)
+		tag, _           = args["-T"].(string)
+		containerName, _ = args["-n"].(string)
+	)
+
+	var (
+		image string
+		tags  []string
+		err   error
+	)
+
+	if isHasturArchive(archive) {
+		manifest, name, err := restoreArchive(
+			rootDir, archive, containerName, force, storageEngine,
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't restore archive '%s'", archive,
+			)
+		}
+
+		if manifest.Kind == archiveKindContainer {
+			fmt.Println(name)
+
+			return nil
+		}
+
+		image, tags = name, manifest.Tags
+	} else {
+		image, tags, err = importImage(rootDir, archive, force, storageEngine)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't import image from '%s'", archive,
+			)
+		}
+	}
+
+	if tag != "" {
+		tags = []string{tag}
+	}
+
+	for _, tag := range tags {
+		err = setTag(rootDir, tag, image)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't tag image %s with '%s'", image, tag,
+			)
+		}
+	}
+
+	fmt.Println(image)
+
+	return nil
+}
+
+func commitContainerImage(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir       = args["-r"].(string)
+		containerName = args["<name>"].([]string)[0]
+		tag           = args["<tag>"].([]string)[0]
+		force         = args["-f"].(bool)
+	)
+
+	err := validateTag(tag)
+	if err != nil {
+		return err
+	}
+
+	image, err := commitContainer(rootDir, containerName, force, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't commit container '%s'", containerName,
+		)
+	}
+
+	err = setTag(rootDir, tag, image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't tag image %s with '%s'", image, tag,
+		)
+	}
+
+	fmt.Println(image)
+
+	return nil
+}
+
+func cloneContainerCopy(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir           = args["-r"].(string)
+		containerName     = args["<name>"].([]string)[0]
+		target            = args["<target>"].(string)
+		networkAddress, _ = args["-a"].(string)
+		force             = args["-f"].(bool)
+	)
+
+	address, err := cloneContainer(
+		rootDir, containerName, target, networkAddress, force,
+		storageEngine,
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't clone container '%s' to '%s'", containerName, target,
+		)
+	}
+
+	if address != "" {
+		fmt.Printf("Container will use IP: %s\n", address)
+	}
+
+	return nil
+}
+
+func snapshotContainer(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir       = args["-r"].(string)
+		containerName = args["<name>"].([]string)[0]
+		snapshot      = args["<snapshot>"].(string)
+	)
+
+	err := validateSnapshotName(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if !isExists(getContainerDir(rootDir, containerName)) {
+		return fmt.Errorf("container '%s' does not exist", containerName)
+	}
+
+	err = storageEngine.SnapshotContainer(containerName, snapshot)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create snapshot '%s' of container '%s'",
+			snapshot, containerName,
+		)
+	}
+
+	return nil
+}
+
+func rollbackContainer(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir       = args["-r"].(string)
+		containerName = args["<name>"].([]string)[0]
+		snapshot      = args["<snapshot>"].(string)
+		force         = args["-f"].(bool)
+	)
+
+	err := ensureContainerStopped(rootDir, containerName, force)
+	if err != nil {
+		return err
+	}
+
+	err = storageEngine.RollbackContainer(containerName, snapshot)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't rollback container '%s' to snapshot '%s'",
+			containerName, snapshot,
+		)
+	}
+
+	return nil
+}
+
+func removeContainerSnapshot(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		containerName = args["<name>"].([]string)[0]
+		snapshot      = args["<snapshot>"].(string)
+	)
+
+	err := storageEngine.RemoveContainerSnapshot(containerName, snapshot)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't remove snapshot '%s' of container '%s'",
+			snapshot, containerName,
+		)
+	}
+
+	return nil
+}
+
+func resetContainerLayer(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir       = args["-r"].(string)
+		containerName = args["<name>"].([]string)[0]
+		force         = args["-f"].(bool)
+	)
+
+	err := resetContainer(rootDir, containerName, force, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't reset container '%s'", containerName,
+		)
+	}
+
+	return nil
+}
+
+func showContainerDiff(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir       = args["-r"].(string)
+		containerName = args["<name>"].([]string)[0]
+		useJSON       = args["-j"].(bool)
+		archive, _    = args["-o"].(string)
+	)
+
+	changes, state, err := diffContainer(
+		rootDir, containerName, storageEngine,
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get changes of container '%s'", containerName,
+		)
+	}
+
+	if archive != "" {
+		err = exportChanges(
+			rootDir, containerName, state, changes, archive, storageEngine,
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't write changes of container '%s' to '%s'",
+				containerName, archive,
+			)
+		}
+	}
+
+	return printChanges(changes, useJSON)
+}
+
+func exportContainerArchive(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir       = args["-r"].(string)
+		containerName = args["<name>"].([]string)[0]
+		archive       = args["<archive>"].(string)
+		send          = args["--send"].(bool)
+	)
+
+	err := exportContainer(
+		rootDir, containerName, archive, send, storageEngine,
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't export container '%s' to '%s'",
+			containerName, archive,
+		)
+	}
+
+	return nil
+}
+
+func exportImageArchive(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir   = args["-r"].(string)
+		imageName = args["<image>"].(string)
+		archive   = args["<archive>"].(string)
+		send      = args["--send"].(bool)
+	)
+
+	err := exportImage(rootDir, imageName, archive, send, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't export image '%s' to '%s'", imageName, archive,
+		)
+	}
+
+	return nil
+}
+
+func tagImage(args map[string]interface{}) error {
+	var (
+		rootDir   = args["-r"].(string)
+		imageName = args["<image>"].(string)
+		tag       = args["<tag>"].([]string)[0]
+	)
+
+	image, err := resolveImage(rootDir, imageName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't resolve image '%s'", imageName,
+		)
+	}
+
+	err = setTag(rootDir, tag, image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't tag image %s with '%s'", image, tag,
+		)
+	}
+
+	return nil
+}
+
+func untagImages(args map[string]interface{}) error {
+	var (
+		rootDir = args["-r"].(string)
+		tags    = args["<tag>"].([]string)
+	)
+
+	for _, tag := range tags {
+		err := removeTag(rootDir, tag)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't remove tag '%s'", tag,
+			)
+		}
+	}
+
+	return nil
+}
+
+func migrateRoot(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	var (
+		rootDir    = args["-r"].(string)
+		targetSpec = args["<spec>"].(string)
+		force      = args["-f"].(bool)
+	)
+
+	err := migrateStorage(rootDir, targetSpec, force, storageEngine)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't migrate '%s' to storage '%s'", rootDir, targetSpec,
+		)
+	}
+
+	return nil
+}
+
+func addNamedNetwork(args map[string]interface{}) error {
+	var (
+		rootDir    = args["-r"].(string)
+		name       = args["<network>"].(string)
+		bridgeInfo = args["<bridge>"].(string)
+		nat        = args["--nat"].(bool)
+		isolated   = args["--isolated"].(bool)
+	)
+
+	err := addNetwork(rootDir, name, bridgeInfo, nat, isolated)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't add network '%s'", name,
+		)
+	}
+
+	return nil
+}
+
+func removeNamedNetwork(args map[string]interface{}) error {
+	var (
+		rootDir = args["-r"].(string)
+		name    = args["<network>"].(string)
+		force   = args["-f"].(bool)
+	)
+
+	err := removeNetwork(rootDir, name, force)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't remove network '%s'", name,
+		)
+	}
+
+	return nil
+}
+
+func listNamedNetworks(args map[string]interface{}) error {
+	return listNetworks(args["-r"].(string), args["-j"].(bool))
+}
+
+func isolateRootNetwork(args map[string]interface{}) error {
+	rootDir := args["-r"].(string)
+
+	network, err := isolateRoot(rootDir)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create isolated network for '%s'", rootDir,
+		)
+	}
+
+	fmt.Printf(
+		"Containers will use network on %s:%s\n",
+		network.Bridge, network.Address,
+	)
+
+	return nil
+}
+
+func restoreHostUplink(args map[string]interface{}) error {
+	var (
+		rootDir = args["-r"].(string)
+		iface   = args["<iface>"].(string)
+	)
+
+	err := restoreUplink(rootDir, iface)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't restore configuration of '%s'", iface,
+		)
+	}
+
+	return nil
+}
+
+func runDHCPServer(args map[string]interface{}) error {
+	var (
+		rootDir    = args["-r"].(string)
+		bridgeInfo = args["-b"].(string)
+	)
+
+	bridgeDevice, bridgeAddress := parseBridgeInfo(bridgeInfo)
+
+	err := serveDHCP(rootDir, bridgeDevice, bridgeAddress)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't serve DHCP on '%s'", bridgeDevice,
+		)
+	}
+
+	return nil
+}
+
+func captureContainerPackets(args map[string]interface{}) error {
+	var (
+		rootDir         = args["-r"].(string)
+		containerName   = args["<name>"].([]string)[0]
+		useBridge       = args["--bridge"].(bool)
+		filter, _       = args["--filter"].(string)
+		durationSpec, _ = args["--duration"].(string)
+		outputPath, _   = args["<file>"].(string)
+		usePcapng       = args["--pcapng"].(bool)
+		quiet           = args["-q"].(bool)
+		duration        time.Duration
+		err             error
+	)
+
+	if durationSpec != "" {
+		duration, err = time.ParseDuration(durationSpec)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid duration '%s'", durationSpec)
+		}
+	}
+
+	output := os.Stdout
+	if outputPath != "" && outputPath != "-" {
+		output, err = os.Create(outputPath)
+		if err != nil {
+			return ser.Errorf(err, "can't create '%s'", outputPath)
+		}
+
+		defer output.Close()
+	}
+
+	err = capturePackets(
+		rootDir, containerName, useBridge, filter, duration,
+		output, usePcapng, quiet,
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't capture packets of container '%s'", containerName,
+		)
+	}
+
+	return nil
+}
+
+func destroyRoot(
+	args map[string]interface{},
+	storageEngine storage,
+) error {
+	err := storageEngine.Destroy()
+	if err != nil {
+		return ser.Errorf(
+			err, "can't destroy storage",
+		)
+	}
+
+	err = removeStorageSpec(args["-r"].(string))
+	if err != nil {
+		return ser.Errorf(
+			err, "can't remove storage spec",
+		)
+	}
+
+	return nil
+}
+
+func generateContainerName() string {
+	tuples := []string{"ir", "oh", "at", "op", "un", "ed"}
+	triples := []string{"gep", "vin", "kut", "lop", "man", "zod"}
+	all := append(append([]string{}, tuples...), triples...)
+
 	getTuple := func() string {
 		return tuples[rand.Intn(len(tuples))]
 	}
@@ -471,7 +1641,8 @@ func generateContainerName() string {
 }
 
 func parseBridgeInfo(bridgeInfo string) (dev, address string) {
-	parts := strings.Split(bridgeInfo, ":")
+	// IPv6 address contains colons too
+	parts := strings.SplitN(bridgeInfo, ":", 2)
 	if len(parts) == 1 {
 		return parts[0], ""
 	} else {
@@ -479,32 +1650,89 @@ func parseBridgeInfo(bridgeInfo string) (dev, address string) {
 	}
 }
 
-func createStorageFromSpec(rootDir, storageSpec string) (storage, error) {
-	var storageEngine storage
-	var err error
+// createStorageFromSpec creates storage engine from specified spec. If spec
+// is not specified explicitly, spec stored in the root dir will be used.
+// Explicitly specified spec, which doesn't match stored one, is refused unless
+// force is specified, in which case it's used only for current run. Spec is
+// remembered only when empty root dir is initialized with explicitly
+// specified spec, including migration.
+func createStorageFromSpec(
+	rootDir string,
+	storageSpec string,
+	force bool,
+) (storage, error) {
+	spec, err := parseStorageSpec(storageSpec)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "invalid storage spec '%s'", storageSpec,
+		)
+	}
+
+	storedSpec, err := readStorageSpec(rootDir)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't read storage spec from '%s'", rootDir,
+		)
+	}
+
+	explicit := storageSpec != storageSpecAutodetect
+
+	// root dir, which was created by older hastur version, can use any
+	// storage, so spec is remembered only for new root dirs
+	remember := storedSpec == nil && explicit && isEmptyRootDir(rootDir)
 
 	switch {
-	case storageSpec == "autodetect":
-		storageSpec = "overlayfs"
-		fallthrough
+	case storedSpec == nil:
 
-	case strings.HasPrefix(storageSpec, "overlayfs"):
-		storageEngine, err = NewOverlayFSStorage(rootDir, storageSpec)
+	case !explicit:
+		spec = storedSpec
 
-	case strings.HasPrefix(storageSpec, "zfs"):
-		storageEngine, err = NewZFSStorage(rootDir, storageSpec)
+	case spec.conflicts(storedSpec) && !force:
+		return nil, fmt.Errorf(
+			"root dir '%s' is initialized with storage '%s', "+
+				"which doesn't match '%s', use --migrate to move "+
+				"containers to another storage or -f to override",
+			rootDir, storedSpec, spec,
+		)
+
+	case !spec.conflicts(storedSpec):
+		spec = spec.merge(storedSpec)
+	}
+
+	var storageEngine storage
+
+	switch spec.Engine {
+	case "overlayfs":
+		storageEngine, err = NewOverlayFSStorage(rootDir, spec)
+
+	case "zfs":
+		storageEngine, err = NewZFSStorage(rootDir, spec)
+
+	default:
+		storageEngine, err = NewExternalStorage(rootDir, spec)
 	}
 
 	if err != nil {
 		return nil, ser.Errorf(
-			err, "can't create storage '%s'", storageSpec,
+			err, "can't create storage '%s'", spec,
 		)
 	}
 
 	err = storageEngine.Init()
 	if err != nil {
 		return nil, ser.Errorf(
-			err, "can't init storage '%s'", storageSpec,
+			err, "can't init storage '%s'", spec,
+		)
+	}
+
+	if !remember {
+		return storageEngine, nil
+	}
+
+	err = writeStorageSpec(rootDir, spec)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't write storage spec to '%s'", rootDir,
 		)
 	}
 
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+// storageDirs are directories of the root dir, which are managed by
+// storage. Other files of the root dir, e.g. container states, networks and
+// uplinks, are kept during migration.
+var storageDirs = []string{"images", "containers"}
+
+// migrateStorage moves all images and containers from current storage to
+// the storage with specified spec. Images and changes of containers are
+// exported into archives outside of the root dir first, then current storage
+// is destroyed, images are restored into the new storage and containers are
+// restored on top of their images. Container snapshots can't
+// be exported, so migration of containers with snapshots is refused unless
+// force is specified.
+func migrateStorage(
+	rootDir string,
+	targetSpec string,
+	force bool,
+	storageEngine storage,
+) error {
+	_, err := parseStorageSpec(targetSpec)
+	if err != nil {
+		return ser.Errorf(
+			err, "invalid storage spec '%s'", targetSpec,
+		)
+	}
+
+	active, err := listActiveContainers(containerSuffix)
+	if err != nil {
+		return err
+	}
+
+	containers, err := listContainers(filepath.Join(rootDir, "containers"))
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		if _, ok := active[container]; ok {
+			return fmt.Errorf(
+				"container '%s' is running and should be stopped first",
+				container,
+			)
+		}
+
+		snapshots, err := storageEngine.ListContainerSnapshots(container)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't list snapshots of container '%s'", container,
+			)
+		}
+
+		if len(snapshots) == 0 {
+			continue
+		}
+
+		if !force {
+			return fmt.Errorf(
+				"container '%s' has snapshots, which can't be migrated, "+
+					"remove them or use -f to drop them",
+				container,
+			)
+		}
+
+		fmt.Fprintf(
+			os.Stderr,
+			"WARNING: snapshots of container '%s' will be dropped: %s\n",
+			container, strings.Join(snapshots, ", "),
+		)
+	}
+
+	images, err := listImages(rootDir)
+	if err != nil {
+		return err
+	}
+
+	absRootDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return formatAbsPathError(rootDir, err)
+	}
+
+	tempDir, err := ioutil.TempDir(
+		filepath.Dir(absRootDir), ".hastur-migrate.",
+	)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create temporary directory",
+		)
+	}
+
+	archives := []string{}
+
+	for _, image := range images {
+		if !isExists(getImageDir(rootDir, image), ".hastur") {
+			continue
+		}
+
+		fmt.Printf("Exporting image %s\n", image)
+
+		archive := filepath.Join(tempDir, "image."+image+".tar")
+
+		err := exportImage(rootDir, image, archive, false, storageEngine)
+		if err != nil {
+			os.RemoveAll(tempDir)
+
+			return ser.Errorf(
+				err, "can't export image %s", image,
+			)
+		}
+
+		archives = append(archives, archive)
+	}
+
+	for _, container := range containers {
+		fmt.Printf("Exporting container %s\n", container)
+
+		archive := filepath.Join(tempDir, "container."+container+".tar")
+
+		err := exportContainerLayer(
+			rootDir, container, archive, storageEngine,
+		)
+		if err != nil {
+			os.RemoveAll(tempDir)
+
+			return ser.Errorf(
+				err, "can't export container '%s'", container,
+			)
+		}
+
+		archives = append(archives, archive)
+	}
+
+	// storage can hold the whole root dir, e.g. tmpfs or ZFS dataset, so
+	// files, which are not managed by storage, are saved and restored after
+	// storage is recreated
+	preservedDir := filepath.Join(tempDir, "root")
+	err = preserveRootFiles(rootDir, preservedDir)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't save files of '%s', exported archives are kept in '%s'",
+			rootDir, tempDir,
+		)
+	}
+
+	err = storageEngine.Destroy()
+	if err != nil {
+		return ser.Errorf(
+			err, "can't destroy storage, exported archives are kept in '%s'",
+			tempDir,
+		)
+	}
+
+	for _, dir := range storageDirs {
+		err = os.RemoveAll(filepath.Join(rootDir, dir))
+		if err != nil {
+			return ser.Errorf(
+				err, "can't remove '%s', exported archives are kept in '%s'",
+				dir, tempDir,
+			)
+		}
+	}
+
+	err = removeStorageSpec(rootDir)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't remove storage spec, "+
+				"exported archives are kept in '%s'",
+			tempDir,
+		)
+	}
+
+	targetStorage, err := createStorageFromSpec(rootDir, targetSpec, true)
+	if err != nil {
+		return ser.Errorf(
+			err, "exported archives are kept in '%s'", tempDir,
+		)
+	}
+
+	err = copyTree(preservedDir, rootDir)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't restore files of '%s', they are kept in '%s'",
+			rootDir, preservedDir,
+		)
+	}
+
+	for _, archive := range archives {
+		manifest, name, err := restoreArchive(
+			rootDir, archive, "", true, targetStorage,
+		)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't restore archive '%s', "+
+					"exported archives are kept in '%s'",
+				archive, tempDir,
+			)
+		}
+
+		fmt.Printf("Restored %s %s\n", manifest.Kind, name)
+
+		for _, tag := range manifest.Tags {
+			err = setTag(rootDir, tag, name)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't tag image %s with '%s'", name, tag,
+				)
+			}
+		}
+	}
+
+	return os.RemoveAll(tempDir)
+}
+
+// preserveRootFiles copies files of the root dir, which are not managed by
+// storage, into specified dir.
+func preserveRootFiles(rootDir string, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == storageSpecFile {
+			continue
+		}
+
+		managed := false
+		for _, storageDir := range storageDirs {
+			if name == storageDir {
+				managed = true
+			}
+		}
+
+		if managed {
+			continue
+		}
+
+		command := exec.Command(
+			"cp", "-a", filepath.Join(rootDir, name), dir,
+		)
+		_, _, err = executil.Run(command)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
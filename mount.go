@@ -44,10 +44,15 @@ func mountTmpfs(target string, size string) error {
 	return nil
 }
 
-func mountOverlay(lower, upper, work, target string) error {
-	lowerAbsPath, err := filepath.Abs(lower)
-	if err != nil {
-		return formatAbsPathError(lower, err)
+func mountOverlay(lowers []string, upper, work, target string) error {
+	lowerAbsPaths := []string{}
+	for _, lower := range lowers {
+		lowerAbsPath, err := filepath.Abs(lower)
+		if err != nil {
+			return formatAbsPathError(lower, err)
+		}
+
+		lowerAbsPaths = append(lowerAbsPaths, lowerAbsPath)
 	}
 
 	upperAbsPath, err := filepath.Abs(upper)
@@ -63,7 +68,7 @@ func mountOverlay(lower, upper, work, target string) error {
 	command := exec.Command(
 		"mount", "-t", "overlay", "-o",
 		strings.Join([]string{
-			"lowerdir=" + lowerAbsPath,
+			"lowerdir=" + strings.Join(lowerAbsPaths, ":"),
 			"upperdir=" + upperAbsPath,
 			"workdir=" + workAbsPath,
 		}, ","),
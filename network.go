@@ -5,12 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"strings"
-	"time"
 
 	"github.com/reconquest/executil-go"
 	"github.com/reconquest/ser-go"
@@ -42,7 +41,68 @@ func ensureBridgeInterfaceUp(bridge string) error {
 }
 
 func ensureIPv4Forwarding() error {
-	fileIpForward := "/proc/sys/net/ipv4/ip_forward"
+	return ensureForwarding("/proc/sys/net/ipv4/ip_forward")
+}
+
+func ensureIPv6Forwarding() error {
+	return ensureForwarding("/proc/sys/net/ipv6/conf/all/forwarding")
+}
+
+// ensureBridgeNetfilter makes traffic between interfaces of specified bridge
+// pass through iptables. Netfilter is enabled only for the bridge: kernel
+// enables it for all bridges when br_netfilter is loaded, so global settings
+// are reverted if module was not loaded before. Traffic forwarded between
+// interfaces of the bridge is accepted explicitly, so it's not dropped by
+// FORWARD policy, e.g. one set by docker. Settings are kept until bridge is
+// removed.
+func ensureBridgeNetfilter(bridge string) error {
+	if !isExists("/sys/module/br_netfilter") {
+		command := exec.Command("modprobe", "br_netfilter")
+		_, _, err := executil.Run(command)
+		if err != nil {
+			return err
+		}
+
+		for _, family := range []string{"iptables", "ip6tables"} {
+			path := "/proc/sys/net/bridge/bridge-nf-call-" + family
+
+			err = ioutil.WriteFile(path, []byte("0\n"), 0644)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't write '0' to file %s", path,
+				)
+			}
+		}
+	}
+
+	command := exec.Command(
+		"ip", "link", "set", "dev", bridge, "type", "bridge",
+		"nf_call_iptables", "1", "nf_call_ip6tables", "1",
+	)
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	rule := []string{"FORWARD", "-i", bridge, "-o", bridge, "-j", "ACCEPT"}
+	for _, family := range []string{"0.0.0.0/0", "::/0"} {
+		err := runIPTables(family, append([]string{"-C"}, rule...)...)
+		if err == nil {
+			continue
+		}
+
+		// rule is appended, so it's checked after rules of container
+		// policies
+		err = runIPTables(family, append([]string{"-A"}, rule...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ensureForwarding(fileIpForward string) error {
 	valueIpForward, err := ioutil.ReadFile(fileIpForward)
 	if err != nil {
 		return ser.Errorf(
@@ -139,17 +199,19 @@ func copyInterfaceAddressToBridge(iface string, bridge string) error {
 				err, "can't parse net address '%s'", addr.String(),
 			)
 		}
-		if ip.To4() == nil {
+
+		args := []string{"addr", "add", "dev", bridge, addr.String()}
+
+		if ip.To4() != nil {
+			broadcast := broadcast(ip, ip.DefaultMask())
+
+			args = append(args, "broadcast", broadcast.String())
+		} else if !ip.IsGlobalUnicast() {
+			// link-local addresses are generated by kernel for bridge itself
 			continue
 		}
 
-		broadcast := broadcast(ip, ip.DefaultMask())
-
-		command := exec.Command(
-			"ip", "addr", "add",
-			"dev", bridge, addr.String(),
-			"broadcast", broadcast.String(),
-		)
+		command := exec.Command("ip", args...)
 		_, stderr, err := executil.Run(command)
 		if err != nil {
 			if bytes.HasPrefix(
@@ -181,17 +243,37 @@ func addInterfaceToBridge(iface, bridge string) error {
 	return nil
 }
 
-func getContainerIP(containerName string) (string, error) {
-	command := exec.Command("ip", "-n", containerName, "addr", "show", "host0")
+func removeInterfaceFromBridge(iface, bridge string) error {
+	command := exec.Command("brctl", "delif", bridge, iface)
+	_, stderr, err := executil.Run(command)
+	if err != nil {
+		if bytes.Contains(stderr, []byte("is not a slave")) {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// getContainerIP returns IPv4 and global IPv6 addresses of the container
+// interface, separated by comma.
+func getContainerIP(containerName string, iface string) (string, error) {
+	command := exec.Command("ip", "-n", containerName, "addr", "show", iface)
 	output, _, err := executil.Run(command)
 	if err != nil {
 		return "", err
 	}
 
+	addresses := []string{}
+
 	rawIPOutput := strings.Split(string(output), "\n")
 	for _, line := range rawIPOutput {
 		trimmedLine := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmedLine, "inet ") {
+		if strings.HasPrefix(trimmedLine, "inet ") ||
+			strings.HasPrefix(trimmedLine, "inet6 ") &&
+				strings.Contains(trimmedLine, "scope global") {
 			inet := strings.Fields(trimmedLine)
 			if len(inet) < 2 {
 				return "", fmt.Errorf(
@@ -199,39 +281,294 @@ func getContainerIP(containerName string) (string, error) {
 				)
 			}
 
-			return inet[1], nil
+			addresses = append(addresses, inet[1])
 		}
 	}
 
-	return "", nil
+	return strings.Join(addresses, addressSeparator), nil
 }
 
-func setupNetwork(namespace string, address string, gateway string) error {
-	err := ensureAddress(namespace, address, "host0")
-	if err != nil {
-		return err
+const (
+	networkModeBridge  = `bridge`
+	networkModeVeth    = `veth`
+	networkModeMacvlan = `macvlan`
+	networkModeIPvlan  = `ipvlan`
+	networkModeHost    = `host`
+	networkModeNone    = `none`
+)
+
+// parseNetworkMode parses network mode in format MODE[:IFACE], where IFACE is
+// host interface, which is required for macvlan and ipvlan modes.
+func parseNetworkMode(spec string) (mode string, link string, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	mode = parts[0]
+	if len(parts) > 1 {
+		link = parts[1]
 	}
 
-	err = upInterface(namespace, "host0")
-	if err != nil {
-		return err
+	switch mode {
+	case networkModeMacvlan, networkModeIPvlan:
+		if link == "" {
+			return "", "", fmt.Errorf(
+				"host interface should be specified for %s mode, "+
+					"e.g. %s:eth0",
+				mode, mode,
+			)
+		}
+
+	case networkModeBridge, networkModeVeth, networkModeHost, networkModeNone:
+		if link != "" {
+			return "", "", fmt.Errorf(
+				"host interface can't be specified for %s mode", mode,
+			)
+		}
+
+	default:
+		return "", "", fmt.Errorf(
+			"unknown network mode '%s', should be one of: "+
+				"bridge, veth, macvlan:IFACE, ipvlan:IFACE, host, none",
+			mode,
+		)
+	}
+
+	return mode, link, nil
+}
+
+// getNetworkModeInterface returns name of the container interface, which is
+// created by systemd-nspawn in specified network mode.
+func getNetworkModeInterface(mode string, link string) string {
+	switch mode {
+	case networkModeMacvlan:
+		return shortenInterfaceName("mv-" + link)
+	case networkModeIPvlan:
+		return shortenInterfaceName("iv-" + link)
+	case networkModeHost, networkModeNone:
+		return "lo"
+	default:
+		return getInterfaceName(0)
+	}
+}
+
+// getVethHostName returns name of the host side of veth pair, which is
+// created by systemd-nspawn for the container.
+func getVethHostName(prefix string, containerName string) string {
+	name := prefix + containerName
+	if len(name) > 14 {
+		name = name[:14] // seems like it get cutted by 14 chars
+	}
+
+	return name
+}
+
+func shortenInterfaceName(name string) string {
+	if len(name) > 15 {
+		return name[:15]
+	}
+
+	return name
+}
+
+// containerInterface describes network interface of the container.
+type containerInterface struct {
+	// Mode is one of network modes, bridge is used if it's empty.
+	Mode string
+
+	// Link is host interface for macvlan and ipvlan modes.
+	Link string
+
+	// Name is name of the interface inside container, e.g. host0.
+	Name string
+
+	// HostName is name of the host side of veth pair for additional
+	// interfaces, which are not created by --network-bridge, and for veth
+	// mode.
+	HostName string
+
+	Bridge string
+
+	// Address and Gateway can contain IPv4 and IPv6 addresses separated by
+	// comma. Gateway is address of the bridge.
+	Address string
+	Gateway string
+
+	// DefaultRoute enables default routes via gateway, it's set only for
+	// the first interface of the container.
+	DefaultRoute bool
+
+	// Masquerade enables masquerading of traffic, which leaves host through
+	// the bridge, e.g. when host interface is added to the bridge.
+	Masquerade bool
+
+	// NAT and NAT66 enable masquerading of IPv4 and IPv6 traffic from
+	// container network, which leaves host not through the bridge.
+	NAT   bool
+	NAT66 bool
+}
+
+// getInterfaceName returns name of the n-th container interface.
+func getInterfaceName(index int) string {
+	return fmt.Sprintf("host%d", index)
+}
+
+// getExtraInterfaceHostName returns name of the host side of veth pair for
+// n-th additional interface of the container.
+func getExtraInterfaceHostName(containerName string, index int) string {
+	return shortenInterfaceName(fmt.Sprintf("vx%d-%s", index, containerName))
+}
+
+// getNetworkArgs returns systemd-nspawn arguments, which create interface.
+func getNetworkArgs(iface containerInterface) []string {
+	switch iface.Mode {
+	case networkModeVeth:
+		return []string{"-n"}
+	case networkModeMacvlan:
+		return []string{"--network-macvlan=" + iface.Link}
+	case networkModeIPvlan:
+		return []string{"--network-ipvlan=" + iface.Link}
+	case networkModeHost:
+		return []string{}
+	case networkModeNone:
+		return []string{"--private-network"}
+	}
+
+	if iface.HostName == "" {
+		return []string{"-n", "--network-bridge", iface.Bridge}
+	}
+
+	return []string{"--network-veth-extra=" + iface.HostName + ":" + iface.Name}
+}
+
+// setupNetwork assigns addresses to the interface in the container and adds
+// default routes via gateways of the same address family. Host side of
+// interface is configured as well if it is not enslaved to bridge.
+func setupNetwork(namespace string, iface containerInterface) error {
+	switch iface.Mode {
+	case networkModeHost:
+		// container shares network namespace with host
+		return nil
+
+	case networkModeNone:
+		return upInterface(namespace, "lo")
+
+	case networkModeVeth:
+		err := setupVethHost(iface)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't setup host interface '%s'", iface.HostName,
+			)
+		}
+	}
+
+	families := map[bool]bool{}
+
+	for _, address := range splitAddresses(iface.Address) {
+		var flags []string
+
+		// duplicate address detection will make address unusable for a
+		// while, but addresses in container network are assigned by hastur
+		if isIPv6Address(address) {
+			flags = []string{"nodad"}
+		}
+
+		err := ensureAddress(namespace, address, iface.Name, flags...)
+		if err != nil {
+			return err
+		}
+
+		families[isIPv6Address(address)] = true
 	}
 
-	gatewayIP, _, err := net.ParseCIDR(gateway)
+	err := upInterface(namespace, iface.Name)
 	if err != nil {
 		return err
 	}
 
-	err = addDefaultRoute(namespace, "host0", gatewayIP.String())
+	if !iface.DefaultRoute {
+		return nil
+	}
+
+	for _, gateway := range splitAddresses(iface.Gateway) {
+		if !families[isIPv6Address(gateway)] {
+			continue
+		}
+
+		gatewayIP, _, err := net.ParseCIDR(gateway)
+		if err != nil {
+			return err
+		}
+
+		err = addDefaultRoute(namespace, iface.Name, gatewayIP.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupVethHost assigns gateway addresses to the host side of veth pair and
+// adds routes to container addresses through it, so containers in veth mode
+// can share gateway address without bridge.
+func setupVethHost(iface containerInterface) error {
+	err := ensureBridgeInterfaceUp(iface.HostName)
 	if err != nil {
 		return err
 	}
 
+	for _, gateway := range splitAddresses(iface.Gateway) {
+		gatewayIP, _, err := net.ParseCIDR(gateway)
+		if err != nil {
+			return err
+		}
+
+		err = ensureAddress("", getHostAddress(gatewayIP), iface.HostName)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, address := range splitAddresses(iface.Address) {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return err
+		}
+
+		err = execIpRoute("add", iface.HostName, getHostAddress(ip))
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// parseGatewayAddress returns gateway address in CIDR notation, which is
+// used for bridge addresses. Gateway can be specified without prefix.
+func parseGatewayAddress(gateway string) (string, error) {
+	if gateway == "" || strings.Contains(gateway, "/") {
+		return gateway, validateAddresses(gateway)
+	}
+
+	ip := net.ParseIP(gateway)
+	if ip == nil {
+		return "", fmt.Errorf("invalid gateway address '%s'", gateway)
+	}
+
+	return getHostAddress(ip), nil
+}
+
+// getHostAddress returns address with single-host prefix.
+func getHostAddress(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+
+	return ip.String() + "/128"
+}
+
 func addDefaultRoute(namespace string, dev string, gateway string) error {
-	args := []string{"route", "add", "default", "via", gateway}
+	args := []string{"route", "add", "default", "via", gateway, "dev", dev}
 	if namespace != "" {
 		args = append([]string{"-n", namespace}, args...)
 	}
@@ -250,8 +587,13 @@ func addDefaultRoute(namespace string, dev string, gateway string) error {
 	return nil
 }
 
-func ensureAddress(namespace string, address string, dev string) error {
-	args := []string{"addr", "add", address, "dev", dev}
+func ensureAddress(
+	namespace string,
+	address string,
+	dev string,
+	flags ...string,
+) error {
+	args := append([]string{"addr", "add", address, "dev", dev}, flags...)
 	if namespace != "" {
 		args = append([]string{"-n", namespace}, args...)
 	}
@@ -270,12 +612,17 @@ func ensureAddress(namespace string, address string, dev string) error {
 	return nil
 }
 
-func cleanupNetworkInterface(name string) error {
-	interfaceName := "vb-" + name
-	if len(interfaceName) > 14 {
-		interfaceName = interfaceName[:14] // seems like it get cutted by 14 chars
+func deleteAddress(dev string, address string) error {
+	command := exec.Command("ip", "addr", "del", address, "dev", dev)
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
 	}
 
+	return nil
+}
+
+func deleteInterface(interfaceName string) error {
 	args := []string{"link", "delete", interfaceName}
 
 	command := exec.Command("ip", args...)
@@ -293,7 +640,14 @@ func cleanupNetworkInterface(name string) error {
 }
 
 func setupBridge(dev string, address string) error {
-	return ensureAddress("", address, dev)
+	for _, address := range splitAddresses(address) {
+		err := ensureAddress("", address, dev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func upInterface(namespace string, dev string) error {
@@ -309,33 +663,129 @@ func upInterface(namespace string, dev string) error {
 	return nil
 }
 
-func generateRandomNetwork(address *net.IPNet) string {
-	tick := float64(time.Now().UnixNano() / 1000000)
+const (
+	defaultContainerNetwork = "10.0.0.0/8"
 
-	ones, bits := address.Mask.Size()
-	zeros := bits - ones
-	uniqIPsAmount := math.Pow(2.0, float64(zeros))
+	addressSeparator = ","
+)
 
-	rawIP := math.Mod(tick, uniqIPsAmount)
+// allocateIPv6Address returns random address from the network of specified
+// IPv6 bridge address.
+func allocateIPv6Address(bridgeAddress string) (string, error) {
+	bridgeIP, network, err := net.ParseCIDR(bridgeAddress)
+	if err != nil {
+		return "", err
+	}
 
-	remainder := rawIP
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return "", fmt.Errorf(
+			"network %s is too small for containers", network,
+		)
+	}
 
-	remainder, octet4 := math.Modf(remainder / 255.0)
-	remainder, octet3 := math.Modf(remainder / 255.0)
-	remainder, octet2 := math.Modf(remainder / 255.0)
+	ip := make(net.IP, net.IPv6len)
+	for {
+		rand.Read(ip)
 
-	base := address.IP
+		for i := range ip {
+			ip[i] = network.IP[i] | ip[i]&^network.Mask[i]
+		}
 
-	address.IP = net.IPv4(
-		byte(remainder)|base[0],
-		byte(octet2*255)|base[1],
-		byte(octet3*255)|base[2],
-		byte(octet4*255)|base[3],
-	)
+		// skip network address and address of the bridge itself
+		if !ip.Equal(network.IP) && !ip.Equal(bridgeIP) {
+			break
+		}
+	}
+
+	return (&net.IPNet{IP: ip, Mask: network.Mask}).String(), nil
+}
+
+// ensureIPv6Address adds IPv6 address to the container address list if
+// bridge has IPv6 address and container has no one yet.
+func ensureIPv6Address(address string, bridgeAddress string) (string, error) {
+	bridgeIPv6 := getIPv6Address(bridgeAddress)
+	if bridgeIPv6 == "" || getIPv6Address(address) != "" {
+		return address, nil
+	}
+
+	containerIPv6, err := allocateIPv6Address(bridgeIPv6)
+	if err != nil {
+		return "", err
+	}
+
+	return joinAddresses(splitAddresses(address), containerIPv6), nil
+}
+
+func splitAddresses(addresses string) []string {
+	result := []string{}
+	for _, address := range strings.Split(addresses, addressSeparator) {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			result = append(result, address)
+		}
+	}
+
+	return result
+}
+
+func joinAddresses(addresses []string, address ...string) string {
+	return strings.Join(append(addresses, address...), addressSeparator)
+}
+
+func isIPv6Address(address string) bool {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		ip = net.ParseIP(address)
+	}
+
+	return ip != nil && ip.To4() == nil
+}
+
+// getIPv4Address returns first IPv4 address from the list of addresses.
+func getIPv4Address(addresses string) string {
+	for _, address := range splitAddresses(addresses) {
+		if !isIPv6Address(address) {
+			return address
+		}
+	}
+
+	return ""
+}
+
+// getIPv6Address returns first IPv6 address from the list of addresses.
+func getIPv6Address(addresses string) string {
+	for _, address := range splitAddresses(addresses) {
+		if isIPv6Address(address) {
+			return address
+		}
+	}
+
+	return ""
+}
+
+// validateAddresses checks, that every address is in CIDR notation and there
+// is at most one address of each family.
+func validateAddresses(addresses string) error {
+	families := map[bool]bool{}
+	for _, address := range splitAddresses(addresses) {
+		_, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return ser.Errorf(
+				err, "invalid address '%s', should be address/prefix", address,
+			)
+		}
 
-	address.IP.Mask(address.Mask)
+		if families[isIPv6Address(address)] {
+			return fmt.Errorf(
+				"only one IPv4 and one IPv6 address can be specified",
+			)
+		}
 
-	return address.String()
+		families[isIPv6Address(address)] = true
+	}
+
+	return nil
 }
 
 func getHostIPs(interfaceName string) ([]net.Addr, error) {
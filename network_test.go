@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestParseNetworkMode(t *testing.T) {
+	testcases := []struct {
+		spec  string
+		valid bool
+		mode  string
+		link  string
+		iface string
+	}{
+		{"bridge", true, networkModeBridge, "", "host0"},
+		{"veth", true, networkModeVeth, "", "host0"},
+		{"host", true, networkModeHost, "", "lo"},
+		{"none", true, networkModeNone, "", "lo"},
+		{"macvlan:eth0", true, networkModeMacvlan, "eth0", "mv-eth0"},
+		{"ipvlan:enp0s31f6", true, networkModeIPvlan, "enp0s31f6", "iv-enp0s31f6"},
+		{
+			"macvlan:enx0123456789ab", true,
+			networkModeMacvlan, "enx0123456789ab", "mv-enx012345678",
+		},
+		{"macvlan", false, "", "", ""},
+		{"ipvlan:", false, "", "", ""},
+		{"bridge:br0", false, "", "", ""},
+		{"host:eth0", false, "", "", ""},
+		{"vlan:eth0", false, "", "", ""},
+		{"", false, "", "", ""},
+	}
+
+	for _, testcase := range testcases {
+		mode, link, err := parseNetworkMode(testcase.spec)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%q: expected error, got none", testcase.spec)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", testcase.spec, err)
+			continue
+		}
+
+		if mode != testcase.mode || link != testcase.link {
+			t.Errorf(
+				"%q: expected %s %s, got %s %s",
+				testcase.spec, testcase.mode, testcase.link, mode, link,
+			)
+		}
+
+		iface := getNetworkModeInterface(mode, link)
+		if iface != testcase.iface {
+			t.Errorf(
+				"%q: expected interface %s, got %s",
+				testcase.spec, testcase.iface, iface,
+			)
+		}
+	}
+}
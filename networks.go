@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/reconquest/ser-go"
+)
+
+const isolatedNetworkName = `isolated`
+
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// namedNetwork is network, which containers can be attached to.
+type namedNetwork struct {
+	Bridge string `json:"bridge"`
+
+	// Address is address of the bridge, which also defines subnet of the
+	// network. IPv4 and IPv6 addresses can be specified separated by comma.
+	Address string `json:"address"`
+
+	// NAT enables masquerading of traffic, which leaves host.
+	NAT bool `json:"nat,omitempty"`
+
+	// Isolated networks can't reach anything except each other and host.
+	Isolated bool `json:"isolated,omitempty"`
+}
+
+// containerNetwork is named network, which container is attached to.
+type containerNetwork struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+func addNetwork(
+	rootDir string,
+	name string,
+	bridgeInfo string,
+	nat bool,
+	isolated bool,
+) error {
+	if !networkNameRegexp.MatchString(name) {
+		return fmt.Errorf(
+			"invalid network name '%s', should match %s",
+			name, networkNameRegexp,
+		)
+	}
+
+	bridge, address := parseBridgeInfo(bridgeInfo)
+
+	network := &namedNetwork{
+		Bridge:   bridge,
+		Address:  address,
+		NAT:      nat,
+		Isolated: isolated,
+	}
+
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := config.Networks[name]; ok {
+		return fmt.Errorf("network '%s' already exists", name)
+	}
+
+	err = validateNetwork(config, network)
+	if err != nil {
+		return err
+	}
+
+	if config.Networks == nil {
+		config.Networks = map[string]*namedNetwork{}
+	}
+
+	config.Networks[name] = network
+
+	return writeNetworkConfig(rootDir, config)
+}
+
+// validateNetwork checks, that network has IPv4 address and doesn't use
+// bridge or subnet of another network.
+func validateNetwork(config *networkConfig, network *namedNetwork) error {
+	if network.Bridge == "" || len(network.Bridge) > 15 {
+		return fmt.Errorf(
+			"invalid bridge name '%s', should be 1-15 characters",
+			network.Bridge,
+		)
+	}
+
+	err := validateAddresses(network.Address)
+	if err != nil {
+		return err
+	}
+
+	if getIPv4Address(network.Address) == "" {
+		return fmt.Errorf(
+			"bridge '%s' should have IPv4 address", network.Bridge,
+		)
+	}
+
+	for name, other := range config.Networks {
+		if other.Bridge == network.Bridge {
+			return fmt.Errorf(
+				"bridge '%s' is already used by network '%s'",
+				network.Bridge, name,
+			)
+		}
+
+		for _, address := range splitAddresses(network.Address) {
+			for _, otherAddress := range splitAddresses(other.Address) {
+				if isNetworksOverlap(address, otherAddress) {
+					return fmt.Errorf(
+						"subnet of %s overlaps with network '%s' (%s)",
+						address, name, otherAddress,
+					)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func isNetworksOverlap(address string, otherAddress string) bool {
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return false
+	}
+
+	_, otherNetwork, err := net.ParseCIDR(otherAddress)
+	if err != nil {
+		return false
+	}
+
+	return network.Contains(otherNetwork.IP) || otherNetwork.Contains(network.IP)
+}
+
+func removeNetwork(rootDir string, name string, force bool) error {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return err
+	}
+
+	network, ok := config.Networks[name]
+	if !ok {
+		return fmt.Errorf("network '%s' does not exist", name)
+	}
+
+	containers, err := listContainers(filepath.Join(rootDir, "containers"))
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		state, err := readContainerState(rootDir, container)
+		if err != nil || state == nil {
+			continue
+		}
+
+		for _, containerNetwork := range state.Networks {
+			if containerNetwork.Name == name && !force {
+				return fmt.Errorf(
+					"network '%s' is used by container '%s'",
+					name, container,
+				)
+			}
+		}
+	}
+
+	if network.Isolated {
+		_ = removeIsolationRules(network.Bridge)
+	}
+
+	delete(config.Networks, name)
+
+	if config.DefaultNetwork == name {
+		config.DefaultNetwork = ""
+	}
+
+	return writeNetworkConfig(rootDir, config)
+}
+
+// isolateRoot creates isolated network with unique bridge and subnet for the
+// root dir and makes it default for containers in the root dir.
+func isolateRoot(rootDir string) (*namedNetwork, error) {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if network, ok := config.Networks[isolatedNetworkName]; ok {
+		config.DefaultNetwork = isolatedNetworkName
+
+		return network, writeNetworkConfig(rootDir, config)
+	}
+
+	absRootDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, formatAbsPathError(rootDir, err)
+	}
+
+	hash := sha256.Sum256([]byte(absRootDir))
+
+	routes, err := getHostRoutes("")
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't get host routes",
+		)
+	}
+
+	// subnets are chosen from 172.16.0.0/12 split into /24 networks
+	const subnets = 1 << 12
+
+	offset := uint32(binary.BigEndian.Uint16(hash[:2]))
+	for attempt := uint32(0); attempt < subnets; attempt++ {
+		index := (offset + attempt) % subnets
+
+		ip := net.IPv4(172, byte(16+index>>8), byte(index), 1)
+		address := (&net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}).String()
+
+		if isRoutedByHost(ip, routes) {
+			continue
+		}
+
+		network := &namedNetwork{
+			Bridge:   fmt.Sprintf("hi-%x", hash[:6]),
+			Address:  address,
+			Isolated: true,
+		}
+
+		if validateNetwork(config, network) != nil {
+			continue
+		}
+
+		if config.Networks == nil {
+			config.Networks = map[string]*namedNetwork{}
+		}
+
+		config.Networks[isolatedNetworkName] = network
+		config.DefaultNetwork = isolatedNetworkName
+
+		return network, writeNetworkConfig(rootDir, config)
+	}
+
+	return nil, fmt.Errorf("can't find free subnet for isolated network")
+}
+
+// prepareNetwork creates bridge of the network and assigns addresses to it.
+func prepareNetwork(network *namedNetwork) error {
+	err := ensureIPv4Forwarding()
+	if err != nil {
+		return ser.Errorf(
+			err,
+			"can't enable ipv4 forwarding",
+		)
+	}
+
+	if getIPv6Address(network.Address) != "" {
+		err = ensureIPv6Forwarding()
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't enable ipv6 forwarding",
+			)
+		}
+	}
+
+	err = ensureBridge(network.Bridge)
+	if err != nil {
+		return ser.Errorf(
+			err,
+			"can't create bridge interface '%s'", network.Bridge,
+		)
+	}
+
+	err = ensureBridgeInterfaceUp(network.Bridge)
+	if err != nil {
+		return ser.Errorf(
+			err,
+			"can't set bridge '%s' up",
+			network.Bridge,
+		)
+	}
+
+	err = setupBridge(network.Bridge, network.Address)
+	if err != nil {
+		return ser.Errorf(
+			err,
+			"can't assign address '%s' on bridge '%s'",
+			network.Address,
+			network.Bridge,
+		)
+	}
+
+	if network.Isolated {
+		err = addIsolationRules(network.Bridge)
+		if err != nil {
+			return ser.Errorf(
+				err,
+				"can't add isolation rules for bridge '%s'",
+				network.Bridge,
+			)
+		}
+	}
+
+	return nil
+}
+
+// getContainerNetworks returns interfaces of the container for specified
+// named networks. Address specified for the container is used on the first
+// network; addresses on other networks are taken from state or allocated.
+func getContainerNetworks(
+	rootDir string,
+	containerName string,
+	names []string,
+	address string,
+	state *containerState,
+) ([]containerInterface, []containerNetwork, error) {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return nil, nil, ser.Errorf(
+			err, "can't read network config of '%s'", rootDir,
+		)
+	}
+
+	interfaces := []containerInterface{}
+	networks := []containerNetwork{}
+
+	for index, name := range names {
+		network, ok := config.Networks[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("network '%s' does not exist", name)
+		}
+
+		err := prepareNetwork(network)
+		if err != nil {
+			return nil, nil, ser.Errorf(
+				err, "can't prepare network '%s'", name,
+			)
+		}
+
+		networkAddress := ""
+		if index == 0 {
+			networkAddress = address
+		}
+
+		if networkAddress == "" && state != nil {
+			for _, containerNetwork := range state.Networks {
+				if containerNetwork.Name == name {
+					networkAddress = containerNetwork.Address
+				}
+			}
+		}
+
+		if networkAddress == "" {
+			networkAddress, err = allocateNetworkAddress(
+				rootDir, containerName, network, config.HashAddresses,
+			)
+			if err != nil {
+				return nil, nil, ser.Errorf(
+					err, "can't allocate address in network '%s'", name,
+				)
+			}
+		}
+
+		networkAddress, err = ensureIPv6Address(
+			networkAddress, network.Address,
+		)
+		if err != nil {
+			return nil, nil, ser.Errorf(
+				err, "can't allocate IPv6 address in network '%s'", name,
+			)
+		}
+
+		iface := containerInterface{
+			Name:         getInterfaceName(index),
+			Bridge:       network.Bridge,
+			Address:      networkAddress,
+			Gateway:      network.Address,
+			DefaultRoute: index == 0,
+			NAT:          network.NAT,
+			NAT66:        network.NAT,
+		}
+
+		if index > 0 {
+			iface.HostName = getExtraInterfaceHostName(containerName, index)
+		}
+
+		interfaces = append(interfaces, iface)
+		networks = append(networks, containerNetwork{
+			Name:    name,
+			Address: networkAddress,
+		})
+	}
+
+	return interfaces, networks, nil
+}
+
+// allocateNetworkAddress returns new IPv4 address for container from subnet
+// of the network.
+func allocateNetworkAddress(
+	rootDir string,
+	containerName string,
+	network *namedNetwork,
+	hashed bool,
+) (string, error) {
+	_, subnet, err := net.ParseCIDR(getIPv4Address(network.Address))
+	if err != nil {
+		return "", ser.Errorf(
+			err, "invalid address of bridge '%s'", network.Bridge,
+		)
+	}
+
+	return allocateAddress(
+		rootDir, containerName, subnet, network.Address, hashed,
+	)
+}
+
+// getDefaultNetworks returns names of networks, which container should be
+// attached to, if networks are not specified explicitly: networks of
+// existing container or default network of the root dir.
+func getDefaultNetworks(
+	rootDir string,
+	state *containerState,
+) ([]string, error) {
+	names := []string{}
+
+	if state != nil && len(state.Networks) > 0 {
+		for _, network := range state.Networks {
+			names = append(names, network.Name)
+		}
+
+		return names, nil
+	}
+
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DefaultNetwork != "" {
+		names = append(names, config.DefaultNetwork)
+	}
+
+	return names, nil
+}
+
+func listNetworks(rootDir string, useJSON bool) error {
+	config, err := readNetworkConfig(rootDir)
+	if err != nil {
+		return err
+	}
+
+	if useJSON {
+		output, err := json.MarshalIndent(config.Networks, "", "    ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(output))
+
+		return nil
+	}
+
+	names := []string{}
+	for name := range config.Networks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, name := range names {
+		network := config.Networks[name]
+
+		flags := []string{}
+		if name == config.DefaultNetwork {
+			flags = append(flags, "default")
+		}
+
+		if network.NAT {
+			flags = append(flags, "nat")
+		}
+
+		if network.Isolated {
+			flags = append(flags, "isolated")
+		}
+
+		fmt.Fprintf(
+			writer,
+			"%s\t%s\t%s\t%s\n",
+			name, network.Bridge, network.Address,
+			joinAddresses(flags),
+		)
+	}
+
+	return writer.Flush()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,9 +15,11 @@ import (
 
 func nspawn(
 	storageEngine storage,
+	rootDir string,
 	containerName string,
-	bridge string,
-	networkAddress string, bridgeAddress string,
+	interfaces []containerInterface,
+	ports []publishedPort,
+	policy *networkPolicy,
 	ephemeral bool, keepFailed bool, quiet bool,
 	commandLine []string,
 ) (err error) {
@@ -56,20 +59,21 @@ func nspawn(
 		}()
 	}
 
+	containerRoot, err := storageEngine.GetContainerRoot(containerName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get root of container '%s'", containerName,
+		)
+	}
+
 	bootstrapper := "/.hastur.exec"
-	err = installBootstrapExecutable(
-		storageEngine.GetContainerRoot(containerName),
-		bootstrapper,
-	)
+	err = installBootstrapExecutable(containerRoot, bootstrapper)
 	if err != nil {
 		return err
 	}
 
 	controlPipeName := bootstrapper + ".control"
-	controlPipePath := filepath.Join(
-		storageEngine.GetContainerRoot(containerName),
-		controlPipeName,
-	)
+	controlPipePath := filepath.Join(containerRoot, controlPipeName)
 
 	err = syscall.Mknod(controlPipePath, syscall.S_IFIFO|0644, 0)
 	if err != nil {
@@ -83,24 +87,19 @@ func nspawn(
 
 	// we ignore error there because interface may not exist
 	_ = umountNetorkNamespace(containerName)
-	_ = cleanupNetworkInterface(containerName)
-
-	defer cleanupNetworkInterface(containerName)
+	_ = cleanupNetworkInterface(rootDir, containerName)
+	_ = removeContainerFirewall(containerName)
 
-	err = addPostroutingMasquarading(bridge)
+	err = ensureVethNamesFree(containerName, interfaces)
 	if err != nil {
-		return ser.Errorf(
-			err,
-			"can't add masquarading rules on the '%s'",
-			bridge,
-		)
+		return err
 	}
 
-	defer removePostroutingMasquarading(bridge)
+	defer cleanupNetworkInterface(rootDir, containerName)
 
 	command := exec.Command(
 		"systemd-machine-id-setup",
-		"--root", storageEngine.GetContainerRoot(containerName),
+		"--root", containerRoot,
 	)
 	_, _, err = executil.Run(command)
 	if err != nil {
@@ -110,10 +109,12 @@ func nspawn(
 	args := []string{
 		"--pipe",
 		"-M", containerName + containerSuffix,
-		"-D", storageEngine.GetContainerRoot(containerName),
+		"-D", containerRoot,
 	}
 
-	args = append(args, "-n", "--network-bridge", bridge)
+	for _, iface := range interfaces {
+		args = append(args, getNetworkArgs(iface)...)
+	}
 
 	if quiet {
 		args = append(args, "-q")
@@ -156,11 +157,61 @@ func nspawn(
 
 	defer umountNetorkNamespace(containerName)
 
-	err = setupNetwork(containerName, networkAddress, bridgeAddress)
+	err = discoverVethPeers(rootDir, containerName, interfaces)
 	if err != nil {
 		return err
 	}
 
+	for _, iface := range interfaces {
+		cleanup, err := addInterfaceMasquarading(iface)
+
+		defer cleanup()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	defer removeContainerFirewall(containerName)
+
+	if len(ports) > 0 {
+		err = addPublishedPorts(containerName, interfaces[0].Address, ports)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addNetworkPolicy(containerName, policy, interfaces)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't add network policy for '%s'", containerName,
+		)
+	}
+
+	for _, iface := range interfaces {
+		if iface.HostName != "" && iface.Bridge != "" {
+			err = addInterfaceToBridge(iface.HostName, iface.Bridge)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't add '%s' to bridge '%s'",
+					iface.HostName, iface.Bridge,
+				)
+			}
+
+			err = ensureBridgeInterfaceUp(iface.HostName)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = setupNetwork(containerName, iface)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't setup network interface %s", iface.Name,
+			)
+		}
+	}
+
 	err = ioutil.WriteFile(controlPipePath, []byte{}, 0)
 	if err != nil {
 		return ser.Errorf(
@@ -170,3 +221,77 @@ func nspawn(
 	err = command.Wait()
 	return err
 }
+
+// addInterfaceMasquarading adds masquarading rules required by interface and
+// returns function, which removes them.
+func addInterfaceMasquarading(iface containerInterface) (func(), error) {
+	cleanups := []func(){}
+	cleanup := func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+
+	// container in veth mode is connected to host side of veth pair
+	// instead of bridge
+	dev := iface.Bridge
+	if iface.Mode == networkModeVeth {
+		dev = iface.HostName
+	}
+
+	if iface.Masquerade {
+		network := ""
+		if gateway := getIPv4Address(iface.Gateway); gateway != "" {
+			_, gatewayNetwork, err := net.ParseCIDR(gateway)
+			if err != nil {
+				return cleanup, err
+			}
+
+			network = gatewayNetwork.String()
+		}
+
+		err := addPostroutingMasquarading(dev, network)
+		if err != nil {
+			return cleanup, ser.Errorf(
+				err,
+				"can't add masquarading rules on the '%s'",
+				dev,
+			)
+		}
+
+		cleanups = append(cleanups, func() {
+			removePostroutingMasquarading(dev, network)
+		})
+	}
+
+	for _, address := range splitAddresses(iface.Gateway) {
+		if isIPv6Address(address) && !iface.NAT66 ||
+			!isIPv6Address(address) && !iface.NAT {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return cleanup, err
+		}
+
+		err = addPostroutingNetworkMasquarading(
+			dev, network.String(),
+		)
+		if err != nil {
+			return cleanup, ser.Errorf(
+				err,
+				"can't add masquarading rules for '%s'",
+				network,
+			)
+		}
+
+		cleanups = append(cleanups, func() {
+			removePostroutingNetworkMasquarading(
+				dev, network.String(),
+			)
+		})
+	}
+
+	return cleanup, nil
+}
@@ -11,7 +11,7 @@ import (
 )
 
 func installPackages(target string, packages []string) error {
-	args := []string{"-c", "-d", target}
+	args := append(append([]string{}, imageBuilderOptions...), target)
 	command := exec.Command("pacstrap", append(args, packages...)...)
 
 	command.Stdout = os.Stderr
@@ -26,11 +26,13 @@ func installPackages(target string, packages []string) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(target, ".packages"), []byte(
+	return nil
+}
+
+func writeExplicitlyInstalled(target string, packages []string) error {
+	return ioutil.WriteFile(filepath.Join(target, ".packages"), []byte(
 		strings.Join(packages, "\n"),
 	), 0644)
-
-	return err
 }
 
 func listExplicitlyInstalled(baseDir string) ([]string, error) {
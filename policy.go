@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/ser-go"
+)
+
+// networkPolicy restricts traffic of the container. Policy is enforced by
+// filter rules in the chain of the container, which is called from FORWARD
+// for traffic from container addresses, and also from INPUT if only listed
+// peers are allowed.
+type networkPolicy struct {
+	// DenyInternet drops traffic, which leaves container networks, and
+	// disables masquerading for container.
+	DenyInternet bool `json:"deny_internet,omitempty"`
+
+	// DenyHost drops new connections from container to its gateways.
+	DenyHost bool `json:"deny_host,omitempty"`
+
+	// Allow is list of peers in format peer[:port[/proto]], where peer is
+	// address, network or container name. If it's not empty, all other
+	// traffic from container, including traffic to the host, is dropped.
+	Allow []string `json:"allow,omitempty"`
+
+	rules []policyRule
+}
+
+// policyRule is resolved peer of the policy.
+type policyRule struct {
+	Network  string
+	Protocol string
+	Port     int
+}
+
+func (policy *networkPolicy) IsEmpty() bool {
+	return policy == nil ||
+		!policy.DenyInternet && !policy.DenyHost && len(policy.Allow) == 0
+}
+
+func (policy *networkPolicy) String() string {
+	if policy.IsEmpty() {
+		return ""
+	}
+
+	items := []string{}
+	if policy.DenyInternet {
+		items = append(items, "deny-internet")
+	}
+
+	if policy.DenyHost {
+		items = append(items, "deny-host")
+	}
+
+	for _, peer := range policy.Allow {
+		items = append(items, "allow="+peer)
+	}
+
+	return strings.Join(items, ",")
+}
+
+// parsePolicyPeer parses peer in format peer[:port[/proto]]. IPv6 peer
+// should be enclosed in brackets if port is specified.
+func parsePolicyPeer(spec string) (peer string, port int, proto string, err error) {
+	peer = spec
+	portSpec := ""
+	hasPort := false
+
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return "", 0, "", fmt.Errorf("invalid peer '%s'", spec)
+		}
+
+		peer = spec[1:end]
+
+		if rest := spec[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", 0, "", fmt.Errorf("invalid peer '%s'", spec)
+			}
+
+			portSpec, hasPort = rest[1:], true
+		}
+	} else if !strings.Contains(spec, "::") &&
+		strings.Count(spec, ":") == 1 {
+		parts := strings.SplitN(spec, ":", 2)
+		peer, portSpec, hasPort = parts[0], parts[1], true
+	}
+
+	if peer == "" {
+		return "", 0, "", fmt.Errorf("invalid peer '%s'", spec)
+	}
+
+	if !hasPort {
+		return peer, 0, "", nil
+	}
+
+	proto = "tcp"
+	if parts := strings.SplitN(portSpec, "/", 2); len(parts) == 2 {
+		portSpec, proto = parts[0], parts[1]
+	}
+
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return "", 0, "", fmt.Errorf(
+			"invalid protocol '%s' of peer '%s', should be tcp, udp or sctp",
+			proto, spec,
+		)
+	}
+
+	port, err = strconv.Atoi(portSpec)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, "", fmt.Errorf(
+			"invalid port '%s' of peer '%s'", portSpec, spec,
+		)
+	}
+
+	return peer, port, proto, nil
+}
+
+// resolveNetworkPolicy resolves peers of the policy into networks. Container
+// names are resolved into addresses of containers in the root dir.
+func resolveNetworkPolicy(rootDir string, policy *networkPolicy) error {
+	policy.rules = []policyRule{}
+
+	for _, spec := range policy.Allow {
+		peer, port, proto, err := parsePolicyPeer(spec)
+		if err != nil {
+			return err
+		}
+
+		networks := []string{}
+
+		switch {
+		case strings.Contains(peer, "/"):
+			_, network, err := net.ParseCIDR(peer)
+			if err != nil {
+				return ser.Errorf(err, "invalid peer network '%s'", peer)
+			}
+
+			networks = append(networks, network.String())
+
+		case net.ParseIP(peer) != nil:
+			networks = append(networks, getHostAddress(net.ParseIP(peer)))
+
+		default:
+			state, err := readContainerState(rootDir, peer)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't read state of container '%s'", peer,
+				)
+			}
+
+			if state == nil {
+				return fmt.Errorf(
+					"peer '%s' is neither address nor container", peer,
+				)
+			}
+
+			addresses := splitAddresses(state.Address)
+			for _, network := range state.Networks {
+				addresses = append(
+					addresses, splitAddresses(network.Address)...,
+				)
+			}
+
+			for _, address := range addresses {
+				ip, _, err := net.ParseCIDR(address)
+				if err == nil {
+					networks = append(networks, getHostAddress(ip))
+				}
+			}
+		}
+
+		for _, network := range networks {
+			policy.rules = append(policy.rules, policyRule{
+				Network:  network,
+				Protocol: proto,
+				Port:     port,
+			})
+		}
+	}
+
+	return nil
+}
+
+// getPolicyChain returns name of the chain, which holds policy rules of the
+// container. Chain name is limited by 28 characters, so hash is used.
+func getPolicyChain(containerName string) string {
+	hash := sha256.Sum256([]byte(containerName))
+
+	return fmt.Sprintf("hastur-%x", hash[:8])
+}
+
+// addNetworkPolicy creates chain with policy rules of the container and adds
+// rules, which pass container traffic through it.
+func addNetworkPolicy(
+	containerName string,
+	policy *networkPolicy,
+	interfaces []containerInterface,
+) error {
+	if policy.IsEmpty() {
+		return nil
+	}
+
+	for _, iface := range interfaces {
+		if len(policy.Allow) == 0 || iface.Bridge == "" {
+			continue
+		}
+
+		// traffic between containers on the same bridge is not passed
+		// through iptables otherwise
+		err := ensureBridgeNetfilter(iface.Bridge)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't enable netfilter on bridge '%s'", iface.Bridge,
+			)
+		}
+	}
+
+	chain := getPolicyChain(containerName)
+	comment := []string{
+		"-m", "comment", "--comment", getRulesComment(containerName),
+	}
+
+	for _, family := range []string{"0.0.0.0/0", "::/0"} {
+		addresses := []string{}
+		gateways := []string{}
+		devices := []string{}
+
+		for _, iface := range interfaces {
+			for _, address := range splitAddresses(iface.Address) {
+				if isIPv6Address(address) == isIPv6Address(family) {
+					addresses = append(addresses, address)
+				}
+			}
+
+			for _, gateway := range splitAddresses(iface.Gateway) {
+				if isIPv6Address(gateway) == isIPv6Address(family) {
+					gateways = append(gateways, gateway)
+				}
+			}
+
+			dev := iface.Bridge
+			if iface.Mode == networkModeVeth {
+				dev = iface.HostName
+			}
+
+			if dev != "" {
+				devices = append(devices, dev)
+			}
+		}
+
+		if len(addresses) == 0 {
+			continue
+		}
+
+		// chain can be left by container, which wasn't stopped cleanly
+		err := runIPTables(family, "-N", chain)
+		if err != nil {
+			err = runIPTables(family, "-F", chain)
+			if err != nil {
+				return ser.Errorf(err, "can't create chain %s", chain)
+			}
+		}
+
+		rules := [][]string{
+			{
+				"-A", chain, "-m", "conntrack",
+				"--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN",
+			},
+		}
+
+		for _, rule := range policy.rules {
+			if isIPv6Address(rule.Network) != isIPv6Address(family) {
+				continue
+			}
+
+			args := []string{"-A", chain, "-d", rule.Network}
+			if rule.Port > 0 {
+				args = append(
+					args, "-p", rule.Protocol, "--dport", fmt.Sprint(rule.Port),
+				)
+			}
+
+			rules = append(rules, append(args, "-j", "RETURN"))
+		}
+
+		switch {
+		case len(policy.Allow) > 0:
+			rules = append(rules, []string{"-A", chain, "-j", "DROP"})
+
+		case policy.DenyInternet:
+			for _, dev := range devices {
+				rules = append(
+					rules, []string{"-A", chain, "-o", dev, "-j", "RETURN"},
+				)
+			}
+
+			rules = append(rules, []string{"-A", chain, "-j", "DROP"})
+		}
+
+		for _, address := range addresses {
+			ip, _, err := net.ParseCIDR(address)
+			if err != nil {
+				return err
+			}
+
+			rules = append(rules, append(
+				[]string{"-I", "FORWARD", "-s", ip.String()},
+				append(comment, "-j", chain)...,
+			))
+
+			// host addresses are not reachable through FORWARD, so they
+			// are allowed only if listed as peers
+			if len(policy.Allow) > 0 {
+				rules = append(rules, append(
+					[]string{"-I", "INPUT", "-s", ip.String()},
+					append(comment, "-j", chain)...,
+				))
+			}
+
+			if policy.DenyInternet {
+				rules = append(rules, append(
+					[]string{"-t", "nat", "-I", "POSTROUTING", "-s", ip.String()},
+					append(comment, "-j", "RETURN")...,
+				))
+			}
+
+			if !policy.DenyHost {
+				continue
+			}
+
+			for _, gateway := range gateways {
+				gatewayIP, _, err := net.ParseCIDR(gateway)
+				if err != nil {
+					return err
+				}
+
+				rules = append(rules, append(
+					[]string{
+						"-I", "INPUT", "-s", ip.String(),
+						"-d", gatewayIP.String(),
+						"-m", "conntrack", "--ctstate", "NEW",
+					},
+					append(comment, "-j", "DROP")...,
+				))
+			}
+		}
+
+		for _, rule := range rules {
+			err := runIPTables(family, rule...)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't add policy rule %q", rule,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeContainerFirewall removes all rules of the container, including
+// published ports and network policy.
+func removeContainerFirewall(containerName string) error {
+	err := removeContainerRules(containerName)
+	if err != nil {
+		return err
+	}
+
+	chain := getPolicyChain(containerName)
+	for _, family := range []string{"0.0.0.0/0", "::/0"} {
+		// chain exists only if container has policy
+		err := runIPTables(family, "-F", chain)
+		if err != nil {
+			continue
+		}
+
+		err = runIPTables(family, "-X", chain)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't remove chain %s", chain,
+			)
+		}
+	}
+
+	return nil
+}
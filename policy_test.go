@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParsePolicyPeer(t *testing.T) {
+	testcases := []struct {
+		spec  string
+		valid bool
+		peer  string
+		port  int
+		proto string
+	}{
+		{"web", true, "web", 0, ""},
+		{"web:80", true, "web", 80, "tcp"},
+		{"web:53/udp", true, "web", 53, "udp"},
+		{"10.0.0.2", true, "10.0.0.2", 0, ""},
+		{"10.0.0.0/8:443", true, "10.0.0.0/8", 443, "tcp"},
+		{"fd00::1", true, "fd00::1", 0, ""},
+		{"fd00::/64", true, "fd00::/64", 0, ""},
+		{"fe80:1:2:3:4:5:6:7", true, "fe80:1:2:3:4:5:6:7", 0, ""},
+		{"[fd00::1]", true, "fd00::1", 0, ""},
+		{"[fd00::1]:8080/sctp", true, "fd00::1", 8080, "sctp"},
+		{"", false, "", 0, ""},
+		{":80", false, "", 0, ""},
+		{"web:", false, "", 0, ""},
+		{"web:0", false, "", 0, ""},
+		{"web:65536", false, "", 0, ""},
+		{"web:http", false, "", 0, ""},
+		{"web:80/icmp", false, "", 0, ""},
+		{"web:80/", false, "", 0, ""},
+		{"[fd00::1", false, "", 0, ""},
+		{"[fd00::1]80", false, "", 0, ""},
+		{"[fd00::1]:", false, "", 0, ""},
+		{"[]:80", false, "", 0, ""},
+	}
+
+	for _, testcase := range testcases {
+		peer, port, proto, err := parsePolicyPeer(testcase.spec)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%q: expected error, got none", testcase.spec)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", testcase.spec, err)
+			continue
+		}
+
+		if peer != testcase.peer ||
+			port != testcase.port ||
+			proto != testcase.proto {
+			t.Errorf(
+				"%q: expected %s %d %s, got %s %d %s",
+				testcase.spec,
+				testcase.peer, testcase.port, testcase.proto,
+				peer, port, proto,
+			)
+		}
+	}
+}
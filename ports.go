@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+var publishedPortRegexp = regexp.MustCompile(
+	`^(\d+):(\d+)(?:/(tcp|udp|sctp))?$`,
+)
+
+// publishedPort is port of the host, which is forwarded to the container.
+type publishedPort struct {
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol"`
+}
+
+func (port publishedPort) String() string {
+	return fmt.Sprintf(
+		"%d:%d/%s", port.HostPort, port.ContainerPort, port.Protocol,
+	)
+}
+
+// parsePublishedPort parses port in format hostport:containerport[/proto].
+func parsePublishedPort(spec string) (publishedPort, error) {
+	matches := publishedPortRegexp.FindStringSubmatch(spec)
+	if matches == nil {
+		return publishedPort{}, fmt.Errorf(
+			"invalid port '%s', should be hostport:containerport[/proto], "+
+				"where proto is tcp, udp or sctp",
+			spec,
+		)
+	}
+
+	port := publishedPort{Protocol: "tcp"}
+	if matches[3] != "" {
+		port.Protocol = matches[3]
+	}
+
+	for i, target := range []*int{&port.HostPort, &port.ContainerPort} {
+		value, err := strconv.Atoi(matches[i+1])
+		if err != nil || value < 1 || value > 65535 {
+			return publishedPort{}, fmt.Errorf(
+				"invalid port number '%s'", matches[i+1],
+			)
+		}
+
+		*target = value
+	}
+
+	return port, nil
+}
+
+func parsePublishedPorts(specs []string) ([]publishedPort, error) {
+	ports := []publishedPort{}
+	for _, spec := range specs {
+		port, err := parsePublishedPort(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
+
+func formatPublishedPorts(ports []publishedPort) string {
+	specs := []string{}
+	for _, port := range ports {
+		specs = append(specs, port.String())
+	}
+
+	return strings.Join(specs, ",")
+}
+
+// getRulesComment returns comment, which marks iptables rules of the
+// container, so they can be found and removed even if container state is
+// lost.
+func getRulesComment(containerName string) string {
+	return "hastur:" + containerName
+}
+
+// addPublishedPorts adds DNAT rules, which forward host ports to the
+// container address, for every address family of the container. Forwarded
+// traffic is accepted before isolation rules of the bridge.
+func addPublishedPorts(
+	containerName string,
+	address string,
+	ports []publishedPort,
+) error {
+	comment := []string{
+		"-m", "comment", "--comment", getRulesComment(containerName),
+	}
+
+	for _, address := range splitAddresses(address) {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return err
+		}
+
+		destination := ip.String()
+		if isIPv6Address(address) {
+			destination = "[" + destination + "]"
+		}
+
+		for _, port := range ports {
+			rules := [][]string{}
+
+			for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+				rule := []string{
+					"-t", "nat", "-A", chain,
+					"-p", port.Protocol, "--dport", fmt.Sprint(port.HostPort),
+					"-m", "addrtype", "--dst-type", "LOCAL",
+				}
+
+				rule = append(rule, comment...)
+				rule = append(rule,
+					"-j", "DNAT", "--to-destination",
+					fmt.Sprintf("%s:%d", destination, port.ContainerPort),
+				)
+
+				rules = append(rules, rule)
+			}
+
+			rule := []string{
+				"-I", "FORWARD", "-d", ip.String(),
+				"-p", port.Protocol,
+				"--dport", fmt.Sprint(port.ContainerPort),
+			}
+
+			rule = append(rule, comment...)
+			rule = append(rule, "-j", "ACCEPT")
+
+			rules = append(rules, rule)
+
+			for _, rule := range rules {
+				err := runIPTables(address, rule...)
+				if err != nil {
+					return ser.Errorf(
+						err, "can't publish port %s", port,
+					)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeContainerRules removes all iptables rules, which are marked with
+// comment of the container.
+func removeContainerRules(containerName string) error {
+	comment := getRulesComment(containerName)
+
+	for _, family := range []string{"0.0.0.0/0", "::/0"} {
+		for _, table := range []string{"nat", "filter"} {
+			rules, err := listIPTablesRules(family, table)
+			if err != nil {
+				return err
+			}
+
+			for _, rule := range rules {
+				if !hasRuleComment(rule, comment) || rule[0] != "-A" {
+					continue
+				}
+
+				args := append([]string{"-t", table, "-D"}, rule[1:]...)
+
+				err := runIPTables(family, args...)
+				if err != nil {
+					return ser.Errorf(
+						err, "can't remove rule %q", rule,
+					)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasRuleComment(rule []string, comment string) bool {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] == "--comment" && rule[i+1] == comment {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIPTablesRule splits rule in the iptables -S format into arguments.
+// iptables quotes arguments, which contain spaces or special characters,
+// like comments, so quotes are removed to pass arguments back to iptables.
+func parseIPTablesRule(line string) []string {
+	var (
+		args    = []string{}
+		arg     = []rune{}
+		quoted  = false
+		escaped = false
+		found   = false
+	)
+
+	for _, char := range line {
+		switch {
+		case escaped:
+			arg = append(arg, char)
+			escaped = false
+		case quoted && char == '\\':
+			escaped = true
+		case char == '"':
+			quoted = !quoted
+			found = true
+		case !quoted && (char == ' ' || char == '\t'):
+			if found {
+				args = append(args, string(arg))
+			}
+
+			arg = []rune{}
+			found = false
+		default:
+			arg = append(arg, char)
+			found = true
+		}
+	}
+
+	if found {
+		args = append(args, string(arg))
+	}
+
+	return args
+}
+
+// listIPTablesRules returns rules of the table in the iptables -S format.
+func listIPTablesRules(address string, table string) ([][]string, error) {
+	binary := "iptables"
+	if isIPv6Address(address) {
+		binary = "ip6tables"
+	}
+
+	command := exec.Command(binary, "-t", table, "-S")
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := [][]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		rule := parseIPTablesRule(line)
+		if len(rule) > 0 {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePublishedPort(t *testing.T) {
+	testcases := []struct {
+		spec     string
+		valid    bool
+		expected publishedPort
+	}{
+		{"8080:80", true, publishedPort{8080, 80, "tcp"}},
+		{"5353:53/udp", true, publishedPort{5353, 53, "udp"}},
+		{"1:65535/sctp", true, publishedPort{1, 65535, "sctp"}},
+		{"80", false, publishedPort{}},
+		{"0:80", false, publishedPort{}},
+		{"80:65536", false, publishedPort{}},
+		{"80:80/icmp", false, publishedPort{}},
+		{"80:80/", false, publishedPort{}},
+		{":80", false, publishedPort{}},
+		{"-1:80", false, publishedPort{}},
+		{"99999999999999999999:80", false, publishedPort{}},
+	}
+
+	for _, testcase := range testcases {
+		port, err := parsePublishedPort(testcase.spec)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", testcase.spec)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.spec, err)
+			continue
+		}
+
+		if port != testcase.expected {
+			t.Errorf(
+				"%s: expected %v, got %v", testcase.spec, testcase.expected, port,
+			)
+		}
+
+		// port is stored in container state in the same format
+		if port.String() != testcase.spec &&
+			port.String() != testcase.spec+"/tcp" {
+			t.Errorf("%s: formatted as %s", testcase.spec, port.String())
+		}
+	}
+}
+
+func TestParseIPTablesRule(t *testing.T) {
+	testcases := []struct {
+		line     string
+		expected []string
+	}{
+		{
+			"-P FORWARD ACCEPT",
+			[]string{"-P", "FORWARD", "ACCEPT"},
+		},
+		{
+			`-A PREROUTING -p tcp -m tcp --dport 8080 ` +
+				`-m addrtype --dst-type LOCAL ` +
+				`-m comment --comment "hastur:web" ` +
+				`-j DNAT --to-destination 10.0.0.2:80`,
+			[]string{
+				"-A", "PREROUTING", "-p", "tcp", "-m", "tcp",
+				"--dport", "8080", "-m", "addrtype", "--dst-type", "LOCAL",
+				"-m", "comment", "--comment", "hastur:web",
+				"-j", "DNAT", "--to-destination", "10.0.0.2:80",
+			},
+		},
+		{
+			`-A FORWARD -m comment --comment "with \"quotes\" and \\" -j ACCEPT`,
+			[]string{
+				"-A", "FORWARD", "-m", "comment",
+				"--comment", `with "quotes" and \`, "-j", "ACCEPT",
+			},
+		},
+		{
+			`-A INPUT -m comment --comment "" -j DROP`,
+			[]string{"-A", "INPUT", "-m", "comment", "--comment", "", "-j", "DROP"},
+		},
+		{
+			"  -N\thastur-0123  ",
+			[]string{"-N", "hastur-0123"},
+		},
+		{
+			"",
+			[]string{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		rule := parseIPTablesRule(testcase.line)
+		if !reflect.DeepEqual(rule, testcase.expected) {
+			t.Errorf(
+				"%q: expected %q, got %q", testcase.line, testcase.expected, rule,
+			)
+		}
+	}
+}
+
+func TestHasRuleComment(t *testing.T) {
+	comment := getRulesComment("web")
+
+	testcases := []struct {
+		line     string
+		expected bool
+	}{
+		{`-A FORWARD -d 10.0.0.2/32 -m comment --comment "hastur:web" -j ACCEPT`, true},
+		{`-A FORWARD -m comment --comment hastur:web -j ACCEPT`, true},
+		{`-A FORWARD -m comment --comment "hastur:web2" -j ACCEPT`, false},
+		{`-A FORWARD -m comment --comment "hastur:we" -j ACCEPT`, false},
+		{`-A FORWARD -j ACCEPT`, false},
+		{`-A FORWARD --comment`, false},
+	}
+
+	for _, testcase := range testcases {
+		rule := parseIPTablesRule(testcase.line)
+		if hasRuleComment(rule, comment) != testcase.expected {
+			t.Errorf(
+				"%s: expected comment match %v", testcase.line, testcase.expected,
+			)
+		}
+
+		// rule is deleted by the same arguments, so comment should not
+		// keep quotes of iptables -S output
+		if testcase.expected {
+			for i := range rule {
+				if rule[i] == "--comment" && rule[i+1] != comment {
+					t.Errorf("%s: comment is %q", testcase.line, rule[i+1])
+				}
+			}
+		}
+	}
+}
@@ -5,16 +5,37 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/reconquest/karma-go"
+	"github.com/reconquest/ser-go"
 )
 
+type image struct {
+	Name     string        `json:"name"`
+	Tags     []string      `json:"tags"`
+	Parent   string        `json:"parent,omitempty"`
+	Recipe   string        `json:"recipe,omitempty"`
+	Commit   string        `json:"commit,omitempty"`
+	Packages []string      `json:"packages"`
+	Stats    *storageStats `json:"stats,omitempty"`
+}
+
 type container struct {
-	Name    string `json:"name"`
-	Status  string `json:"status"`
-	Root    string `json:"root"`
-	Address string `json:"address"`
+	Name      string        `json:"name"`
+	Status    string        `json:"status"`
+	Root      string        `json:"root"`
+	Address   string        `json:"address"`
+	Snapshots []string      `json:"snapshots"`
+	Usage     uint64        `json:"usage"`
+	Quota     uint64        `json:"quota,omitempty"`
+	Stats     *storageStats `json:"stats,omitempty"`
+
+	Networks []containerNetwork `json:"networks,omitempty"`
+	Ports    []publishedPort    `json:"ports,omitempty"`
+	Policy   *networkPolicy     `json:"policy,omitempty"`
+	Veths    []string           `json:"veths,omitempty"`
 }
 
 func queryContainers(
@@ -55,14 +76,74 @@ func queryContainers(
 		container := container{
 			Name:    name,
 			Status:  "inactive",
-			Root:    storageEngine.GetContainerRoot(name),
 			Address: "",
 		}
 
+		container.Root, err = storageEngine.GetContainerRoot(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(err,
+				"WARNING: can't get container '%s' root",
+				name,
+			))
+		}
+
+		container.Snapshots, err = storageEngine.ListContainerSnapshots(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(err,
+				"WARNING: can't list container '%s' snapshots",
+				name,
+			))
+
+			container.Snapshots = []string{}
+		}
+
+		container.Usage, err = storageEngine.GetContainerUsage(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(err,
+				"WARNING: can't obtain container '%s' disk usage",
+				name,
+			))
+		}
+
+		if stats, ok := storageEngine.(statsStorage); ok {
+			container.Stats, err = stats.GetContainerStats(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, karma.Format(err,
+					"WARNING: can't obtain container '%s' stats",
+					name,
+				))
+			}
+		}
+
+		state, err := readContainerState(rootDir, name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(err,
+				"WARNING: can't read container '%s' state",
+				name,
+			))
+		}
+
+		if state != nil && state.Quota != "" {
+			container.Quota, _ = parseSize(state.Quota)
+		}
+
+		if state != nil {
+			container.Networks = state.Networks
+			container.Ports = state.Ports
+			container.Policy = state.Policy
+			container.Veths = state.Veths
+		}
+
 		_, ok := active[name]
 		if ok {
 			container.Status = "active"
-			container.Address, err = getContainerIP(name)
+			iface := getInterfaceName(0)
+			if state != nil && state.Network != "" {
+				mode, link, _ := parseNetworkMode(state.Network)
+				iface = getNetworkModeInterface(mode, link)
+			}
+
+			container.Address, err = getContainerIP(name, iface)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, karma.Format(err,
 					"WARNING: can't obtain container '%s' address",
@@ -77,11 +158,20 @@ func queryContainers(
 	if !useJSON {
 		writer := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
 		for _, container := range containers {
+			usage := formatSize(container.Usage)
+			if container.Quota > 0 {
+				usage += "/" + formatSize(container.Quota)
+			}
+
 			fmt.Fprintf(
 				writer,
-				"%s\t%s\t%s\t%s\n",
+				"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 				container.Name, container.Status,
 				container.Address, container.Root,
+				usage, formatStorageStats(container.Stats),
+				strings.Join(container.Snapshots, ","),
+				formatPublishedPorts(container.Ports),
+				container.Policy.String(),
 			)
 		}
 
@@ -102,3 +192,113 @@ func queryContainers(
 
 	return nil
 }
+
+func queryImages(
+	args map[string]interface{}, storageEngine storage,
+) error {
+	var (
+		rootDir = args["-r"].(string)
+		useJSON = args["-j"].(bool)
+	)
+
+	names, err := listImages(rootDir)
+	if err != nil {
+		return err
+	}
+
+	tags, err := listTags(rootDir)
+	if err != nil {
+		return ser.Errorf(err, "can't list tags")
+	}
+
+	images := []image{}
+	for _, name := range names {
+		imageDir := getImageDir(rootDir, name)
+		if !isExists(imageDir, ".hastur") {
+			continue
+		}
+
+		key, err := readImageKey(imageDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, karma.Format(err,
+				"WARNING: can't read image '%s' key",
+				name,
+			))
+		}
+
+		image := image{
+			Name:     name,
+			Tags:     tags[name],
+			Packages: key.Packages,
+		}
+
+		if image.Tags == nil {
+			image.Tags = []string{}
+		}
+
+		image.Parent, err = getImageParent(rootDir, name)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't get parent of image %s", name,
+			)
+		}
+
+		recipe, err := readImageRecipe(imageDir)
+		if err == nil {
+			image.Recipe = recipe.Name
+		}
+
+		commit, err := readImageCommit(imageDir)
+		if err == nil {
+			image.Commit = commit.Container
+		}
+
+		if stats, ok := storageEngine.(statsStorage); ok {
+			image.Stats, err = stats.GetImageStats(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, karma.Format(err,
+					"WARNING: can't obtain image '%s' stats",
+					name,
+				))
+			}
+		}
+
+		images = append(images, image)
+	}
+
+	if !useJSON {
+		writer := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		for _, image := range images {
+			fmt.Fprintf(
+				writer,
+				"%s\t%s\t%s\t%s\n",
+				image.Name, strings.Join(image.Tags, ","),
+				formatStorageStats(image.Stats),
+				strings.Join(image.Packages, ","),
+			)
+		}
+
+		return writer.Flush()
+	}
+
+	output, err := json.MarshalIndent(images, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(output))
+
+	return nil
+}
+
+func formatStorageStats(stats *storageStats) string {
+	if stats == nil {
+		return ""
+	}
+
+	return fmt.Sprintf(
+		"used=%s referenced=%s compressratio=%s",
+		formatSize(stats.Used), formatSize(stats.Referenced),
+		stats.CompressRatio,
+	)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+// maxProjectID is the maximum project id, which is supported by quota tools.
+const maxProjectID = 0x7ffffffe
+
+// getContainerProjectID returns project quota id of container, which upper
+// dir is located on xfs or ext4. Id is allocated once, so it's unique on the
+// filesystem, and is stored in container state.
+func getContainerProjectID(
+	rootDir string,
+	containerName string,
+	dir string,
+) (uint32, error) {
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return 0, err
+	}
+
+	if state == nil {
+		state = &containerState{}
+	}
+
+	if state.ProjectID != 0 {
+		return state.ProjectID, nil
+	}
+
+	projectID, err := allocateProjectID(rootDir, containerName, dir)
+	if err != nil {
+		return 0, ser.Errorf(
+			err, "can't allocate quota project for '%s'", containerName,
+		)
+	}
+
+	state.ProjectID = projectID
+
+	err = writeContainerState(rootDir, containerName, state)
+	if err != nil {
+		return 0, err
+	}
+
+	return projectID, nil
+}
+
+// allocateProjectID returns project id, which is not used on filesystem of
+// specified dir and is not assigned to other containers of the root dir.
+// Search is started from id derived from container name, so ids are not
+// reused by different containers if possible.
+func allocateProjectID(
+	rootDir string,
+	containerName string,
+	dir string,
+) (uint32, error) {
+	used, err := getUsedProjectIDs(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	containers, err := listContainers(filepath.Join(rootDir, "containers"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, container := range containers {
+		state, err := readContainerState(rootDir, container)
+		if err == nil && state != nil && state.ProjectID != 0 {
+			used[state.ProjectID] = true
+		}
+	}
+
+	projectID := crc32.ChecksumIEEE([]byte(containerName))%maxProjectID + 1
+	for attempt := 0; attempt < maxProjectID; attempt++ {
+		if !used[projectID] {
+			return projectID, nil
+		}
+
+		projectID = projectID%maxProjectID + 1
+	}
+
+	return 0, errors.New("all project ids are used")
+}
+
+// getUsedProjectIDs returns project ids, which have quotas on filesystem of
+// specified dir.
+func getUsedProjectIDs(dir string) (map[uint32]bool, error) {
+	fsType, err := getFSType(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoint, err := getMountpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var command *exec.Cmd
+
+	switch fsType {
+	case "xfs":
+		command = exec.Command(
+			"xfs_quota", "-x", "-c", "report -p -n -N", mountpoint,
+		)
+
+	case "ext4":
+		command = exec.Command("repquota", "-P", "-n", mountpoint)
+
+	default:
+		return nil, fmt.Errorf("project quotas are not supported on %s", fsType)
+	}
+
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseQuotaReport(string(output)), nil
+}
+
+// parseQuotaReport returns ids listed in output of xfs_quota report or
+// repquota with numeric ids, e.g. '#42  1024  0  2048'.
+func parseQuotaReport(output string) map[uint32]bool {
+	ids := map[uint32]bool{}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "#"), 10, 32)
+		if err == nil && id != 0 {
+			ids[uint32(id)] = true
+		}
+	}
+
+	return ids
+}
+
+// setDirQuota limits size of specified directory using quota mechanism of
+// underlying FS. Zero size removes limit. Project id is requested only for
+// filesystems, which use project quotas.
+func setDirQuota(
+	dir string,
+	size uint64,
+	getProjectID func() (uint32, error),
+) error {
+	fsType, err := getFSType(dir)
+	if err != nil {
+		return err
+	}
+
+	mountpoint, err := getMountpoint(dir)
+	if err != nil {
+		return err
+	}
+
+	switch fsType {
+	case "xfs":
+		projectID, err := getProjectID()
+		if err != nil {
+			return err
+		}
+
+		err = runQuotaCommand(
+			"xfs_quota", "-x",
+			"-c", fmt.Sprintf("project -s -p %s %d", dir, projectID),
+			mountpoint,
+		)
+		if err != nil {
+			return err
+		}
+
+		return runQuotaCommand(
+			"xfs_quota", "-x",
+			"-c", fmt.Sprintf("limit -p bhard=%dk %d", size/1024, projectID),
+			mountpoint,
+		)
+
+	case "ext4":
+		projectID, err := getProjectID()
+		if err != nil {
+			return err
+		}
+
+		err = runQuotaCommand(
+			"chattr", "-R", "-p", fmt.Sprint(projectID), "+P", dir,
+		)
+		if err != nil {
+			return err
+		}
+
+		return runQuotaCommand(
+			"setquota", "-P", fmt.Sprint(projectID),
+			"0", fmt.Sprint(size/1024), "0", "0",
+			mountpoint,
+		)
+
+	case "btrfs":
+		err = runQuotaCommand("btrfs", "quota", "enable", mountpoint)
+		if err != nil {
+			return err
+		}
+
+		limit := "none"
+		if size > 0 {
+			limit = fmt.Sprint(size)
+		}
+
+		return runQuotaCommand("btrfs", "qgroup", "limit", limit, dir)
+
+	default:
+		return fmt.Errorf("quotas are not supported on %s", fsType)
+	}
+}
+
+// getDirUsage returns disk space used by specified directory.
+func getDirUsage(dir string) (uint64, error) {
+	command := exec.Command("du", "-s", "-x", "--block-size=1", dir)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid output from du: %q", output)
+	}
+
+	return strconv.ParseUint(fields[0], 10, 64)
+}
+
+func runQuotaCommand(name string, args ...string) error {
+	command := exec.Command(name, args...)
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
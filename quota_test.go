@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuotaReport(t *testing.T) {
+	testcases := []struct {
+		name     string
+		output   string
+		expected map[uint32]bool
+	}{
+		{
+			name: "xfs_quota",
+			output: "#0                  0          0          0     00 [--------]\n" +
+				"#42              1024          0    2097152     00 [--------]\n" +
+				"#2147483646         0          0    1048576     00 [--------]\n",
+			expected: map[uint32]bool{42: true, 2147483646: true},
+		},
+		{
+			name: "repquota",
+			output: "*** Report for project quotas on device /dev/sda1\n" +
+				"Block grace time: 7days; Inode grace time: 7days\n" +
+				"                        Block limits                File limits\n" +
+				"Project         used    soft    hard  grace    used  soft  hard  grace\n" +
+				"----------------------------------------------------------------------\n" +
+				"#0        --      20       0       0              2     0     0\n" +
+				"#1337     --    4096       0 1048576              9     0     0\n",
+			expected: map[uint32]bool{1337: true},
+		},
+		{
+			name:     "invalid",
+			output:   "#\n#-1 0 0\n#4294967296 0 0\n#abc 0 0\n42 0 0\n",
+			expected: map[uint32]bool{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		ids := parseQuotaReport(testcase.output)
+		if !reflect.DeepEqual(ids, testcase.expected) {
+			t.Errorf(
+				"%s: expected %v, got %v", testcase.name, testcase.expected, ids,
+			)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+const imageRecipeFile = `.recipe`
+
+// recipe describes how to build image: which packages should be installed,
+// which files should be copied and which commands should be run inside.
+type recipe struct {
+	Name        string            `json:"name"`
+	Packages    []string          `json:"packages"`
+	Files       []recipeFile      `json:"files,omitempty"`
+	Commands    []string          `json:"commands,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+
+	dir string
+}
+
+type recipeFile struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+func readRecipe(path string) (*recipe, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipe recipe
+	err = json.Unmarshal(data, &recipe)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode recipe '%s'", path,
+		)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, formatAbsPathError(path, err)
+	}
+
+	recipe.dir = filepath.Dir(absPath)
+
+	if recipe.Name == "" {
+		return nil, errors.New("recipe name should be specified")
+	}
+
+	if len(recipe.Packages) == 0 {
+		recipe.Packages = strings.Split(defaultPackages, ",")
+	}
+
+	recipe.Packages = normalizePackages(recipe.Packages)
+
+	for _, file := range recipe.Files {
+		if !filepath.IsAbs(file.Target) {
+			return nil, fmt.Errorf(
+				"target '%s' of file '%s' should be absolute path",
+				file.Target, file.Source,
+			)
+		}
+
+		if !isExists(recipe.getSourcePath(file)) {
+			return nil, fmt.Errorf(
+				"file '%s' does not exist", recipe.getSourcePath(file),
+			)
+		}
+
+		if file.Mode != "" {
+			_, err := strconv.ParseUint(file.Mode, 8, 32)
+			if err != nil {
+				return nil, ser.Errorf(
+					err, "invalid mode '%s' of file '%s'",
+					file.Mode, file.Source,
+				)
+			}
+		}
+	}
+
+	return &recipe, nil
+}
+
+// readImageRecipe reads recipe, which was used to provision the image.
+func readImageRecipe(imageDir string) (*recipe, error) {
+	data, err := ioutil.ReadFile(filepath.Join(imageDir, imageRecipeFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var recipe recipe
+	err = json.Unmarshal(data, &recipe)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode image recipe in '%s'", imageDir,
+		)
+	}
+
+	return &recipe, nil
+}
+
+func (recipe *recipe) getSourcePath(file recipeFile) string {
+	if filepath.IsAbs(file.Source) {
+		return file.Source
+	}
+
+	return filepath.Join(recipe.dir, file.Source)
+}
+
+// getChecksum returns checksum of recipe itself and contents of all files,
+// which will be copied into image, so any change will cause image rebuild.
+func (recipe *recipe) getChecksum() (string, error) {
+	hash := sha256.New()
+
+	data, err := json.Marshal(recipe)
+	if err != nil {
+		return "", err
+	}
+
+	hash.Write(data)
+
+	for _, file := range recipe.Files {
+		source := recipe.getSourcePath(file)
+
+		err := filepath.Walk(
+			source,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				relPath, err := filepath.Rel(source, path)
+				if err != nil {
+					return err
+				}
+
+				fmt.Fprintf(hash, "%s %s\n", relPath, info.Mode())
+
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+
+				contents, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+
+				defer contents.Close()
+
+				_, err = io.Copy(hash, contents)
+
+				return err
+			},
+		)
+		if err != nil {
+			return "", ser.Errorf(
+				err, "can't calculate checksum of '%s'", source,
+			)
+		}
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// buildImageForRecipe builds image with recipe packages first and then
+// provisions recipe image as a layer on top of it.
+func buildImageForRecipe(
+	rootDir string,
+	recipe *recipe,
+	force bool,
+	storageEngine storage,
+) (string, error) {
+	_, err := buildImageForPackages(
+		rootDir,
+		recipe.Packages,
+		false,
+		storageEngine,
+	)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't build image for packages %q", recipe.Packages,
+		)
+	}
+
+	checksum, err := recipe.getChecksum()
+	if err != nil {
+		return "", err
+	}
+
+	cacheExists, image, err := createBaseDirForKey(
+		rootDir,
+		newImageKey(recipe.Packages, checksum),
+		true,
+		storageEngine,
+	)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't create base dir '%s'", image,
+		)
+	}
+
+	if cacheExists && !force {
+		return image, nil
+	}
+
+	if cacheExists {
+		err = setImageReadOnly(image, false, storageEngine)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = installImagePackages(
+		rootDir, image,
+		recipe.Packages,
+		storageEngine,
+	)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't install packages into '%s'", image,
+		)
+	}
+
+	fmt.Printf("Provisioning image from recipe %s\n", recipe.Name)
+
+	err = provisionImage(rootDir, image, recipe, storageEngine)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't provision image %s", image,
+		)
+	}
+
+	err = markImageBuilt(rootDir, image, storageEngine)
+	if err != nil {
+		return "", err
+	}
+
+	return image, nil
+}
+
+func provisionImage(
+	rootDir string,
+	image string,
+	recipe *recipe,
+	storageEngine storage,
+) error {
+	imageRoot, err := storageEngine.MountImage(image)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't mount image %s", image,
+		)
+	}
+
+	defer storageEngine.UmountImage(image)
+
+	for _, file := range recipe.Files {
+		err := copyRecipeFile(imageRoot, recipe.getSourcePath(file), file)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't copy '%s' to '%s'", file.Source, file.Target,
+			)
+		}
+	}
+
+	for _, command := range recipe.Commands {
+		err := runImageCommand(image, imageRoot, recipe.Environment, command)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't run command %q", command,
+			)
+		}
+	}
+
+	data, err := json.MarshalIndent(recipe, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(
+		filepath.Join(imageRoot, imageRecipeFile), data, 0644,
+	)
+}
+
+func copyRecipeFile(root string, source string, file recipeFile) error {
+	target := filepath.Join(root, file.Target)
+
+	stat, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if stat.IsDir() {
+		err = copyDir(source, target)
+	} else {
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = copyFile(source, target)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if file.Mode != "" {
+		mode, _ := strconv.ParseUint(file.Mode, 8, 32)
+
+		err = os.Chmod(target, os.FileMode(mode))
+		if err != nil {
+			return ser.Errorf(
+				err, "can't change file mode: %s", target,
+			)
+		}
+	}
+
+	return nil
+}
+
+func runImageCommand(
+	image string,
+	root string,
+	environment map[string]string,
+	commandLine string,
+) error {
+	args := []string{"-q", "-M", image + ".build", "-D", root}
+
+	names := []string{}
+	for name := range environment {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		args = append(args, "--setenv="+name+"="+environment[name])
+	}
+
+	args = append(args, "/bin/sh", "-c", commandLine)
+
+	command := exec.Command("systemd-nspawn", args...)
+
+	command.Stdout = os.Stderr
+	command.Stderr = os.Stderr
+
+	_, _, err := executil.Run(
+		command,
+		executil.IgnoreStderr,
+		executil.IgnoreStdout,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
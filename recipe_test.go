@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRecipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hastur-recipe-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "nginx.conf"), []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name     string
+		recipe   string
+		valid    bool
+		packages []string
+	}{
+		{
+			name: "valid",
+			recipe: `{
+				"name": "web",
+				"packages": ["nginx", "bash", "nginx"],
+				"files": [
+					{"source": "nginx.conf", "target": "/etc/nginx.conf"},
+					{"source": "nginx.conf", "target": "/etc/x", "mode": "0600"}
+				],
+				"commands": ["nginx -t"]
+			}`,
+			valid:    true,
+			packages: []string{"bash", "nginx"},
+		},
+		{
+			name:     "default packages",
+			recipe:   `{"name": "base"}`,
+			valid:    true,
+			packages: normalizePackages(strings.Split(defaultPackages, ",")),
+		},
+		{
+			name:   "no name",
+			recipe: `{"packages": ["bash"]}`,
+		},
+		{
+			name:   "invalid json",
+			recipe: `{"name": "web",`,
+		},
+		{
+			name: "relative target",
+			recipe: `{"name": "web", "files": [
+				{"source": "nginx.conf", "target": "etc/nginx.conf"}
+			]}`,
+		},
+		{
+			name: "missing source",
+			recipe: `{"name": "web", "files": [
+				{"source": "missing.conf", "target": "/etc/nginx.conf"}
+			]}`,
+		},
+		{
+			name: "invalid mode",
+			recipe: `{"name": "web", "files": [
+				{"source": "nginx.conf", "target": "/etc/x", "mode": "0800"}
+			]}`,
+		},
+	}
+
+	for _, testcase := range testcases {
+		path := filepath.Join(dir, "recipe.json")
+
+		err := ioutil.WriteFile(path, []byte(testcase.recipe), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recipe, err := readRecipe(path)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", testcase.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(recipe.Packages, testcase.packages) {
+			t.Errorf(
+				"%s: expected packages %q, got %q",
+				testcase.name, testcase.packages, recipe.Packages,
+			)
+		}
+
+		for _, file := range recipe.Files {
+			source := recipe.getSourcePath(file)
+			if source != filepath.Join(dir, file.Source) {
+				t.Errorf(
+					"%s: source is not relative to recipe: %s",
+					testcase.name, source,
+				)
+			}
+		}
+	}
+}
+
+func TestRecipeChecksumDependsOnFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hastur-recipe-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "motd")
+
+	err = ioutil.WriteFile(source, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "recipe.json")
+
+	err = ioutil.WriteFile(path, []byte(`{
+		"name": "motd",
+		"files": [{"source": "motd", "target": "/etc/motd"}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipe, err := readRecipe(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := recipe.getChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	same, err := recipe.getChecksum()
+	if err != nil || same != checksum {
+		t.Errorf("checksum is not stable: %s, then %s", checksum, same)
+	}
+
+	err = ioutil.WriteFile(source, []byte("bye"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := recipe.getChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed == checksum {
+		t.Errorf("checksum is not changed after file is changed")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var sizeRegexp = regexp.MustCompile(`^(\d+)([KMGT]?)$`)
+
+// parseSize parses size like 512, 100K, 2G into bytes.
+func parseSize(size string) (uint64, error) {
+	matches := sizeRegexp.FindStringSubmatch(strings.ToUpper(size))
+	if matches == nil {
+		return 0, fmt.Errorf(
+			"invalid size '%s', expected number with optional "+
+				"K, M, G or T suffix",
+			size,
+		)
+	}
+
+	value, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s': %s", size, err)
+	}
+
+	shift := uint(0)
+	if matches[2] != "" {
+		shift = uint(strings.Index("KMGT", matches[2])+1) * 10
+	}
+
+	if value > ^uint64(0)>>shift {
+		return 0, fmt.Errorf("size '%s' is too large", size)
+	}
+
+	return value << shift, nil
+}
+
+func formatSize(size uint64) string {
+	units := "KMGT"
+
+	value := float64(size)
+	unit := ""
+	for i := 0; value >= 1024 && i < len(units); i++ {
+		value /= 1024
+		unit = string(units[i])
+	}
+
+	if unit == "" {
+		return fmt.Sprintf("%d", size)
+	}
+
+	return fmt.Sprintf("%.1f%s", value, unit)
+}
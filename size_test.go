@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	testcases := []struct {
+		size     string
+		valid    bool
+		expected uint64
+	}{
+		{"0", true, 0},
+		{"512", true, 512},
+		{"100K", true, 100 << 10},
+		{"100k", true, 100 << 10},
+		{"2M", true, 2 << 20},
+		{"2G", true, 2 << 30},
+		{"3T", true, 3 << 40},
+		{"16777215T", true, 16777215 << 40},
+		{"18446744073709551615", true, 18446744073709551615},
+		{"16777216T", false, 0},
+		{"18446744073709551616", false, 0},
+		{"", false, 0},
+		{"G", false, 0},
+		{"2P", false, 0},
+		{"2GB", false, 0},
+		{"1.5G", false, 0},
+		{"-1", false, 0},
+		{" 2G", false, 0},
+	}
+
+	for _, testcase := range testcases {
+		size, err := parseSize(testcase.size)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%q: expected error, got %d", testcase.size, size)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", testcase.size, err)
+			continue
+		}
+
+		if size != testcase.expected {
+			t.Errorf(
+				"%q: expected %d, got %d", testcase.size, testcase.expected, size,
+			)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	testcases := []struct {
+		size     uint64
+		expected string
+	}{
+		{0, "0"},
+		{1023, "1023"},
+		{1024, "1.0K"},
+		{1536, "1.5K"},
+		{2 << 30, "2.0G"},
+		{5 << 40, "5.0T"},
+		{2048 << 40, "2048.0T"},
+	}
+
+	for _, testcase := range testcases {
+		formatted := formatSize(testcase.size)
+		if formatted != testcase.expected {
+			t.Errorf(
+				"%d: expected %s, got %s",
+				testcase.size, testcase.expected, formatted,
+			)
+		}
+	}
+}
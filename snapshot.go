@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/reconquest/ser-go"
+)
+
+var snapshotNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+func validateSnapshotName(snapshot string) error {
+	if !snapshotNameRegexp.MatchString(snapshot) {
+		return fmt.Errorf(
+			"snapshot name '%s' should contain only letters, digits "+
+				"and any of '_.:-'",
+			snapshot,
+		)
+	}
+
+	return nil
+}
+
+// resetContainer reverts container to the state of its image.
+func resetContainer(
+	rootDir string,
+	containerName string,
+	force bool,
+	storageEngine storage,
+) error {
+	err := ensureContainerStopped(rootDir, containerName, force)
+	if err != nil {
+		return err
+	}
+
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't read state of container '%s'", containerName,
+		)
+	}
+
+	if state == nil || state.Image == "" {
+		return fmt.Errorf(
+			"image of container '%s' is unknown", containerName,
+		)
+	}
+
+	return storageEngine.ResetContainer(state.Image, containerName)
+}
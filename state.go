@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/reconquest/ser-go"
+)
+
+// containerState holds container options, which are remembered between
+// container runs.
+type containerState struct {
+	Image   string `json:"image"`
+	Address string `json:"address,omitempty"`
+	Bridge  string `json:"bridge,omitempty"`
+	Quota   string `json:"quota,omitempty"`
+
+	// ProjectID is project quota id of container upper dir on xfs and ext4.
+	ProjectID uint32 `json:"project_id,omitempty"`
+
+	Networks []containerNetwork `json:"networks,omitempty"`
+
+	// Network is network mode of container, if it's not bridge.
+	Network string `json:"network,omitempty"`
+
+	Ports []publishedPort `json:"ports,omitempty"`
+
+	Policy *networkPolicy `json:"policy,omitempty"`
+
+	// Veths are host sides of veth pairs of the container, which are
+	// discovered on container start.
+	Veths []string `json:"veths,omitempty"`
+}
+
+func getContainerStateFile(rootDir string, containerName string) string {
+	return filepath.Join(rootDir, "states", containerName+".json")
+}
+
+// readContainerState returns state of the container or nil if container has
+// no state, e.g. was created by older hastur version.
+func readContainerState(
+	rootDir string,
+	containerName string,
+) (*containerState, error) {
+	data, err := ioutil.ReadFile(getContainerStateFile(rootDir, containerName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var state containerState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode state of container '%s'", containerName,
+		)
+	}
+
+	return &state, nil
+}
+
+func writeContainerState(
+	rootDir string,
+	containerName string,
+	state *containerState,
+) error {
+	err := os.MkdirAll(filepath.Dir(getContainerStateFile(rootDir, "")), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(
+		getContainerStateFile(rootDir, containerName), data, 0644,
+	)
+}
+
+func removeContainerState(rootDir string, containerName string) error {
+	err := os.Remove(getContainerStateFile(rootDir, containerName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// getContainerImage returns image of container. Containers created by older
+// hastur versions have no state, so their image is asked from storage.
+func getContainerImage(
+	containerName string,
+	state *containerState,
+	storageEngine storage,
+) (string, error) {
+	if state != nil && state.Image != "" {
+		return state.Image, nil
+	}
+
+	imageStorage, ok := storageEngine.(containerImageStorage)
+	if !ok {
+		return "", fmt.Errorf(
+			"image of container '%s' is unknown, start container with "+
+				"-p, -R or -i once to remember it",
+			containerName,
+		)
+	}
+
+	return imageStorage.GetContainerImage(containerName)
+}
+
+// ensureContainerStopped returns error if container does not exist or if it
+// is running and operation is not forced.
+func ensureContainerStopped(
+	rootDir string,
+	containerName string,
+	force bool,
+) error {
+	if !isExists(getContainerDir(rootDir, containerName)) {
+		return fmt.Errorf("container '%s' does not exist", containerName)
+	}
+
+	active, err := listActiveContainers(containerSuffix)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := active[containerName]; ok && !force {
+		return fmt.Errorf(
+			"container '%s' is running and should be stopped first",
+			containerName,
+		)
+	}
+
+	return nil
+}
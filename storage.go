@@ -1,13 +1,62 @@
 package main
 
+import "io"
+
 type storage interface {
 	Init() error
 	DeInit() error
 	InitContainer(baseDir, container string) error
 	DeInitContainer(container string) error
-	InitImage(image string) error
+	InitImage(image, parent string) error
+	MountImage(image string) (string, error)
+	UmountImage(image string) error
 	DeInitImage(image string) error
+	RenameImage(image, newImage string) error
 	DestroyContainer(container string) error
-	GetContainerRoot(container string) string
+	CommitContainer(container, image, parent string) error
+	CloneContainer(container, newContainer string) error
+	ResetContainer(baseDir, container string) error
+	SnapshotContainer(container, snapshot string) error
+	RollbackContainer(container, snapshot string) error
+	RemoveContainerSnapshot(container, snapshot string) error
+	ListContainerSnapshots(container string) ([]string, error)
+	DiffContainer(baseDir, container string) ([]change, error)
+	SetContainerQuota(container string, size uint64) error
+	GetContainerUsage(container string) (uint64, error)
+	GetContainerRoot(container string) (string, error)
 	Destroy() error
 }
+
+// streamingStorage is implemented by storage engines, which can serialize
+// images and containers into their own stream format.
+type streamingStorage interface {
+	SendImage(image string, output io.Writer) error
+	ReceiveImage(image string, input io.Reader) error
+	SendContainer(container string, output io.Writer) error
+	ReceiveContainer(container string, input io.Reader) error
+}
+
+// readOnlyImageStorage is implemented by storage engines, which can protect
+// built images from modification.
+type readOnlyImageStorage interface {
+	SetImageReadOnly(image string, readonly bool) error
+}
+
+// statsStorage is implemented by storage engines, which can report detailed
+// disk usage of images and containers.
+type statsStorage interface {
+	GetImageStats(image string) (*storageStats, error)
+	GetContainerStats(container string) (*storageStats, error)
+}
+
+// containerImageStorage is implemented by storage engines, which can find
+// image of container without container state.
+type containerImageStorage interface {
+	GetContainerImage(container string) (string, error)
+}
+
+type storageStats struct {
+	Used          uint64 `json:"used"`
+	Referenced    uint64 `json:"referenced"`
+	CompressRatio string `json:"compressratio"`
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+const externalStorageDriverPrefix = `hastur-storage-`
+
+// externalStorageRequest is passed to the driver on stdin. Driver is also
+// invoked with method name as first argument.
+type externalStorageRequest struct {
+	Method    string                 `json:"method"`
+	RootDir   string                 `json:"root_dir"`
+	Options   map[string]string      `json:"options"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+// externalStorageResponse should be written by the driver to stdout.
+type externalStorageResponse struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// externalStorage is storage, which is implemented by external program
+// named hastur-storage-<engine>, which receives JSON request for every method
+// of storage interface and responds with JSON.
+type externalStorage struct {
+	driver  string
+	rootDir string
+	options map[string]string
+}
+
+func getExternalStorageDriver(engine string) (string, error) {
+	return exec.LookPath(externalStorageDriverPrefix + engine)
+}
+
+func NewExternalStorage(rootDir string, spec *storageSpec) (storage, error) {
+	driver, err := getExternalStorageDriver(spec.Engine)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't find storage driver for '%s'", spec.Engine,
+		)
+	}
+
+	return &externalStorage{
+		driver:  driver,
+		rootDir: rootDir,
+		options: spec.Options,
+	}, nil
+}
+
+// validateExternalStorage asks driver to validate options without making
+// any changes on host.
+func validateExternalStorage(spec *storageSpec) error {
+	storageEngine, err := NewExternalStorage("", spec)
+	if err != nil {
+		return err
+	}
+
+	return storageEngine.(*externalStorage).call("Validate", nil, nil)
+}
+
+func (storage *externalStorage) call(
+	method string,
+	arguments map[string]interface{},
+	result interface{},
+) error {
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+
+	request, err := json.Marshal(externalStorageRequest{
+		Method:    method,
+		RootDir:   storage.rootDir,
+		Options:   storage.options,
+		Arguments: arguments,
+	})
+	if err != nil {
+		return err
+	}
+
+	command := exec.Command(storage.driver, method)
+	command.Stdin = bytes.NewReader(request)
+
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return ser.Errorf(
+			err, "storage driver '%s' failed on %s", storage.driver, method,
+		)
+	}
+
+	var response externalStorageResponse
+	err = json.Unmarshal(output, &response)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't decode response of storage driver '%s' on %s",
+			storage.driver, method,
+		)
+	}
+
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+
+	err = json.Unmarshal(response.Result, result)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't decode result of storage driver '%s' on %s",
+			storage.driver, method,
+		)
+	}
+
+	return nil
+}
+
+func (storage *externalStorage) Init() error {
+	return storage.call("Init", nil, nil)
+}
+
+func (storage *externalStorage) DeInit() error {
+	return storage.call("DeInit", nil, nil)
+}
+
+func (storage *externalStorage) InitContainer(
+	baseDir string,
+	containerName string,
+) error {
+	return storage.call("InitContainer", map[string]interface{}{
+		"base_dir":  baseDir,
+		"container": containerName,
+	}, nil)
+}
+
+func (storage *externalStorage) DeInitContainer(containerName string) error {
+	return storage.call("DeInitContainer", map[string]interface{}{
+		"container": containerName,
+	}, nil)
+}
+
+func (storage *externalStorage) InitImage(image, parent string) error {
+	return storage.call("InitImage", map[string]interface{}{
+		"image":  image,
+		"parent": parent,
+	}, nil)
+}
+
+func (storage *externalStorage) MountImage(image string) (string, error) {
+	var root string
+	err := storage.call("MountImage", map[string]interface{}{
+		"image": image,
+	}, &root)
+	if err != nil {
+		return "", err
+	}
+
+	if root == "" {
+		return "", fmt.Errorf(
+			"storage driver '%s' returned empty root for image %s",
+			storage.driver, image,
+		)
+	}
+
+	return root, nil
+}
+
+func (storage *externalStorage) UmountImage(image string) error {
+	return storage.call("UmountImage", map[string]interface{}{
+		"image": image,
+	}, nil)
+}
+
+func (storage *externalStorage) DeInitImage(image string) error {
+	return storage.call("DeInitImage", map[string]interface{}{
+		"image": image,
+	}, nil)
+}
+
+func (storage *externalStorage) RenameImage(image, newImage string) error {
+	return storage.call("RenameImage", map[string]interface{}{
+		"image":     image,
+		"new_image": newImage,
+	}, nil)
+}
+
+func (storage *externalStorage) DestroyContainer(containerName string) error {
+	return storage.call("DestroyContainer", map[string]interface{}{
+		"container": containerName,
+	}, nil)
+}
+
+func (storage *externalStorage) CommitContainer(
+	containerName string,
+	image string,
+	parent string,
+) error {
+	return storage.call("CommitContainer", map[string]interface{}{
+		"container": containerName,
+		"image":     image,
+		"parent":    parent,
+	}, nil)
+}
+
+func (storage *externalStorage) CloneContainer(
+	containerName string,
+	newContainerName string,
+) error {
+	return storage.call("CloneContainer", map[string]interface{}{
+		"container":     containerName,
+		"new_container": newContainerName,
+	}, nil)
+}
+
+func (storage *externalStorage) ResetContainer(
+	baseDir string,
+	containerName string,
+) error {
+	return storage.call("ResetContainer", map[string]interface{}{
+		"base_dir":  baseDir,
+		"container": containerName,
+	}, nil)
+}
+
+func (storage *externalStorage) SnapshotContainer(
+	containerName string,
+	snapshot string,
+) error {
+	return storage.call("SnapshotContainer", map[string]interface{}{
+		"container": containerName,
+		"snapshot":  snapshot,
+	}, nil)
+}
+
+func (storage *externalStorage) RollbackContainer(
+	containerName string,
+	snapshot string,
+) error {
+	return storage.call("RollbackContainer", map[string]interface{}{
+		"container": containerName,
+		"snapshot":  snapshot,
+	}, nil)
+}
+
+func (storage *externalStorage) RemoveContainerSnapshot(
+	containerName string,
+	snapshot string,
+) error {
+	return storage.call("RemoveContainerSnapshot", map[string]interface{}{
+		"container": containerName,
+		"snapshot":  snapshot,
+	}, nil)
+}
+
+func (storage *externalStorage) ListContainerSnapshots(
+	containerName string,
+) ([]string, error) {
+	snapshots := []string{}
+	err := storage.call("ListContainerSnapshots", map[string]interface{}{
+		"container": containerName,
+	}, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+func (storage *externalStorage) DiffContainer(
+	baseDir string,
+	containerName string,
+) ([]change, error) {
+	changes := []change{}
+	err := storage.call("DiffContainer", map[string]interface{}{
+		"base_dir":  baseDir,
+		"container": containerName,
+	}, &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (storage *externalStorage) SetContainerQuota(
+	containerName string,
+	size uint64,
+) error {
+	return storage.call("SetContainerQuota", map[string]interface{}{
+		"container": containerName,
+		"size":      size,
+	}, nil)
+}
+
+func (storage *externalStorage) GetContainerUsage(
+	containerName string,
+) (uint64, error) {
+	var usage uint64
+	err := storage.call("GetContainerUsage", map[string]interface{}{
+		"container": containerName,
+	}, &usage)
+	if err != nil {
+		return 0, err
+	}
+
+	return usage, nil
+}
+
+func (storage *externalStorage) GetContainerRoot(
+	containerName string,
+) (string, error) {
+	var root string
+	err := storage.call("GetContainerRoot", map[string]interface{}{
+		"container": containerName,
+	}, &root)
+	if err != nil {
+		return "", err
+	}
+
+	return root, nil
+}
+
+func (storage *externalStorage) Destroy() error {
+	return storage.call("Destroy", nil, nil)
+}
@@ -1,37 +1,67 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"strings"
 
+	"github.com/reconquest/executil-go"
 	"github.com/reconquest/ser-go"
 )
 
 const defaultOverlayFSSize = "1G"
 
+var overlayFSStorageOptions = storageOptions{
+	"tmpfs-size": func(value string) error {
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			return errors.New("size should be greater than zero")
+		}
+
+		return nil
+	},
+
+	"upper": func(value string) error {
+		switch value {
+		case "auto", "tmpfs":
+			return nil
+		}
+
+		return errors.New("should be either 'auto' or 'tmpfs'")
+	},
+}
+
 type overlayFSStorage struct {
-	tmpfsSize string
-	rootDir   string
+	tmpfsSize  string
+	forceTmpfs bool
+	rootDir    string
 }
 
-func NewOverlayFSStorage(rootDir, spec string) (storage, error) {
-	args := strings.Split(spec, ":")
+func NewOverlayFSStorage(rootDir string, spec *storageSpec) (storage, error) {
 	size := defaultOverlayFSSize
-
-	// TODO: validate size parameter
-	if len(args) == 2 {
-		size = args[1]
+	if spec.Options["tmpfs-size"] != "" {
+		size = spec.Options["tmpfs-size"]
 	}
 
 	return &overlayFSStorage{
-		rootDir:   rootDir,
-		tmpfsSize: size,
+		rootDir:    rootDir,
+		tmpfsSize:  size,
+		forceTmpfs: spec.Options["upper"] == "tmpfs",
 	}, nil
 }
 
 func (storage *overlayFSStorage) Init() error {
+	if storage.forceTmpfs {
+		return storage.fixUnsupportedFS()
+	}
+
 	FSType, err := getFSType(storage.rootDir)
 	if err != nil {
 		return ser.Errorf(
@@ -41,7 +71,7 @@ func (storage *overlayFSStorage) Init() error {
 	}
 
 	switch FSType {
-	case "tmpfs", "ext", "ext2", "ext3", "ext4", "btrfs":
+	case "tmpfs", "ext", "ext2", "ext3", "ext4", "btrfs", "xfs":
 		return nil
 
 	default:
@@ -59,14 +89,72 @@ func (storage *overlayFSStorage) Init() error {
 	return nil
 }
 
-func (storage *overlayFSStorage) InitImage(image string) error {
+func (storage *overlayFSStorage) InitImage(image, parent string) error {
 	return os.MkdirAll(getImageDir(storage.rootDir, image), 0755)
 }
 
+// MountImage returns root of the image, which is ready for modification.
+// Layered images are mounted as overlay, where image dir is used as upper dir
+// on top of all parent layers.
+func (storage *overlayFSStorage) MountImage(image string) (string, error) {
+	layers, err := getImageLayers(storage.rootDir, image)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't get layers of image %s", image,
+		)
+	}
+
+	if len(layers) == 1 {
+		return layers[0], nil
+	}
+
+	buildDir := getImageBuildDir(storage.rootDir, image)
+	imageRoot := filepath.Join(buildDir, "root")
+
+	for _, dir := range []string{"root", ".overlay.workdir"} {
+		err := os.MkdirAll(filepath.Join(buildDir, dir), 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = mountOverlay(
+		layers[1:],
+		layers[0],
+		filepath.Join(buildDir, ".overlay.workdir"),
+		imageRoot,
+	)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't mount overlay fs for image %s", image,
+		)
+	}
+
+	return imageRoot, nil
+}
+
+func (storage *overlayFSStorage) UmountImage(image string) error {
+	buildDir := getImageBuildDir(storage.rootDir, image)
+	if !isExists(buildDir) {
+		return nil
+	}
+
+	_ = umount(filepath.Join(buildDir, "root"))
+
+	return os.RemoveAll(buildDir)
+}
+
 func (storage *overlayFSStorage) DeInitImage(image string) error {
 	return os.RemoveAll(getImageDir(storage.rootDir, image))
 }
 
+func (storage *overlayFSStorage) RenameImage(image, newImage string) error {
+	return os.Rename(
+		getImageDir(storage.rootDir, image),
+		getImageDir(storage.rootDir, newImage),
+	)
+}
+
 func (storage *overlayFSStorage) DeInit() error {
 	return nil
 }
@@ -77,10 +165,13 @@ func (storage *overlayFSStorage) InitContainer(
 ) error {
 	containerDir := getContainerDir(storage.rootDir, containerName)
 
-	containerRoot := storage.GetContainerRoot(containerName)
+	containerRoot, err := storage.GetContainerRoot(containerName)
+	if err != nil {
+		return err
+	}
 
-	for _, dir := range []string{"root", ".nspawn.root", ".overlay.workdir"} {
-		err := os.MkdirAll(
+	for _, dir := range []string{".nspawn.root", ".overlay.workdir"} {
+		err = os.MkdirAll(
 			filepath.Join(containerDir, dir),
 			0755,
 		)
@@ -90,8 +181,22 @@ func (storage *overlayFSStorage) InitContainer(
 		}
 	}
 
-	err := mountOverlay(
-		getImageDir(storage.rootDir, baseDir),
+	err = createUpperDir(filepath.Join(containerDir, "root"))
+	if err != nil {
+		return ser.Errorf(
+			err, "can't create upper dir for '%s'", containerName,
+		)
+	}
+
+	layers, err := getImageLayers(storage.rootDir, baseDir)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get layers of image %s", baseDir,
+		)
+	}
+
+	err = mountOverlay(
+		layers,
 		filepath.Join(containerDir, "root"),
 		filepath.Join(containerDir, ".overlay.workdir"),
 		containerRoot,
@@ -107,14 +212,21 @@ func (storage *overlayFSStorage) InitContainer(
 	return nil
 }
 
-func (storage *overlayFSStorage) GetContainerRoot(containerName string) string {
+func (storage *overlayFSStorage) GetContainerRoot(
+	containerName string,
+) (string, error) {
 	containerDir := getContainerDir(storage.rootDir, containerName)
 
-	return filepath.Join(containerDir, ".nspawn.root")
+	return filepath.Join(containerDir, ".nspawn.root"), nil
 }
 
 func (storage *overlayFSStorage) DeInitContainer(containerName string) error {
-	return umount(storage.GetContainerRoot(containerName))
+	containerRoot, err := storage.GetContainerRoot(containerName)
+	if err != nil {
+		return err
+	}
+
+	return umount(containerRoot)
 }
 
 func (storage *overlayFSStorage) Destroy() error {
@@ -124,9 +236,232 @@ func (storage *overlayFSStorage) Destroy() error {
 func (storage *overlayFSStorage) DestroyContainer(containerName string) error {
 	_ = storage.DeInitContainer(containerName)
 
+	_ = removeUpperDir(
+		filepath.Join(getContainerDir(storage.rootDir, containerName), "root"),
+	)
+
 	return removeContainerDir(getContainerDir(storage.rootDir, containerName))
 }
 
+// CommitContainer creates image, which is a copy of container's upper dir
+// on top of the container's image.
+func (storage *overlayFSStorage) CommitContainer(
+	containerName string,
+	image string,
+	parent string,
+) error {
+	err := storage.InitImage(image, parent)
+	if err != nil {
+		return err
+	}
+
+	return copyTree(
+		filepath.Join(getContainerDir(storage.rootDir, containerName), "root"),
+		getImageDir(storage.rootDir, image),
+	)
+}
+
+// CloneContainer copies container's upper dir into new container, which
+// will use the same image.
+func (storage *overlayFSStorage) CloneContainer(
+	containerName string,
+	newContainerName string,
+) error {
+	containerDir := getContainerDir(storage.rootDir, newContainerName)
+
+	for _, dir := range []string{".nspawn.root", ".overlay.workdir"} {
+		err := os.MkdirAll(filepath.Join(containerDir, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := createUpperDir(filepath.Join(containerDir, "root"))
+	if err != nil {
+		return err
+	}
+
+	return copyTree(
+		filepath.Join(getContainerDir(storage.rootDir, containerName), "root"),
+		filepath.Join(containerDir, "root"),
+	)
+}
+
+// ResetContainer removes all changes made in container's upper dir.
+func (storage *overlayFSStorage) ResetContainer(
+	baseDir string,
+	containerName string,
+) error {
+	return storage.restoreUpperDir(containerName, "")
+}
+
+// SnapshotContainer saves copy of container's upper dir.
+func (storage *overlayFSStorage) SnapshotContainer(
+	containerName string,
+	snapshot string,
+) error {
+	snapshotDir := storage.getSnapshotDir(containerName, snapshot)
+	if isExists(snapshotDir) {
+		return fmt.Errorf("snapshot '%s' already exists", snapshot)
+	}
+
+	err := os.MkdirAll(snapshotDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = copyTree(
+		filepath.Join(getContainerDir(storage.rootDir, containerName), "root"),
+		snapshotDir,
+	)
+	if err != nil {
+		_ = os.RemoveAll(snapshotDir)
+		return err
+	}
+
+	return nil
+}
+
+// RollbackContainer replaces container's upper dir with saved copy.
+func (storage *overlayFSStorage) RollbackContainer(
+	containerName string,
+	snapshot string,
+) error {
+	snapshotDir := storage.getSnapshotDir(containerName, snapshot)
+	if !isExists(snapshotDir) {
+		return fmt.Errorf("snapshot '%s' does not exist", snapshot)
+	}
+
+	return storage.restoreUpperDir(containerName, snapshotDir)
+}
+
+func (storage *overlayFSStorage) RemoveContainerSnapshot(
+	containerName string,
+	snapshot string,
+) error {
+	snapshotDir := storage.getSnapshotDir(containerName, snapshot)
+	if !isExists(snapshotDir) {
+		return fmt.Errorf("snapshot '%s' does not exist", snapshot)
+	}
+
+	return os.RemoveAll(snapshotDir)
+}
+
+func (storage *overlayFSStorage) ListContainerSnapshots(
+	containerName string,
+) ([]string, error) {
+	entries, err := ioutil.ReadDir(storage.getSnapshotDir(containerName, ""))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+
+	snapshots := []string{}
+	for _, entry := range entries {
+		snapshots = append(snapshots, entry.Name())
+	}
+
+	return snapshots, nil
+}
+
+// DiffContainer reads changes directly from container's upper dir.
+func (storage *overlayFSStorage) DiffContainer(
+	baseDir string,
+	containerName string,
+) ([]change, error) {
+	layers, err := getImageLayers(storage.rootDir, baseDir)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't get layers of image %s", baseDir,
+		)
+	}
+
+	return diffOverlayUpperDir(
+		filepath.Join(getContainerDir(storage.rootDir, containerName), "root"),
+		layers,
+	)
+}
+
+// SetContainerQuota limits size of container's upper dir using project quotas
+// on xfs and ext4 or qgroups on btrfs.
+func (storage *overlayFSStorage) SetContainerQuota(
+	containerName string,
+	size uint64,
+) error {
+	upperDir := filepath.Join(
+		getContainerDir(storage.rootDir, containerName), "root",
+	)
+
+	return setDirQuota(
+		upperDir,
+		size,
+		func() (uint32, error) {
+			return getContainerProjectID(
+				storage.rootDir, containerName, upperDir,
+			)
+		},
+	)
+}
+
+func (storage *overlayFSStorage) GetContainerUsage(
+	containerName string,
+) (uint64, error) {
+	return getDirUsage(
+		filepath.Join(getContainerDir(storage.rootDir, containerName), "root"),
+	)
+}
+
+func (storage *overlayFSStorage) getSnapshotDir(
+	containerName string,
+	snapshot string,
+) string {
+	return filepath.Join(
+		getContainerDir(storage.rootDir, containerName),
+		".snapshots",
+		snapshot,
+	)
+}
+
+// restoreUpperDir recreates container's upper dir and work dir and copies
+// contents of source dir into it, if source is specified.
+func (storage *overlayFSStorage) restoreUpperDir(
+	containerName string,
+	source string,
+) error {
+	_ = storage.DeInitContainer(containerName)
+
+	containerDir := getContainerDir(storage.rootDir, containerName)
+
+	err := os.RemoveAll(filepath.Join(containerDir, ".overlay.workdir"))
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Join(containerDir, ".overlay.workdir"), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = removeUpperDir(filepath.Join(containerDir, "root"))
+	if err != nil {
+		return err
+	}
+
+	err = createUpperDir(filepath.Join(containerDir, "root"))
+	if err != nil {
+		return err
+	}
+
+	if source == "" {
+		return nil
+	}
+
+	return copyTree(source, filepath.Join(containerDir, "root"))
+}
+
 func (storage *overlayFSStorage) fixUnsupportedFS() error {
 	tmpfsMounted, err := isMounted("tmpfs", storage.rootDir)
 	if err != nil {
@@ -157,3 +492,41 @@ func (storage *overlayFSStorage) fixUnsupportedFS() error {
 
 	return nil
 }
+
+// createUpperDir creates upper dir for container. On btrfs upper dir is
+// created as subvolume, so qgroups can be used to limit its size.
+func createUpperDir(dir string) error {
+	if isExists(dir) {
+		return nil
+	}
+
+	fsType, err := getFSType(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+
+	if fsType == "btrfs" {
+		command := exec.Command("btrfs", "subvolume", "create", dir)
+		_, _, err := executil.Run(command)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	return os.MkdirAll(dir, 0755)
+}
+
+func removeUpperDir(dir string) error {
+	fsType, err := getFSType(dir)
+	if err == nil && fsType == "btrfs" {
+		command := exec.Command("btrfs", "subvolume", "delete", dir)
+		_, _, err := executil.Run(command)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
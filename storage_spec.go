@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	storageSpecAutodetect = `autodetect`
+	storageSpecFile       = `storage.json`
+)
+
+// storageOptions describes options supported by storage engine: option name
+// is mapped to function, which validates option value.
+type storageOptions map[string]func(value string) error
+
+// storageEngines lists known storage engines with their options and option,
+// which can be specified without name, like 'zfs:POOL'.
+var storageEngines = map[string]struct {
+	options       storageOptions
+	defaultOption string
+}{
+	"overlayfs": {overlayFSStorageOptions, "tmpfs-size"},
+	"zfs":       {zfsStorageOptions, "pool"},
+}
+
+// getStorageEngine returns options of built-in storage engine or nil options
+// if engine is implemented by external driver.
+func getStorageEngine(
+	name string,
+) (options storageOptions, defaultOption string, err error) {
+	engine, ok := storageEngines[name]
+	if ok {
+		return engine.options, engine.defaultOption, nil
+	}
+
+	_, err = getExternalStorageDriver(name)
+	if err != nil {
+		return nil, "", ser.Errorf(
+			err, "unknown storage engine '%s'", name,
+		)
+	}
+
+	return nil, "", nil
+}
+
+// storageSpec is parsed storage specification in form of
+// 'engine:key=value,key=value' or 'engine:value'.
+type storageSpec struct {
+	Engine  string            `json:"engine"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+func parseStorageSpec(spec string) (*storageSpec, error) {
+	engineName, optionsSpec := spec, ""
+	if colon := strings.Index(spec, ":"); colon >= 0 {
+		engineName, optionsSpec = spec[:colon], spec[colon+1:]
+	}
+
+	if engineName == storageSpecAutodetect {
+		engineName = "overlayfs"
+	}
+
+	_, defaultOption, err := getStorageEngine(engineName)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &storageSpec{
+		Engine:  engineName,
+		Options: map[string]string{},
+	}
+
+	if optionsSpec == "" {
+		return parsed, parsed.validate()
+	}
+
+	for _, option := range strings.Split(optionsSpec, ",") {
+		name, value := defaultOption, option
+		if equals := strings.Index(option, "="); equals >= 0 {
+			name, value = option[:equals], option[equals+1:]
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf(
+				"option '%s' should be specified as key=value", option,
+			)
+		}
+
+		if _, ok := parsed.Options[name]; ok {
+			return nil, fmt.Errorf(
+				"option '%s' is specified more than once", name,
+			)
+		}
+
+		parsed.Options[name] = value
+	}
+
+	return parsed, parsed.validate()
+}
+
+func (spec *storageSpec) validate() error {
+	options, _, err := getStorageEngine(spec.Engine)
+	if err != nil {
+		return err
+	}
+
+	// options of external storage are validated by driver itself
+	if options == nil {
+		return validateExternalStorage(spec)
+	}
+
+	for name, value := range spec.Options {
+		validate, ok := options[name]
+		if !ok {
+			return fmt.Errorf(
+				"unknown option '%s' for storage engine '%s', "+
+					"supported options: %s",
+				name, spec.Engine, strings.Join(options.names(), ", "),
+			)
+		}
+
+		if value == "" {
+			return fmt.Errorf("value of option '%s' is empty", name)
+		}
+
+		err := validate(value)
+		if err != nil {
+			return ser.Errorf(
+				err, "invalid value '%s' of option '%s'", value, name,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (spec *storageSpec) String() string {
+	options := []string{}
+	for name, value := range spec.Options {
+		options = append(options, name+"="+value)
+	}
+
+	if len(options) == 0 {
+		return spec.Engine
+	}
+
+	sort.Strings(options)
+
+	return spec.Engine + ":" + strings.Join(options, ",")
+}
+
+// conflicts returns true if spec uses another engine or any option, which
+// is specified in spec, has another value in other spec.
+func (spec *storageSpec) conflicts(other *storageSpec) bool {
+	if spec.Engine != other.Engine {
+		return true
+	}
+
+	for name, value := range spec.Options {
+		if other.Options[name] != value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// merge returns spec with options of other spec, which are not specified in
+// spec.
+func (spec *storageSpec) merge(other *storageSpec) *storageSpec {
+	merged := &storageSpec{
+		Engine:  spec.Engine,
+		Options: map[string]string{},
+	}
+
+	for name, value := range other.Options {
+		merged.Options[name] = value
+	}
+
+	for name, value := range spec.Options {
+		merged.Options[name] = value
+	}
+
+	return merged
+}
+
+func (options storageOptions) names() []string {
+	names := []string{}
+	for name := range options {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// readStorageSpec returns storage spec, which was used in the root dir
+// previously, or nil if root dir has no stored spec.
+func readStorageSpec(rootDir string) (*storageSpec, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rootDir, storageSpecFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var spec storageSpec
+	err = json.Unmarshal(data, &spec)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode %s", storageSpecFile,
+		)
+	}
+
+	if spec.Options == nil {
+		spec.Options = map[string]string{}
+	}
+
+	err = spec.validate()
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "invalid storage spec in %s", storageSpecFile,
+		)
+	}
+
+	return &spec, nil
+}
+
+func writeStorageSpec(rootDir string, spec *storageSpec) error {
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(
+		filepath.Join(rootDir, storageSpecFile), data, 0644,
+	)
+}
+
+func removeStorageSpec(rootDir string) error {
+	err := os.Remove(filepath.Join(rootDir, storageSpecFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStorageSpec(t *testing.T) {
+	testcases := []struct {
+		spec     string
+		valid    bool
+		expected storageSpec
+	}{
+		{
+			spec:     "overlayfs",
+			valid:    true,
+			expected: storageSpec{"overlayfs", map[string]string{}},
+		},
+		{
+			spec:     "autodetect",
+			valid:    true,
+			expected: storageSpec{"overlayfs", map[string]string{}},
+		},
+		{
+			spec:  "overlayfs:2G",
+			valid: true,
+			expected: storageSpec{"overlayfs", map[string]string{
+				"tmpfs-size": "2G",
+			}},
+		},
+		{
+			spec:  "overlayfs:tmpfs-size=512M,upper=tmpfs",
+			valid: true,
+			expected: storageSpec{"overlayfs", map[string]string{
+				"tmpfs-size": "512M",
+				"upper":      "tmpfs",
+			}},
+		},
+		{
+			spec:  "zfs:tank/hastur",
+			valid: true,
+			expected: storageSpec{"zfs", map[string]string{
+				"pool": "tank/hastur",
+			}},
+		},
+		{
+			spec:  "zfs:pool=tank,compression=zstd-3,image.recordsize=1M",
+			valid: true,
+			expected: storageSpec{"zfs", map[string]string{
+				"pool":             "tank",
+				"compression":      "zstd-3",
+				"image.recordsize": "1M",
+			}},
+		},
+		{
+			spec:  "zfs:pool=tank,container.atime=off,dedup=verify",
+			valid: true,
+			expected: storageSpec{"zfs", map[string]string{
+				"pool":            "tank",
+				"container.atime": "off",
+				"dedup":           "verify",
+			}},
+		},
+		{spec: "nosuchengine", valid: false},
+		{spec: "overlayfs:upper=disk", valid: false},
+		{spec: "overlayfs:tmpfs-size=0", valid: false},
+		{spec: "overlayfs:tmpfs-size=2X", valid: false},
+		{spec: "overlayfs:tmpfs-size=", valid: false},
+		{spec: "overlayfs:=2G", valid: false},
+		{spec: "overlayfs:2G,tmpfs-size=1G", valid: false},
+		{spec: "overlayfs:pool=tank", valid: false},
+		{spec: "zfs:pool=/tank", valid: false},
+		{spec: "zfs:pool=tank,compression=brotli", valid: false},
+		{spec: "zfs:pool=tank,recordsize=1000", valid: false},
+		{spec: "zfs:pool=tank,recordsize=32M", valid: false},
+		{spec: "zfs:pool=tank,atime=yes", valid: false},
+		{spec: "zfs:pool=tank,mountpoint=relative", valid: false},
+		{spec: "zfs:pool=tank,image.pool=other", valid: false},
+	}
+
+	for _, testcase := range testcases {
+		spec, err := parseStorageSpec(testcase.spec)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", testcase.spec)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.spec, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(*spec, testcase.expected) {
+			t.Errorf(
+				"%s: expected %v, got %v",
+				testcase.spec, testcase.expected, *spec,
+			)
+		}
+	}
+}
+
+func TestStorageSpecString(t *testing.T) {
+	testcases := []struct {
+		spec     string
+		expected string
+	}{
+		{"overlayfs", "overlayfs"},
+		{"autodetect", "overlayfs"},
+		{"overlayfs:2G", "overlayfs:tmpfs-size=2G"},
+		{"zfs:tank,atime=off", "zfs:atime=off,pool=tank"},
+	}
+
+	for _, testcase := range testcases {
+		spec, err := parseStorageSpec(testcase.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.spec, err)
+			continue
+		}
+
+		if spec.String() != testcase.expected {
+			t.Errorf(
+				"%s: expected %s, got %s",
+				testcase.spec, testcase.expected, spec.String(),
+			)
+		}
+
+		// string representation is parsed back into the same spec
+		reparsed, err := parseStorageSpec(spec.String())
+		if err != nil || !reflect.DeepEqual(reparsed, spec) {
+			t.Errorf("%s: can't parse back %s", testcase.spec, spec.String())
+		}
+	}
+}
+
+func TestStorageSpecConflicts(t *testing.T) {
+	testcases := []struct {
+		spec      string
+		stored    string
+		conflicts bool
+	}{
+		{"zfs:tank", "zfs:tank", false},
+		{"zfs", "zfs:pool=tank,atime=off", false},
+		{"zfs:tank,atime=off", "zfs:pool=tank", true},
+		{"zfs:other", "zfs:tank", true},
+		{"overlayfs", "zfs:tank", true},
+	}
+
+	for _, testcase := range testcases {
+		spec, err := parseStorageSpec(testcase.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := parseStorageSpec(testcase.stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spec.conflicts(stored) != testcase.conflicts {
+			t.Errorf(
+				"%s with stored %s: expected conflicts %v",
+				testcase.spec, testcase.stored, testcase.conflicts,
+			)
+		}
+	}
+}
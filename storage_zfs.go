@@ -2,16 +2,120 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+const (
+	zfsExportSnapshot = "hastur-export"
+	zfsSnapshotPrefix = "snapshot-"
+)
+
+// zfsDatasetProperties lists properties, which can be set for root, image
+// and container datasets, e.g. 'compression=lz4' for root dataset or
+// 'image.compression=zstd' for image datasets only.
+var zfsDatasetProperties = storageOptions{
+	"compression": func(value string) error {
+		if !zfsCompressionRegexp.MatchString(value) {
+			return errors.New(
+				"should be one of on, off, lz4, lzjb, zle, gzip[-N], zstd[-N]",
+			)
+		}
+
+		return nil
+	},
+
+	"recordsize": func(value string) error {
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+
+		if size < 512 || size > 16<<20 || size&(size-1) != 0 {
+			return errors.New(
+				"should be power of two between 512 and 16M",
+			)
+		}
+
+		return nil
+	},
+
+	"atime": func(value string) error {
+		switch value {
+		case "on", "off":
+			return nil
+		}
+
+		return errors.New("should be either on or off")
+	},
+
+	"dedup": func(value string) error {
+		switch value {
+		case "on", "off", "verify", "sha256", "sha512", "skein", "edonr":
+			return nil
+		}
+
+		return errors.New(
+			"should be one of on, off, verify, sha256, sha512, skein, edonr",
+		)
+	},
+}
+
+var zfsStorageOptions = newZFSStorageOptions()
+
+func newZFSStorageOptions() storageOptions {
+	options := storageOptions{
+		"pool": func(value string) error {
+			if !zfsDatasetRegexp.MatchString(value) {
+				return errors.New("should be valid ZFS dataset name")
+			}
+
+			return nil
+		},
+
+		"mountpoint": func(value string) error {
+			if !filepath.IsAbs(value) {
+				return errors.New("should be absolute path")
+			}
+
+			return nil
+		},
+	}
+
+	for name, validate := range zfsDatasetProperties {
+		for _, prefix := range []string{"", "image.", "container."} {
+			options[prefix+name] = validate
+		}
+	}
+
+	return options
+}
+
+var (
+	zfsDatasetRegexp     = regexp.MustCompile(`^[a-zA-Z0-9][\w.:-]*(/[\w.:-]+)*$`)
+	zfsCompressionRegexp = regexp.MustCompile(
+		`^(on|off|lz4|lzjb|zle|gzip(-[1-9])?|zstd(-(1[0-9]|[1-9]))?)$`,
+	)
 )
 
 type zfsStorage struct {
 	pool    string
 	rootDir string
+
+	// properties are set on the root dataset, so they are inherited by all
+	// images and containers.
+	properties []string
+
+	imageProperties     []string
+	containerProperties []string
 }
 
 func doZFSCommand(parameters ...string) error {
@@ -24,29 +128,84 @@ func doZFSCommand(parameters ...string) error {
 	return nil
 }
 
-func NewZFSStorage(rootDir, spec string) (storage, error) {
-	args := strings.Split(spec, ":")
-	pool := ""
-
-	// TODO: validate pool parameter
-	if len(args) == 2 {
-		pool = args[1]
-	}
-
+func NewZFSStorage(rootDir string, spec *storageSpec) (storage, error) {
+	pool := spec.Options["pool"]
 	if pool == "" {
 		return nil, errors.New(
 			"pool name should be specified",
 		)
 	}
 
-	return &zfsStorage{
+	storage := &zfsStorage{
 		pool:    pool,
 		rootDir: rootDir,
-	}, nil
+	}
+
+	// images and containers are accessed by paths inside root dir, so root
+	// dataset can be mounted only there
+	if mountpoint, ok := spec.Options["mountpoint"]; ok {
+		absRootDir, err := filepath.Abs(rootDir)
+		if err != nil {
+			return nil, formatAbsPathError(rootDir, err)
+		}
+
+		if filepath.Clean(mountpoint) != absRootDir {
+			return nil, fmt.Errorf(
+				"mountpoint should be root dir '%s'", absRootDir,
+			)
+		}
+
+		storage.properties = append(
+			storage.properties, "mountpoint="+absRootDir,
+		)
+	}
+
+	for _, name := range zfsDatasetProperties.names() {
+		if value, ok := spec.Options[name]; ok {
+			storage.properties = append(
+				storage.properties, name+"="+value,
+			)
+		}
+
+		if value, ok := spec.Options["image."+name]; ok {
+			storage.imageProperties = append(
+				storage.imageProperties, name+"="+value,
+			)
+		}
+
+		if value, ok := spec.Options["container."+name]; ok {
+			storage.containerProperties = append(
+				storage.containerProperties, name+"="+value,
+			)
+		}
+	}
+
+	return storage, nil
 }
 
+// Init creates root dataset with properties from storage spec. Properties
+// of existing root dataset are changed only if they differ from the spec,
+// so datasets of running containers are not remounted.
 func (storage *zfsStorage) Init() error {
-	err := doZFSCommand(
+	rootDataset := filepath.Join(storage.pool, storage.rootDir)
+
+	var err error
+	if doZFSCommand("list", rootDataset) != nil {
+		err = doZFSCommand(
+			append(
+				append([]string{"create", "-p"},
+					getZFSPropertyArgs(storage.properties)...),
+				rootDataset,
+			)...,
+		)
+	} else {
+		err = updateZFSProperties(rootDataset, storage.properties)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = doZFSCommand(
 		"create",
 		"-p",
 		filepath.Join(storage.pool, getContainerDir(storage.rootDir, "")),
@@ -67,11 +226,37 @@ func (storage *zfsStorage) Init() error {
 	return nil
 }
 
-func (storage *zfsStorage) InitImage(image string) error {
-	err := doZFSCommand(
-		"create",
-		"-p",
-		filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+func (storage *zfsStorage) InitImage(image, parent string) error {
+	if parent == "" {
+		return doZFSCommand(
+			append(
+				append([]string{"create", "-p"},
+					getZFSPropertyArgs(storage.imageProperties)...),
+				filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+			)...,
+		)
+	}
+
+	snapshot := filepath.Join(
+		storage.pool,
+		getImageDir(storage.rootDir, parent),
+	) + "@" + image
+
+	err := doZFSCommand("list", snapshot)
+	if err != nil {
+		err = doZFSCommand("snapshot", snapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = doZFSCommand(
+		append(
+			append([]string{"clone"},
+				getZFSPropertyArgs(storage.imageProperties)...),
+			snapshot,
+			filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+		)...,
 	)
 	if err != nil {
 		return err
@@ -80,10 +265,67 @@ func (storage *zfsStorage) InitImage(image string) error {
 	return nil
 }
 
+func (storage *zfsStorage) MountImage(image string) (string, error) {
+	return getImageDir(storage.rootDir, image), nil
+}
+
+// SetImageReadOnly sets readonly property of image dataset, so built images
+// can't be modified by accident.
+func (storage *zfsStorage) SetImageReadOnly(image string, readonly bool) error {
+	value := "off"
+	if readonly {
+		value = "on"
+	}
+
+	return doZFSCommand(
+		"set", "readonly="+value,
+		filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+	)
+}
+
+func (storage *zfsStorage) GetImageStats(image string) (*storageStats, error) {
+	return getZFSStats(
+		filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+	)
+}
+
+func (storage *zfsStorage) GetContainerStats(
+	containerName string,
+) (*storageStats, error) {
+	return getZFSStats(storage.getContainerDataset(containerName))
+}
+
+func (storage *zfsStorage) UmountImage(image string) error {
+	return nil
+}
+
 func (storage *zfsStorage) DeInitImage(image string) error {
+	dataset := filepath.Join(storage.pool, getImageDir(storage.rootDir, image))
+
+	origin, _ := getZFSOrigin(dataset)
+
+	err := doZFSCommand("destroy", dataset)
+	if err != nil {
+		return err
+	}
+
+	// snapshot of the parent image is not needed anymore, unless it's used
+	// by other images or containers
+	imagesDataset := filepath.Join(
+		storage.pool, getImageDir(storage.rootDir, ""),
+	)
+	if strings.HasPrefix(origin, imagesDataset+"/") {
+		_ = doZFSCommand("destroy", origin)
+	}
+
+	return nil
+}
+
+func (storage *zfsStorage) RenameImage(image, newImage string) error {
 	err := doZFSCommand(
-		"destroy",
+		"rename",
 		filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+		filepath.Join(storage.pool, getImageDir(storage.rootDir, newImage)),
 	)
 	if err != nil {
 		return err
@@ -101,6 +343,17 @@ func (storage *zfsStorage) InitContainer(
 	containerName string,
 ) error {
 	err := doZFSCommand(
+		"list",
+		filepath.Join(
+			storage.pool,
+			getContainerDir(storage.rootDir, containerName),
+		),
+	)
+	if err == nil {
+		return nil
+	}
+
+	err = doZFSCommand(
 		"list",
 		filepath.Join(
 			storage.pool,
@@ -123,38 +376,29 @@ func (storage *zfsStorage) InitContainer(
 	}
 
 	err = doZFSCommand(
-		"list",
-		filepath.Join(
-			storage.pool,
-			getContainerDir(storage.rootDir, containerName),
-		),
-	)
-
-	if err != nil {
-		err = doZFSCommand(
-			"clone",
+		append(
+			append([]string{"clone"},
+				getZFSPropertyArgs(storage.containerProperties)...),
 			filepath.Join(
 				storage.pool,
 				getImageDir(storage.rootDir, baseDir),
 			)+"@"+containerName,
-			filepath.Join(
-				storage.pool,
-				getContainerDir(storage.rootDir, containerName),
-			),
-		)
-
-		if err != nil {
-			return err
-		}
+			storage.getContainerDataset(containerName),
+		)...,
+	)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func (storage *zfsStorage) GetContainerRoot(containerName string) string {
+func (storage *zfsStorage) GetContainerRoot(
+	containerName string,
+) (string, error) {
 	containerDir := getContainerDir(storage.rootDir, containerName)
 
-	return containerDir
+	return containerDir, nil
 }
 
 func (storage *zfsStorage) DeInitContainer(containerName string) error {
@@ -170,11 +414,523 @@ func (storage *zfsStorage) Destroy() error {
 }
 
 func (storage *zfsStorage) DestroyContainer(containerName string) error {
+	dataset := filepath.Join(storage.pool, getContainerDir(
+		storage.rootDir,
+		containerName,
+	))
+
+	origin, _ := getZFSOrigin(dataset)
+
+	err := doZFSCommand("destroy", "-r", dataset)
+	if err != nil {
+		return err
+	}
+
+	// image snapshot, which was created for the container, is not needed
+	// anymore, unless it's still used by clones of the container
+	imagesDataset := filepath.Join(
+		storage.pool, getImageDir(storage.rootDir, ""),
+	)
+	if strings.HasPrefix(origin, imagesDataset+"/") {
+		_ = doZFSCommand("destroy", origin)
+	}
+
+	return nil
+}
+
+// getZFSOrigin returns snapshot, which dataset was cloned from, or empty
+// string if dataset is not a clone.
+func getZFSOrigin(dataset string) (string, error) {
+	command := exec.Command(
+		"zfs", "get", "-H", "-o", "value", "origin", dataset,
+	)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return "", err
+	}
+
+	origin := strings.TrimSpace(string(output))
+	if origin == "-" {
+		return "", nil
+	}
+
+	return origin, nil
+}
+
+// GetContainerImage returns image, which snapshot container dataset was
+// cloned from.
+func (storage *zfsStorage) GetContainerImage(
+	containerName string,
+) (string, error) {
+	origin, err := getZFSOrigin(storage.getContainerDataset(containerName))
+	if err != nil {
+		return "", err
+	}
+
+	imagesDataset := filepath.Join(
+		storage.pool, getImageDir(storage.rootDir, ""),
+	)
+	if !strings.HasPrefix(origin, imagesDataset+"/") {
+		return "", fmt.Errorf(
+			"container '%s' is not a clone of image", containerName,
+		)
+	}
+
+	image := strings.TrimPrefix(origin, imagesDataset+"/")
+
+	return strings.SplitN(image, "@", 2)[0], nil
+}
+
+// CloneContainer copies container dataset by zfs send and receive, so both
+// containers can be destroyed independently. New container becomes clone of
+// the same image snapshot as the source container, so only container changes
+// are copied.
+func (storage *zfsStorage) CloneContainer(
+	containerName string,
+	newContainerName string,
+) error {
+	source := storage.getContainerDataset(containerName)
+	dataset := storage.getContainerDataset(newContainerName)
+
+	origin, err := getZFSOrigin(source)
+	if err != nil {
+		return err
+	}
+
+	err = copyZFSDataset(source, dataset, origin)
+	if err != nil {
+		return err
+	}
+
+	return setZFSProperties(dataset, storage.containerProperties)
+}
+
+// CommitContainer copies container dataset into image dataset by zfs send
+// and receive, so image and container can be destroyed independently and
+// snapshots of container are kept. Like the container, image becomes clone
+// of the parent image snapshot, so only container changes are copied.
+func (storage *zfsStorage) CommitContainer(
+	containerName string,
+	image string,
+	parent string,
+) error {
+	imageDataset := filepath.Join(
+		storage.pool,
+		getImageDir(storage.rootDir, image),
+	)
+
+	containerDataset := storage.getContainerDataset(containerName)
+
+	origin, err := getZFSOrigin(containerDataset)
+	if err != nil {
+		return err
+	}
+
+	err = copyZFSDataset(containerDataset, imageDataset, origin)
+	if err != nil {
+		return err
+	}
+
+	return setZFSProperties(imageDataset, storage.imageProperties)
+}
+
+func (storage *zfsStorage) SendImage(image string, output io.Writer) error {
+	return sendZFSDataset(
+		filepath.Join(storage.pool, getImageDir(storage.rootDir, image)),
+		output,
+	)
+}
+
+func (storage *zfsStorage) ReceiveImage(image string, input io.Reader) error {
+	dataset := filepath.Join(storage.pool, getImageDir(storage.rootDir, image))
+
+	err := receiveZFSDataset(dataset, input)
+	if err != nil {
+		return err
+	}
+
+	return setZFSProperties(dataset, storage.imageProperties)
+}
+
+func (storage *zfsStorage) SendContainer(
+	containerName string,
+	output io.Writer,
+) error {
+	return sendZFSDataset(
+		filepath.Join(
+			storage.pool,
+			getContainerDir(storage.rootDir, containerName),
+		),
+		output,
+	)
+}
+
+func (storage *zfsStorage) ReceiveContainer(
+	containerName string,
+	input io.Reader,
+) error {
+	dataset := storage.getContainerDataset(containerName)
+
+	err := receiveZFSDataset(dataset, input)
+	if err != nil {
+		return err
+	}
+
+	return setZFSProperties(dataset, storage.containerProperties)
+}
+
+func sendZFSDataset(
+	dataset string,
+	output io.Writer,
+	args ...string,
+) error {
+	snapshot := dataset + "@" + zfsExportSnapshot
+
+	_ = doZFSCommand("destroy", snapshot)
+
+	err := doZFSCommand("snapshot", snapshot)
+	if err != nil {
+		return err
+	}
+
+	defer doZFSCommand("destroy", snapshot)
+
+	command := exec.Command(
+		"zfs", append(append([]string{"send"}, args...), snapshot)...,
+	)
+	command.Stdout = output
+
+	_, _, err = executil.Run(command, executil.IgnoreStdout)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func receiveZFSDataset(
+	dataset string,
+	input io.Reader,
+	args ...string,
+) error {
+	command := exec.Command(
+		"zfs", append(append([]string{"receive"}, args...), dataset)...,
+	)
+	command.Stdin = input
+
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return doZFSCommand("destroy", dataset+"@"+zfsExportSnapshot)
+}
+
+// copyZFSDataset copies current state of dataset into new dataset, which
+// doesn't depend on the source one. If origin is specified, source should be
+// its clone and only changes relative to origin are copied, new dataset
+// becomes clone of the origin.
+func copyZFSDataset(source string, target string, origin string) error {
+	sendArgs, receiveArgs := []string{}, []string{}
+	if origin != "" {
+		sendArgs = []string{"-i", origin}
+		receiveArgs = []string{"-o", "origin=" + origin}
+	}
+
+	reader, writer := io.Pipe()
+
+	sent := make(chan error, 1)
+	go func() {
+		err := sendZFSDataset(source, writer, sendArgs...)
+		writer.CloseWithError(err)
+		sent <- err
+	}()
+
+	err := receiveZFSDataset(target, reader, receiveArgs...)
+
+	// unblocks sender if receive has failed
+	reader.Close()
+
+	sendErr := <-sent
+	if err != nil {
+		return err
+	}
+
+	return sendErr
+}
+
+// ResetContainer destroys container dataset with all its snapshots and clones
+// it from the image again.
+func (storage *zfsStorage) ResetContainer(
+	baseDir string,
+	containerName string,
+) error {
+	err := doZFSCommand(
+		"destroy",
+		"-r",
+		storage.getContainerDataset(containerName),
+	)
+	if err != nil {
+		return err
+	}
+
+	return storage.InitContainer(baseDir, containerName)
+}
+
+func (storage *zfsStorage) SnapshotContainer(
+	containerName string,
+	snapshot string,
+) error {
+	return doZFSCommand(
+		"snapshot",
+		storage.getContainerSnapshot(containerName, snapshot),
+	)
+}
+
+// RollbackContainer rolls container dataset back to the snapshot. Snapshots,
+// which were created after specified one, are destroyed.
+func (storage *zfsStorage) RollbackContainer(
+	containerName string,
+	snapshot string,
+) error {
+	return doZFSCommand(
+		"rollback",
+		"-r",
+		storage.getContainerSnapshot(containerName, snapshot),
+	)
+}
+
+func (storage *zfsStorage) RemoveContainerSnapshot(
+	containerName string,
+	snapshot string,
+) error {
 	return doZFSCommand(
 		"destroy",
-		filepath.Join(storage.pool, getContainerDir(
-			storage.rootDir,
-			containerName,
-		)),
+		storage.getContainerSnapshot(containerName, snapshot),
 	)
 }
+
+func (storage *zfsStorage) ListContainerSnapshots(
+	containerName string,
+) ([]string, error) {
+	dataset := storage.getContainerDataset(containerName)
+
+	command := exec.Command(
+		"zfs", "list", "-H", "-t", "snapshot", "-o", "name", "-s", "creation",
+		"-d", "1", dataset,
+	)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []string{}
+	for _, name := range strings.Split(string(output), "\n") {
+		prefix := dataset + "@" + zfsSnapshotPrefix
+		if strings.HasPrefix(name, prefix) {
+			snapshots = append(snapshots, strings.TrimPrefix(name, prefix))
+		}
+	}
+
+	return snapshots, nil
+}
+
+// DiffContainer compares container dataset with the snapshot it was cloned
+// from.
+func (storage *zfsStorage) DiffContainer(
+	baseDir string,
+	containerName string,
+) ([]change, error) {
+	dataset := storage.getContainerDataset(containerName)
+
+	origin, err := getZFSOrigin(dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	if origin == "" {
+		return nil, fmt.Errorf(
+			"container '%s' is not a clone of image", containerName,
+		)
+	}
+
+	command := exec.Command("zfs", "diff", "-H", origin, dataset)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	containerRoot, err := storage.GetContainerRoot(containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoint, err := filepath.Abs(containerRoot)
+	if err != nil {
+		return nil, formatAbsPathError(containerRoot, err)
+	}
+
+	return parseZFSDiff(string(output), mountpoint), nil
+}
+
+// SetContainerQuota sets refquota on container dataset, so snapshots are not
+// counted against the limit.
+func (storage *zfsStorage) SetContainerQuota(
+	containerName string,
+	size uint64,
+) error {
+	quota := "none"
+	if size > 0 {
+		quota = fmt.Sprint(size)
+	}
+
+	return doZFSCommand(
+		"set", "refquota="+quota, storage.getContainerDataset(containerName),
+	)
+}
+
+func (storage *zfsStorage) GetContainerUsage(
+	containerName string,
+) (uint64, error) {
+	command := exec.Command(
+		"zfs", "get", "-Hp", "-o", "value", "used",
+		storage.getContainerDataset(containerName),
+	)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+}
+
+func (storage *zfsStorage) getContainerDataset(containerName string) string {
+	return filepath.Join(
+		storage.pool,
+		getContainerDir(storage.rootDir, containerName),
+	)
+}
+
+func (storage *zfsStorage) getContainerSnapshot(
+	containerName string,
+	snapshot string,
+) string {
+	return storage.getContainerDataset(containerName) +
+		"@" + zfsSnapshotPrefix + snapshot
+}
+
+func getZFSPropertyArgs(properties []string) []string {
+	args := []string{}
+	for _, property := range properties {
+		args = append(args, "-o", property)
+	}
+
+	return args
+}
+
+func setZFSProperties(dataset string, properties []string) error {
+	if len(properties) == 0 {
+		return nil
+	}
+
+	return doZFSCommand(
+		append(append([]string{"set"}, properties...), dataset)...,
+	)
+}
+
+// updateZFSProperties sets properties, which differ from current values of
+// the dataset. Mountpoint of existing dataset is never changed, because
+// mounted datasets of images and containers would be moved.
+func updateZFSProperties(dataset string, properties []string) error {
+	changed := []string{}
+	for _, property := range properties {
+		parts := strings.SplitN(property, "=", 2)
+		name, value := parts[0], parts[1]
+
+		current, err := getZFSProperty(dataset, name)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't get %s of '%s'", name, dataset,
+			)
+		}
+
+		if isZFSPropertyEqual(name, value, current) {
+			continue
+		}
+
+		if name == "mountpoint" {
+			return fmt.Errorf(
+				"mountpoint of existing dataset '%s' is '%s' and "+
+					"can't be changed",
+				dataset, current,
+			)
+		}
+
+		changed = append(changed, property)
+	}
+
+	return setZFSProperties(dataset, changed)
+}
+
+// getZFSProperty returns value of the dataset property in parsable format,
+// e.g. record size in bytes.
+func getZFSProperty(dataset string, name string) (string, error) {
+	command := exec.Command(
+		"zfs", "get", "-Hp", "-o", "value", name, dataset,
+	)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func isZFSPropertyEqual(name string, value string, current string) bool {
+	if name != "recordsize" {
+		return value == current
+	}
+
+	size, err := parseSize(value)
+	if err != nil {
+		return false
+	}
+
+	return strconv.FormatUint(size, 10) == current
+}
+
+func getZFSStats(dataset string) (*storageStats, error) {
+	command := exec.Command(
+		"zfs", "get", "-Hp", "-o", "property,value",
+		"used,referenced,compressratio", dataset,
+	)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &storageStats{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "used":
+			stats.Used, err = strconv.ParseUint(fields[1], 10, 64)
+		case "referenced":
+			stats.Referenced, err = strconv.ParseUint(fields[1], 10, 64)
+		case "compressratio":
+			stats.CompressRatio = strings.TrimSuffix(fields[1], "x") + "x"
+		}
+
+		if err != nil {
+			return nil, ser.Errorf(
+				err, "can't parse %s of '%s'", fields[0], dataset,
+			)
+		}
+	}
+
+	return stats, nil
+}
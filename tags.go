@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/reconquest/ser-go"
+)
+
+var imageNameRegexp = regexp.MustCompile(`^[0-9a-f]{56}$`)
+
+func getTagsDir(rootDir string) string {
+	return filepath.Join(rootDir, "tags")
+}
+
+func validateTag(tag string) error {
+	switch {
+	case tag == "":
+		return errors.New("tag should not be empty")
+
+	case tag == "." || tag == "..":
+		return fmt.Errorf("tag '%s' is reserved", tag)
+
+	case strings.ContainsAny(tag, "/ \t\n"):
+		return fmt.Errorf(
+			"tag '%s' should not contain slashes or whitespaces", tag,
+		)
+
+	case imageNameRegexp.MatchString(tag):
+		return fmt.Errorf(
+			"tag '%s' can't be distinguished from image name", tag,
+		)
+	}
+
+	return nil
+}
+
+// resolveImage returns name of the image, which can be specified either by
+// tag or by name itself.
+func resolveImage(rootDir string, name string) (string, error) {
+	if !imageNameRegexp.MatchString(name) {
+		err := validateTag(name)
+		if err != nil {
+			return "", err
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(getTagsDir(rootDir), name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", fmt.Errorf("image '%s' is not found", name)
+			}
+
+			return "", ser.Errorf(
+				err, "can't read tag '%s'", name,
+			)
+		}
+
+		tag := name
+
+		name = strings.TrimSpace(string(data))
+		if !imageNameRegexp.MatchString(name) {
+			return "", fmt.Errorf(
+				"tag '%s' points to invalid image name '%s'", tag, name,
+			)
+		}
+	}
+
+	if !isExists(getImageDir(rootDir, name), ".hastur") {
+		return "", fmt.Errorf("image '%s' is not found", name)
+	}
+
+	return name, nil
+}
+
+func setTag(rootDir string, tag string, image string) error {
+	err := validateTag(tag)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(getTagsDir(rootDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(
+		filepath.Join(getTagsDir(rootDir), tag), []byte(image+"\n"), 0644,
+	)
+}
+
+func removeTag(rootDir string, tag string) error {
+	err := validateTag(tag)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(getTagsDir(rootDir), tag))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("tag '%s' is not found", tag)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// listTags returns tags grouped by images they point to.
+func listTags(rootDir string) (map[string][]string, error) {
+	tags := map[string][]string{}
+
+	files, err := ioutil.ReadDir(getTagsDir(rootDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tags, nil
+		}
+
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(
+			filepath.Join(getTagsDir(rootDir), file.Name()),
+		)
+		if err != nil {
+			return nil, ser.Errorf(
+				err, "can't read tag '%s'", file.Name(),
+			)
+		}
+
+		image := strings.TrimSpace(string(data))
+
+		tags[image] = append(tags[image], file.Name())
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveImageAndRemoveTagStayInTagsDir(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "hastur-tags-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(rootDir)
+
+	image := strings.Repeat("a", 56)
+
+	err = os.MkdirAll(getImageDir(rootDir, image), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(getImageDir(rootDir, image), ".hastur"), nil, 0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file outside of tags dir, which looks like a tag
+	err = ioutil.WriteFile(
+		filepath.Join(rootDir, "outside"), []byte(image+"\n"), 0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = setTag(rootDir, "base", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name  string
+		valid bool
+	}{
+		{"base", true},
+		{image, true},
+		{"missing", false},
+		{"../outside", false},
+		{"..", false},
+		{"", false},
+		{strings.Repeat("b", 56), false},
+	}
+
+	for _, testcase := range testcases {
+		resolved, err := resolveImage(rootDir, testcase.name)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", testcase.name, resolved)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", testcase.name, err)
+			continue
+		}
+
+		if resolved != image {
+			t.Errorf("%q: expected %s, got %s", testcase.name, image, resolved)
+		}
+	}
+
+	for _, tag := range []string{"../outside", "..", ""} {
+		if removeTag(rootDir, tag) == nil {
+			t.Errorf("%q: expected error on removal, got none", tag)
+		}
+	}
+
+	if !isExists(rootDir, "outside") {
+		t.Errorf("file outside of tags dir is removed")
+	}
+
+	err = removeTag(rootDir, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removeTag(rootDir, "base") == nil {
+		t.Errorf("removed tag is removed again")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+// uplinkState holds original network configuration of host interface, which
+// was added to the bridge using -t, so it can be restored later.
+type uplinkState struct {
+	Interface string   `json:"interface"`
+	Bridge    string   `json:"bridge"`
+	Addresses []string `json:"addresses"`
+	Routes    []string `json:"routes"`
+}
+
+func getUplinkStateFile(rootDir string, iface string) string {
+	return filepath.Join(rootDir, "uplinks", iface+".json")
+}
+
+// saveUplinkState remembers addresses and routes of host interface before it
+// will be added to the bridge. State is not overwritten if interface is
+// already added to the bridge by previous run.
+func saveUplinkState(rootDir string, iface string, bridge string) error {
+	stateFile := getUplinkStateFile(rootDir, iface)
+	if isExists(stateFile) {
+		return nil
+	}
+
+	addrs, err := getHostIPs(iface)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get addresses of interface %s", iface,
+		)
+	}
+
+	state := uplinkState{
+		Interface: iface,
+		Bridge:    bridge,
+		Addresses: []string{},
+		Routes:    []string{},
+	}
+
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, addr.String())
+	}
+
+	command := exec.Command("ip", "route", "show", "dev", iface)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't get routes of interface %s", iface,
+		)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		route := strings.Join(strings.Fields(line), " ")
+		if route != "" {
+			state.Routes = append(state.Routes, route)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(stateFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(stateFile, data, 0644)
+}
+
+func readUplinkState(rootDir string, iface string) (*uplinkState, error) {
+	data, err := ioutil.ReadFile(getUplinkStateFile(rootDir, iface))
+	if err != nil {
+		return nil, err
+	}
+
+	var state uplinkState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, ser.Errorf(
+			err, "can't decode state of uplink '%s'", iface,
+		)
+	}
+
+	return &state, nil
+}
+
+// restoreUplink removes host interface from the bridge, removes addresses and
+// routes, which were copied to the bridge, and returns them back to the
+// interface.
+func restoreUplink(rootDir string, iface string) error {
+	state, err := readUplinkState(rootDir, iface)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf(
+				"interface '%s' was not added to bridge by hastur", iface,
+			)
+		}
+
+		return err
+	}
+
+	err = removeInterfaceFromBridge(state.Interface, state.Bridge)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't remove '%s' from bridge '%s'",
+			state.Interface, state.Bridge,
+		)
+	}
+
+	// routes and addresses may be already removed from bridge, e.g. if bridge
+	// was recreated, so errors are ignored
+	for _, route := range state.Routes {
+		_ = execIpRoute("delete", state.Bridge, strings.Fields(route)...)
+	}
+
+	for _, address := range state.Addresses {
+		_ = deleteAddress(state.Bridge, address)
+	}
+
+	for _, address := range state.Addresses {
+		err = ensureAddress("", address, state.Interface)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't restore address %s on '%s'",
+				address, state.Interface,
+			)
+		}
+	}
+
+	for _, route := range state.Routes {
+		err = execIpRoute("add", state.Interface, strings.Fields(route)...)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't restore route '%s' on '%s'",
+				route, state.Interface,
+			)
+		}
+	}
+
+	err = os.Remove(getUplinkStateFile(rootDir, iface))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// restoreUnusedUplinks restores host interfaces, which were added to the
+// bridge, if no containers are attached to the bridge anymore.
+func restoreUnusedUplinks(rootDir string, bridge string) error {
+	files, err := filepath.Glob(getUplinkStateFile(rootDir, "*"))
+	if err != nil {
+		return err
+	}
+
+	uplinks := map[string]bool{}
+	for _, file := range files {
+		uplinks[strings.TrimSuffix(filepath.Base(file), ".json")] = true
+	}
+
+	if len(uplinks) == 0 {
+		return nil
+	}
+
+	ports, err := getBridgePorts(bridge)
+	if err != nil {
+		return ser.Errorf(
+			err, "can't list interfaces of bridge '%s'", bridge,
+		)
+	}
+
+	for _, port := range ports {
+		if !uplinks[port] {
+			return nil
+		}
+	}
+
+	for _, port := range ports {
+		err := restoreUplink(rootDir, port)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't restore configuration of '%s'", port,
+			)
+		}
+	}
+
+	return nil
+}
+
+func getBridgePorts(bridge string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join("/sys/class/net", bridge, "brif"))
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []string{}
+	for _, entry := range entries {
+		ports = append(ports, entry.Name())
+	}
+
+	return ports, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/ser-go"
+)
+
+// vethPeerRegexp matches ifindex of the veth peer in ip link output, e.g.
+// "2: host0@if5: <...>".
+var vethPeerRegexp = regexp.MustCompile(`^\d+: [^:@]+@if(\d+):`)
+
+// hasVeth returns true if interface is connected to host by veth pair.
+func hasVeth(iface containerInterface) bool {
+	switch iface.Mode {
+	case "", networkModeBridge, networkModeVeth:
+		return true
+	}
+
+	return false
+}
+
+// getExpectedVethName returns name of the host side of veth pair, which
+// systemd-nspawn will create for the interface.
+func getExpectedVethName(
+	containerName string,
+	iface containerInterface,
+) string {
+	if iface.HostName != "" {
+		return iface.HostName
+	}
+
+	return getVethHostName("vb-", containerName+containerSuffix)
+}
+
+// getInterfaceAlias returns alias, which marks host side of veth pair of
+// the container.
+func getInterfaceAlias(containerName string) string {
+	return "hastur:" + containerName
+}
+
+func readInterfaceAlias(iface string) (string, error) {
+	alias, err := ioutil.ReadFile(
+		filepath.Join("/sys/class/net", iface, "ifalias"),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(alias)), nil
+}
+
+func setInterfaceAlias(iface string, alias string) error {
+	command := exec.Command("ip", "link", "set", "dev", iface, "alias", alias)
+	_, _, err := executil.Run(command)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ensureVethNamesFree checks, that host interfaces, which will be created
+// for the container, don't exist. Interfaces left by previous run of the same
+// container are removed.
+func ensureVethNamesFree(
+	containerName string,
+	interfaces []containerInterface,
+) error {
+	for _, iface := range interfaces {
+		if !hasVeth(iface) {
+			continue
+		}
+
+		name := getExpectedVethName(containerName, iface)
+
+		if !isExists("/sys/class/net", name) {
+			continue
+		}
+
+		alias, _ := readInterfaceAlias(name)
+		if alias == getInterfaceAlias(containerName) {
+			err := deleteInterface(name)
+			if err != nil {
+				return ser.Errorf(
+					err, "can't remove stale interface '%s'", name,
+				)
+			}
+
+			continue
+		}
+
+		return fmt.Errorf(
+			"host interface '%s' for container '%s' already exists, "+
+				"probably it belongs to another container with similar "+
+				"name, use another container name",
+			name, containerName,
+		)
+	}
+
+	return nil
+}
+
+// getVethPeer returns name of the host side of veth pair, which is connected
+// to specified interface in the container network namespace.
+func getVethPeer(namespace string, iface string) (string, error) {
+	command := exec.Command(
+		"ip", "-n", namespace, "-o", "link", "show", "dev", iface,
+	)
+	output, _, err := executil.Run(command)
+	if err != nil {
+		return "", err
+	}
+
+	matches := vethPeerRegexp.FindStringSubmatch(string(output))
+	if matches == nil {
+		return "", fmt.Errorf(
+			"interface %s is not veth: %q", iface, output,
+		)
+	}
+
+	index, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return "", err
+	}
+
+	peer, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return "", ser.Errorf(
+			err, "can't find host interface with index %d", index,
+		)
+	}
+
+	return peer.Name, nil
+}
+
+// discoverVethPeers finds host sides of veth pairs of container interfaces,
+// marks them with alias of the container and records them in container
+// state.
+func discoverVethPeers(
+	rootDir string,
+	containerName string,
+	interfaces []containerInterface,
+) error {
+	veths := []string{}
+
+	for i, iface := range interfaces {
+		if !hasVeth(iface) {
+			continue
+		}
+
+		peer, err := getVethPeer(containerName, iface.Name)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't find veth peer of %s", iface.Name,
+			)
+		}
+
+		err = setInterfaceAlias(peer, getInterfaceAlias(containerName))
+		if err != nil {
+			return ser.Errorf(
+				err, "can't set alias of '%s'", peer,
+			)
+		}
+
+		if iface.Mode == networkModeVeth || iface.HostName != "" {
+			interfaces[i].HostName = peer
+		}
+
+		veths = append(veths, peer)
+	}
+
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil || state == nil {
+		return err
+	}
+
+	state.Veths = veths
+
+	return writeContainerState(rootDir, containerName, state)
+}
+
+// cleanupNetworkInterface removes host sides of veth pairs, which are
+// recorded in container state and still belong to the container.
+func cleanupNetworkInterface(rootDir string, containerName string) error {
+	state, err := readContainerState(rootDir, containerName)
+	if err != nil || state == nil {
+		return err
+	}
+
+	for _, veth := range state.Veths {
+		alias, err := readInterfaceAlias(veth)
+		if err != nil || alias != getInterfaceAlias(containerName) {
+			continue
+		}
+
+		err = deleteInterface(veth)
+		if err != nil {
+			return ser.Errorf(
+				err, "can't remove interface '%s'", veth,
+			)
+		}
+	}
+
+	return nil
+}